@@ -0,0 +1,182 @@
+// Authentication and roles for the websocket. If you start SPJS with
+// -authfile then every websocket upgrade has to present a token or a
+// user/password from that file, and each user gets a role that decides
+// which commands they may run. Without -authfile everybody is an admin
+// just like before so existing setups keep working.
+//
+// A client can authenticate with any of
+//   ws://host:8989/ws?token=abc123
+//   ws://host:8989/ws?user=bob&pass=blah
+//   an Authorization: Bearer abc123 header
+//   an Authorization: Basic header (i.e. ws://bob:blah@host:8989/ws)
+//
+// The auth file looks like
+//   {"Users":[
+//     {"Name":"pendant", "Token":"abc123", "Role":"viewer"},
+//     {"Name":"bob", "Pass":"blah", "Role":"operator"}
+//   ]}
+// and can optionally override the commands a role may call with
+//   "Roles":{"viewer":["list","version"]}
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+// each role may call the commands of the roles below it. which role a
+// command needs is set in the command table in commands.go.
+var roleLevels = map[string]int{
+	roleViewer:   1,
+	roleOperator: 2,
+	roleAdmin:    3,
+}
+
+// roles the auth file gave its own list of commands
+var roleCmds = map[string][]string{}
+
+// authLock guards authConf and roleCmds. A reload swaps both at once while
+// every connection's reader is checking them.
+var authLock sync.RWMutex
+
+type AuthUser struct {
+	Name  string
+	Token string
+	Pass  string
+	Role  string
+}
+
+type AuthConfig struct {
+	Users []AuthUser
+	Roles map[string][]string
+}
+
+// nil means auth is off and everybody is an admin
+var authConf *AuthConfig
+
+func loadAuthFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var conf AuthConfig
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return errors.New("Problem decoding auth file " + path + ". " + err.Error())
+	}
+	// build it all up on the side so a bad file leaves the old one in place
+	// and roles taken out of the file go away
+	cmds := map[string][]string{}
+	for name, list := range conf.Roles {
+		cmds[strings.ToLower(name)] = list
+	}
+	for i, u := range conf.Users {
+		conf.Users[i].Role = strings.ToLower(u.Role)
+		if len(u.Token) == 0 && len(u.Pass) == 0 {
+			return errors.New("User " + u.Name + " in the auth file has no Token or Pass")
+		}
+		_, isLevel := roleLevels[conf.Users[i].Role]
+		if _, isListed := cmds[conf.Users[i].Role]; !isLevel && !isListed {
+			return errors.New("User " + u.Name + " in the auth file has an unknown role " + u.Role)
+		}
+	}
+	authLock.Lock()
+	authConf = &conf
+	roleCmds = cmds
+	authLock.Unlock()
+	log.Printf("Loaded %v users from auth file %v\n", len(conf.Users), path)
+	return nil
+}
+
+// currentAuthConf gives back the auth file we have now, or nil if auth is off
+func currentAuthConf() *AuthConfig {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	return authConf
+}
+
+func secretsMatch(a string, b string) bool {
+	return len(a) > 0 && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// authenticate figures out who is on the other end of a websocket upgrade.
+// ok is false if auth is on and they didn't give us anything we recognize.
+func authenticate(r *http.Request) (user string, role string, ok bool) {
+	conf := currentAuthConf()
+	if conf == nil {
+		return "", roleAdmin, true
+	}
+
+	token := r.URL.Query().Get("token")
+	name := r.URL.Query().Get("user")
+	pass := r.URL.Query().Get("pass")
+	if bu, bp, isBasic := r.BasicAuth(); isBasic {
+		name, pass = bu, bp
+	} else if ah := r.Header.Get("Authorization"); strings.HasPrefix(ah, "Bearer ") {
+		token = strings.TrimPrefix(ah, "Bearer ")
+	}
+
+	for _, u := range conf.Users {
+		if secretsMatch(u.Token, token) {
+			return u.Name, u.Role, true
+		}
+		if len(name) > 0 && u.Name == name && secretsMatch(u.Pass, pass) {
+			return u.Name, u.Role, true
+		}
+	}
+	return "", "", false
+}
+
+// mayRun tells us whether a role is allowed to call cmd
+func mayRun(role string, cmd string) bool {
+	sc, isFound := spjsCmdsByName[cmd]
+	if !isFound {
+		return false
+	}
+	if len(sc.Role) == 0 {
+		return true
+	}
+	authLock.RLock()
+	cmds, isListed := roleCmds[role]
+	authLock.RUnlock()
+	if isListed {
+		for _, allowed := range cmds {
+			if allowed == "*" || strings.ToLower(allowed) == sc.Name {
+				return true
+			}
+		}
+		return false
+	}
+	level, isLevel := roleLevels[role]
+	return isLevel && level >= roleLevels[sc.Role]
+}
+
+// isAdmin tells us whether c is an admin. nil is SPJS itself.
+func isAdmin(c *connection) bool {
+	if c == nil {
+		return true
+	}
+	level, isLevel := roleLevels[c.role]
+	return isLevel && level >= roleLevels[roleAdmin]
+}
+
+func errNotAllowed(c *connection, cmd string) error {
+	return errors.New("Your role " + c.role + " is not allowed to run the " + cmd + " command")
+}
+
+func sendAuthErr(c *connection, cmd string) {
+	b, _ := json.Marshal(map[string]string{"Error": errNotAllowed(c, cmd).Error()})
+	h.direct <- directMsg{c, b}
+}
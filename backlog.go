@@ -0,0 +1,191 @@
+// When a client can't keep up, i.e. a browser on congested Wi-Fi, its send
+// channel fills. We used to just drop the connection, which made the
+// browser disappear mid job. Now, depending on -slowclient, we park what
+// it couldn't take in a backlog and let the writer catch up. Control
+// events like Complete, Error and OpenFail are always kept. Raw port data
+// is either dropped or coalesced into fewer, bigger messages. Once the
+// client has caught up it gets an Overflow message telling it what happened.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+const (
+	slowClientDisconnect = "disconnect" // the old behavior
+	slowClientDrop       = "drop"       // throw away raw data until the client catches up
+	slowClientCoalesce   = "coalesce"   // merge raw data per port until the client catches up
+)
+
+// how many control events we hold for a client before we give up on it
+var maxBacklog = 25600
+
+type backlog struct {
+	mu sync.Mutex
+
+	// true from the moment the send channel filled until the writer has
+	// drained everything we parked here
+	active bool
+	msgs   []outMsg
+	topics []msgTopic
+
+	// what we did while active, for the Overflow notice
+	dropped   int
+	coalesced int
+	delayed   int
+}
+
+type OverflowMsg struct {
+	Cmd       string
+	Dropped   int
+	Coalesced int
+	Delayed   int
+	Desc      string
+}
+
+// deliver hands m to c. It only ever runs inside the hub goroutine. It gives
+// back false if c had to be dropped.
+func (h *hub) deliver(c *connection, m []byte, seq int64, t *msgTopic) bool {
+	c.backlog.mu.Lock()
+	isActive := c.backlog.active
+	c.backlog.mu.Unlock()
+
+	if !isActive {
+		select {
+		case c.send <- outMsg{m, seq}:
+			return true
+		default:
+		}
+		if *slowClient == slowClientDisconnect {
+			h.dropConnection(c)
+			return false
+		}
+		log.Printf("Client %v can't keep up. Starting to backlog its messages.\n", c.id)
+	}
+
+	if t == nil {
+		topic := classifyMsg(m)
+		t = &topic
+	}
+
+	c.backlog.mu.Lock()
+	c.backlog.active = true
+	ok := c.backlog.add(outMsg{m, seq}, *t)
+	c.backlog.mu.Unlock()
+	if !ok {
+		log.Printf("Client %v has more than %v messages backlogged. Dropping it.\n", c.id, maxBacklog)
+		h.dropConnection(c)
+		return false
+	}
+
+	// nudge the writer in case it is sitting idle
+	select {
+	case c.wake <- true:
+	default:
+	}
+	return true
+}
+
+func (h *hub) dropConnection(c *connection) {
+	delete(h.connections, c)
+	releaseAllLeases(c)
+	stopAllShares(c)
+	endSession(c)
+	close(c.send)
+	go c.ws.Close()
+}
+
+// add parks a message. Must hold b.mu.
+func (b *backlog) add(out outMsg, t msgTopic) bool {
+	if t.Class == topicData {
+		if *slowClient == slowClientDrop {
+			b.dropped++
+			return true
+		}
+		// merge into the last message if it was data for the same port
+		last := len(b.msgs) - 1
+		if last >= 0 && b.topics[last].Class == topicData && b.topics[last].Port == t.Port {
+			if merged, ok := mergeDataMsgs(b.msgs[last].m, out.m); ok {
+				// it's out once the newer of the two is
+				b.msgs[last] = outMsg{merged, out.seq}
+				b.coalesced++
+				return true
+			}
+		}
+	}
+	if len(b.msgs) >= maxBacklog {
+		return false
+	}
+	b.msgs = append(b.msgs, out)
+	b.topics = append(b.topics, t)
+	b.delayed++
+	return true
+}
+
+// mergeDataMsgs glues two SpPortMessage/DataPerLine messages for the same port
+// together. Everything but D, i.e. Seq and ReadTs, is kept from the first one.
+// Encoded data is decoded, glued and encoded again. Frames are never glued
+// since that would undo the framing.
+func mergeDataMsgs(a []byte, b []byte) ([]byte, bool) {
+	var ma map[string]interface{}
+	var mb SpPortMessage
+	da := json.NewDecoder(bytes.NewReader(a))
+	da.UseNumber()
+	if da.Decode(&ma) != nil || json.Unmarshal(b, &mb) != nil {
+		return nil, false
+	}
+	d, ok := ma["D"].(string)
+	if isFrame, _ := ma["Frame"].(bool); !ok || isFrame || mb.Frame {
+		return nil, false
+	}
+	enc, _ := ma["Encoding"].(string)
+	if enc != mb.Encoding {
+		return nil, false
+	}
+	if len(enc) > 0 {
+		da, erra := decodeData(enc, d)
+		db, errb := decodeData(enc, mb.D)
+		if erra != nil || errb != nil {
+			return nil, false
+		}
+		ma["D"] = encodeData(enc, da+db)
+	} else {
+		ma["D"] = d + mb.D
+	}
+	merged, err := json.Marshal(ma)
+	if err != nil {
+		return nil, false
+	}
+	return merged, true
+}
+
+// takeBacklog hands the writer whatever is parked. Once there is nothing left
+// it turns the backlog off and gives back the Overflow notice to send.
+func (c *connection) takeBacklog() ([]outMsg, []byte) {
+	c.backlog.mu.Lock()
+	defer c.backlog.mu.Unlock()
+	b := &c.backlog
+	if !b.active {
+		return nil, nil
+	}
+	if len(b.msgs) > 0 {
+		msgs := b.msgs
+		b.msgs = nil
+		b.topics = nil
+		return msgs, nil
+	}
+	b.active = false
+	notice, _ := json.Marshal(OverflowMsg{
+		Cmd:       "Overflow",
+		Dropped:   b.dropped,
+		Coalesced: b.coalesced,
+		Delayed:   b.delayed,
+		Desc:      "You were not keeping up so we held back messages for you. Dropped and Coalesced count raw data messages.",
+	})
+	b.dropped, b.coalesced, b.delayed = 0, 0, 0
+	return nil, notice
+}
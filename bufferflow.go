@@ -1,5 +1,9 @@
 package main
 
+import (
+	"sync"
+)
+
 //"log"
 //"time"
 
@@ -34,6 +38,26 @@ type Bufferflow interface {
 	IsBufferGloballySendingBackIncomingData() bool            // implement this method
 	Close()                                                   // implement this method
 	RewriteSerialData(cmd string, id string) string           // implement this method
+	SetPort(port string)                                      // comes with bufferflowPort
+}
+
+// bufferflowPort is the port name a buffer flow puts on what it sends back.
+// It changes if the port reconnects under a new name. see reconnect.go.
+type bufferflowPort struct {
+	portLock sync.RWMutex
+	portName string
+}
+
+func (bp *bufferflowPort) SetPort(port string) {
+	bp.portLock.Lock()
+	bp.portName = port
+	bp.portLock.Unlock()
+}
+
+func (bp *bufferflowPort) port() string {
+	bp.portLock.RLock()
+	defer bp.portLock.RUnlock()
+	return bp.portName
 }
 
 /*data packets returned to client*/
@@ -9,7 +9,7 @@ import (
 
 type BufferflowDefault struct {
 	Name string
-	Port string
+	bufferflowPort
 }
 
 var ()
@@ -7,7 +7,7 @@ import (
 
 type BufferflowDummypause struct {
 	Name     string
-	Port     string
+	bufferflowPort
 	NumLines int
 	Paused   bool
 }
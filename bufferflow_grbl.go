@@ -16,7 +16,7 @@ import (
 
 type BufferflowGrbl struct {
 	Name           		string
-	Port           		string
+	bufferflowPort
 	parent_serport		*serport
 
 	Paused       		bool
@@ -157,12 +157,12 @@ func (b *BufferflowGrbl) rptQueryLoop(p *serport) {
 			select {
 			case <-ticker.C:
 
-				n2, err := p.portIo.Write([]byte("?"))
+				n2, err := p.io().Write([]byte("?"))
 
 				log.Print("Just wrote ", n2, " bytes to serial: ?")
 
 				if err != nil {
-					errstr := "Error writing to " + p.portConf.Name + " " + err.Error() + " Closing port."
+					errstr := "Error writing to " + p.name() + " " + err.Error() + " Closing port."
 					log.Print(errstr)
 					h.broadcastSys <- []byte(errstr)
 					ticker.Stop() //stop query loop if we can't write to the port
@@ -188,12 +188,12 @@ func (b *BufferflowGrbl) rxQueryLoop(p *serport) {
 			select {
 			case <-ticker.C:
 
-				n2, err := p.portIo.Write([]byte("?"))
+				n2, err := p.io().Write([]byte("?"))
 
 				log.Print("Just wrote ", n2, " bytes to serial: ?")
 
 				if err != nil {
-					errstr := "Error writing to " + p.portConf.Name + " " + err.Error() + " Closing port."
+					errstr := "Error writing to " + p.name() + " " + err.Error() + " Closing port."
 					log.Print(errstr)
 					h.broadcastSys <- []byte(errstr)
 					ticker.Stop() //stop query loop if we can't write to the port
@@ -307,13 +307,13 @@ func (b *BufferflowGrbl) BreakApartCommands(cmd string) []string {
 		item = strings.Replace(item, " ", "", -1)
 
 		if item == "*init*" { //return init string to update grbl widget when already connected to grbl
-			m := DataPerLine{b.Port, b.version + "\n"}
+			m := DataPerLine{b.port(), b.version + "\n"}
 			bm, err := json.Marshal(m)
 			if err == nil {
 				h.broadcastSys <- bm
 			}
 		} else if item == "*status*" { //return status when client first connects to existing open port
-			m := DataPerLine{b.Port, b.LastStatus + "\n"}
+			m := DataPerLine{b.port(), b.LastStatus + "\n"}
 			bm, err := json.Marshal(m)
 			if err == nil {
 				h.broadcastSys <- bm
@@ -495,7 +495,7 @@ func (b *BufferflowGrbl) OnIncomingData(data string) {
 
 				if b.ok.MatchString(element) {
 					// Send cmd:"Complete" back
-					m := DataCmdComplete{"Complete", id, b.Port, b.q.LenOfCmds(), doneCmd}
+					m := DataCmdComplete{"Complete", id, b.port(), b.q.LenOfCmds(), doneCmd}
 					bm, err := json.Marshal(m)
 					if err == nil {
 						h.broadcastSys <- bm
@@ -503,7 +503,7 @@ func (b *BufferflowGrbl) OnIncomingData(data string) {
 				} else if b.err.MatchString(element) {
 					// Send cmd:"Error" back
 					log.Printf("Error Response Received:%v, id:%v", doneCmd, id)
-					m := DataCmdComplete{"Error", id, b.Port, b.q.LenOfCmds(), doneCmd}
+					m := DataCmdComplete{"Error", id, b.port(), b.q.LenOfCmds(), doneCmd}
 					bm, err := json.Marshal(m)
 					if err == nil {
 						h.broadcastSys <- bm
@@ -573,7 +573,7 @@ func (b *BufferflowGrbl) OnIncomingData(data string) {
 		}
 		// handle communication back to client
 		// for base serial data (this is not the cmd:"Write" or cmd:"Complete")
-		m := DataPerLine{b.Port, element + "\n"}
+		m := DataPerLine{b.port(), element + "\n"}
 		bm, err := json.Marshal(m)
 		if err == nil {
 			h.broadcastSys <- bm
@@ -629,5 +629,5 @@ func (b *BufferflowGrbl) LocalBufferWipe(p *serport) {
 
 	// let user know we wiped queue
 	log.Printf("itemsInBuffer:%v\n", p.itemsInBuffer)
-	h.broadcastSys <- []byte("{\"Cmd\":\"WipedQueue\",\"QCnt\":" + strconv.Itoa(p.itemsInBuffer) + ",\"Port\":\"" + p.portConf.Name + "\"}")
+	h.broadcastSys <- []byte("{\"Cmd\":\"WipedQueue\",\"QCnt\":" + strconv.Itoa(p.itemsInBuffer) + ",\"Port\":\"" + p.name() + "\"}")
 }
@@ -12,7 +12,7 @@ import (
 
 type BufferflowMarlin struct {
 	Name      string
-	Port      string
+	bufferflowPort
 	Paused    bool
 	BufferMax int
 	q         *Queue
@@ -139,7 +139,7 @@ func (b *BufferflowMarlin) OnIncomingData(data string) {
 
 				if b.ok.MatchString(element) {
 					// Send cmd:"Complete" back
-					m := DataCmdComplete{"Complete", id, b.Port, b.q.LenOfCmds(), doneCmd}
+					m := DataCmdComplete{"Complete", id, b.port(), b.q.LenOfCmds(), doneCmd}
 					bm, err := json.Marshal(m)
 					if err == nil {
 						h.broadcastSys <- bm
@@ -147,7 +147,7 @@ func (b *BufferflowMarlin) OnIncomingData(data string) {
 				} else if b.err.MatchString(element) {
 					// Send cmd:"Error" back
 					log.Printf("Error Response Received:%v, id:%v", doneCmd, id)
-					m := DataCmdComplete{"Error", id, b.Port, b.q.LenOfCmds(), doneCmd}
+					m := DataCmdComplete{"Error", id, b.port(), b.q.LenOfCmds(), doneCmd}
 					bm, err := json.Marshal(m)
 					if err == nil {
 						h.broadcastSys <- bm
@@ -193,7 +193,7 @@ func (b *BufferflowMarlin) OnIncomingData(data string) {
 		}
 
 		// handle communication back to client
-		m := DataPerLine{b.Port, element + "\n"}
+		m := DataPerLine{b.port(), element + "\n"}
 		bm, err := json.Marshal(m)
 		if err == nil {
 			h.broadcastSys <- bm
@@ -245,13 +245,13 @@ func (b *BufferflowMarlin) BreakApartCommands(cmd string) []string {
 		item = strings.Replace(item, " ", "", -1)
 
 		if item == "*init*" { //return init string to update marlin widget when already connected to marlin
-			m := DataPerLine{b.Port, b.version + "\n"}
+			m := DataPerLine{b.port(), b.version + "\n"}
 			bm, err := json.Marshal(m)
 			if err == nil {
 				h.broadcastSys <- bm
 			}
 		} else if item == "*status*" { //return status when client first connects to existing open port
-			m := DataPerLine{b.Port, b.LastStatus + "\n"}
+			m := DataPerLine{b.port(), b.LastStatus + "\n"}
 			bm, err := json.Marshal(m)
 			if err == nil {
 				h.broadcastSys <- bm
@@ -378,12 +378,12 @@ func (b *BufferflowMarlin) rptQueryLoop(p *serport) {
 			select {
 			case <-ticker.C:
 
-				n2, err := p.portIo.Write([]byte("M114\n"))
+				n2, err := p.io().Write([]byte("M114\n"))
 
 				log.Print("Just wrote ", n2, " bytes to serial: M114")
 
 				if err != nil {
-					errstr := "Error writing to " + p.portConf.Name + " " + err.Error() + " Closing port."
+					errstr := "Error writing to " + p.name() + " " + err.Error() + " Closing port."
 					log.Print(errstr)
 					h.broadcastSys <- []byte(errstr)
 					ticker.Stop() //stop query loop if we can't write to the port
@@ -461,7 +461,7 @@ func (b *BufferflowMarlin) LocalBufferWipe(p *serport) {
 
 	// let user know we wiped queue
 	log.Printf("itemsInBuffer:%v\n", p.itemsInBuffer)
-	h.broadcastSys <- []byte("{\"Cmd\":\"WipedQueue\",\"QCnt\":" + strconv.Itoa(p.itemsInBuffer) + ",\"Port\":\"" + p.portConf.Name + "\"}")
+	h.broadcastSys <- []byte("{\"Cmd\":\"WipedQueue\",\"QCnt\":" + strconv.Itoa(p.itemsInBuffer) + ",\"Port\":\"" + p.name() + "\"}")
 }
 
 func (b *BufferflowMarlin) GetManualPaused() bool {
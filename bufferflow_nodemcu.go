@@ -11,7 +11,7 @@ import (
 
 type BufferflowNodeMcu struct {
 	Name string
-	Port string
+	bufferflowPort
 	//Output         chan []byte
 	Input          chan string
 	ticker         *time.Ticker
@@ -128,7 +128,7 @@ func (b *BufferflowNodeMcu) Init() {
 						doneCmd, id := b.q.Poll()
 
 						// Send cmd:"Complete" back
-						m := DataCmdComplete{"Complete", id, b.Port, b.q.Len(), doneCmd}
+						m := DataCmdComplete{"Complete", id, b.port(), b.q.Len(), doneCmd}
 						bm, err := json.Marshal(m)
 						if err == nil {
 							h.broadcastSys <- bm
@@ -162,7 +162,7 @@ func (b *BufferflowNodeMcu) Init() {
 
 				// handle communication back to client
 				// for base serial data (this is not the cmd:"Write" or cmd:"Complete")
-				m := DataPerLine{b.Port, element + "\n"}
+				m := DataPerLine{b.port(), element + "\n"}
 				bm, err := json.Marshal(m)
 				if err == nil {
 					h.broadcastSys <- bm
@@ -183,7 +183,7 @@ func (b *BufferflowNodeMcu) Init() {
 			b.ticker = time.NewTicker(16 * time.Millisecond)
 			for _ = range b.ticker.C {
 				if b.bufferedOutput != "" {
-					m := SpPortMessage{b.Port, b.bufferedOutput}
+					m := SpPortMessage{b.port(), b.bufferedOutput}
 					buf, _ := json.Marshal(m)
 					b.Output <- []byte(buf)
 					//log.Println(buf)
@@ -8,12 +8,15 @@ import (
 
 type BufferflowTimed struct {
 	Name           string
-	Port           string
+	bufferflowPort
 	Output         chan []byte
 	Input          chan string
+	Encoding       string // hex or base64 to encode what we send back
 	ticker         *time.Ticker
 	IsOpen         bool
 	bufferedOutput string
+	// when the first of the bytes in bufferedOutput came off the port
+	bufferedReadTs int64
 }
 
 /*
@@ -29,6 +32,9 @@ func (b *BufferflowTimed) Init() {
 
 	go func() {
 		for data := range b.Input {
+			if b.bufferedOutput == "" {
+				b.bufferedReadTs = nowMicros()
+			}
 			b.bufferedOutput = b.bufferedOutput + data
 
 		}
@@ -38,7 +44,11 @@ func (b *BufferflowTimed) Init() {
 		b.ticker = time.NewTicker(16 * time.Millisecond)
 		for _ = range b.ticker.C {
 			if b.bufferedOutput != "" {
-				m := SpPortMessage{b.Port, b.bufferedOutput}
+				m := SpPortMessage{b.port(), b.bufferedOutput, b.bufferedReadTs, "", false}
+				if b.Encoding == encodingHex || b.Encoding == encodingBase64 {
+					m.D = encodeData(b.Encoding, b.bufferedOutput)
+					m.Encoding = b.Encoding
+				}
 				buf, _ := json.Marshal(m)
 				b.Output <- []byte(buf)
 				//log.Println(buf)
@@ -16,7 +16,7 @@ import (
 
 type BufferflowTinyg struct {
 	Name         string
-	Port         string
+	bufferflowPort
 	Paused       bool
 	ManualPaused bool // indicates user hard paused the buffer on their own, i.e. not from flow control
 	//StopSending     int
@@ -241,7 +241,7 @@ func (b *BufferflowTinyg) Init() {
 
 	go func() {
 		time.Sleep(50 * time.Millisecond)
-		spWriteJson("sendjson {\"P\":\"" + b.parent_serport.portConf.Name + "\",\"Data\":[{\"D\":\"" + "{\\\"rxm\\\":0}\\n\", \"Id\":\"internalInit0\"}]}")
+		spWriteJson(nil, "sendjson {\"P\":\"" + b.parent_serport.name() + "\",\"Data\":[{\"D\":\"" + "{\\\"rxm\\\":0}\\n\", \"Id\":\"internalInit0\"}]}")
 
 	}()
 }
@@ -386,7 +386,7 @@ func (b *BufferflowTinyg) OnIncomingData(data string) {
 
 				//doneCmd := b.BufferCmdArray[0]
 				// Send cmd:"Complete" back
-				m := DataCmdComplete{"Complete", id, b.Port, b.q.LenOfCmds(), doneCmd}
+				m := DataCmdComplete{"Complete", id, b.port(), b.q.LenOfCmds(), doneCmd}
 				bm, err := json.Marshal(m)
 				if err == nil {
 					h.broadcastSys <- bm
@@ -572,7 +572,7 @@ func (b *BufferflowTinyg) OnIncomingData(data string) {
 
 		// handle communication back to client
 		// for base serial data (this is not the cmd:"Write" or cmd:"Complete")
-		m := DataPerLine{b.Port, element + "\n"}
+		m := DataPerLine{b.port(), element + "\n"}
 		bm, err := json.Marshal(m)
 		if err == nil {
 			h.broadcastSys <- bm
@@ -893,12 +893,12 @@ func (b *BufferflowTinyg) rxQueryLoop(p *serport) {
 
 				// we'll write a lazy formatted version of json to reduce the amt of chars
 				// chewed up since we're doing this outside the scope of the serial buffer counter
-				n2, err := p.portIo.Write([]byte("{rx:n}\n"))
+				n2, err := p.io().Write([]byte("{rx:n}\n"))
 
 				log.Print("Just wrote ", n2, " bytes to serial: {rx:n}")
 
 				if err != nil {
-					errstr := "Error writing to " + p.portConf.Name + " " + err.Error() + " Closing port."
+					errstr := "Error writing to " + p.name() + " " + err.Error() + " Closing port."
 					log.Print(errstr)
 					h.broadcastSys <- []byte(errstr)
 					ticker.Stop() //stop query loop if we can't write to the port
@@ -16,7 +16,7 @@ import (
 
 type BufferflowTinygV2 struct {
 	Name         string
-	Port         string
+	bufferflowPort
 	Paused       bool
 	ManualPaused bool // indicates user hard paused the buffer on their own, i.e. not from flow control
 	//StopSending     int
@@ -135,9 +135,9 @@ func (b *BufferflowTinygV2) Init() {
 
 	go func() {
 		time.Sleep(1500 * time.Millisecond)
-		//spWriteJson("sendjson {\"P\":\"" + b.parent_serport.portConf.Name + "\",\"Data\":[{\"D\":\"" + "{\\\"rxm\\\":0}\\n\", \"Id\":\"internalInit0\", \"Pause\":50}]}")
+		//spWriteJson(nil, "sendjson {\"P\":\"" + b.parent_serport.portConf.Name + "\",\"Data\":[{\"D\":\"" + "{\\\"rxm\\\":0}\\n\", \"Id\":\"internalInit0\", \"Pause\":50}]}")
 		// get feed rate override from get go
-		spFeedRateOverride("fro " + b.parent_serport.portConf.Name + "\n")
+		spFeedRateOverride("fro " + b.parent_serport.name() + "\n")
 		log.Println("Just forcibly asked for the fro status")
 
 	}()
@@ -293,7 +293,7 @@ func (b *BufferflowTinygV2) OnIncomingData(data string) {
 				//doneCmd := b.BufferCmdArray[0]
 
 				// Send cmd:"Complete" back
-				m := DataCmdComplete{"Complete", id, b.Port, b.q.LenOfCmds(), doneCmd}
+				m := DataCmdComplete{"Complete", id, b.port(), b.q.LenOfCmds(), doneCmd}
 				bm, err := json.Marshal(m)
 				if err == nil {
 					h.broadcastSys <- bm
@@ -313,7 +313,7 @@ func (b *BufferflowTinygV2) OnIncomingData(data string) {
 
 				// we need to send a buffer size update
 				mbs := BufferStats{}
-				mbs.P = b.Port
+				mbs.P = b.port()
 				//mbs.D = "{\"LocalBufSize\":" + strconv.Itoa(b.q.LenOfCmds()) + ",\"Cmds\":\"" + b.q.DebugStr() + "\"}\n"
 				mbs.D = string(bmLocalQueue) + "\n"
 				bmbs, err2 := json.Marshal(mbs)
@@ -449,7 +449,7 @@ func (b *BufferflowTinygV2) OnIncomingData(data string) {
 
 		// handle communication back to client
 		// for base serial data (this is not the cmd:"Write" or cmd:"Complete")
-		m := DataPerLine{b.Port, element + "\n"}
+		m := DataPerLine{b.port(), element + "\n"}
 		bm, err := json.Marshal(m)
 		if err == nil {
 			h.broadcastSys <- bm
@@ -725,12 +725,12 @@ func (b *BufferflowTinygV2) rxQueryLoop(p *serport) {
 
 				// we'll write a lazy formatted version of json to reduce the amt of chars
 				// chewed up since we're doing this outside the scope of the serial buffer counter
-				n2, err := p.portIo.Write([]byte("{rx:n}\n"))
+				n2, err := p.io().Write([]byte("{rx:n}\n"))
 
 				log.Print("Just wrote ", n2, " bytes to serial: {rx:n}")
 
 				if err != nil {
-					errstr := "Error writing to " + p.portConf.Name + " " + err.Error() + " Closing port."
+					errstr := "Error writing to " + p.name() + " " + err.Error() + " Closing port."
 					log.Print(errstr)
 					h.broadcastSys <- []byte(errstr)
 					ticker.Stop() //stop query loop if we can't write to the port
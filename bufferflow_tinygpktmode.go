@@ -16,7 +16,7 @@ import (
 
 type BufferflowTinygPktMode struct {
 	Name         string
-	Port         string
+	bufferflowPort
 	Paused       bool
 	ManualPaused bool // indicates user hard paused the buffer on their own, i.e. not from flow control
 	//StopSending     int
@@ -214,7 +214,7 @@ func (b *BufferflowTinygPktMode) Init() {
 
 	go func() {
 		time.Sleep(1 * time.Millisecond)
-		spWriteJson("sendjson {\"P\":\"" + b.parent_serport.portConf.Name + "\",\"Data\":[{\"D\":\"" + "{\\\"rxm\\\":1}\\n\", \"Id\":\"internalInit0\"}]}")
+		spWriteJson(nil, "sendjson {\"P\":\"" + b.parent_serport.name() + "\",\"Data\":[{\"D\":\"" + "{\\\"rxm\\\":1}\\n\", \"Id\":\"internalInit0\"}]}")
 
 	}()
 
@@ -235,7 +235,7 @@ func (b *BufferflowTinygPktMode) Init() {
 		wrj.Data[0].Id = "internalInit1"
 
 		//wrj.Data = wd
-		wrj.P = b.parent_serport.portConf.Name
+		wrj.P = b.parent_serport.name()
 		wrj.p = b.parent_serport
 		log.Printf("about to write init json: %v", wrj)
 		writeJson(wrj)
@@ -513,7 +513,7 @@ func (b *BufferflowTinygPktMode) OnIncomingData(data string) {
 							//}
 
 							// Send cmd:"Complete" back
-							m := DataCmdComplete{"Complete", id, b.Port, b.q.LenOfCmds(), doneCmd}
+							m := DataCmdComplete{"Complete", id, b.port(), b.q.LenOfCmds(), doneCmd}
 							bm, err := json.Marshal(m)
 							if err == nil {
 								h.broadcastSys <- bm
@@ -536,7 +536,7 @@ func (b *BufferflowTinygPktMode) OnIncomingData(data string) {
 								b.onGotLineModeCounterFromTinyG(b.PacketCtrAvail + 1)
 
 								// Send cmd:"Complete" back
-								m := DataCmdComplete{"Complete", id, b.Port, b.q.LenOfCmds(), doneCmd}
+								m := DataCmdComplete{"Complete", id, b.port(), b.q.LenOfCmds(), doneCmd}
 								bm, err := json.Marshal(m)
 								if err == nil {
 									h.broadcastSys <- bm
@@ -573,7 +573,7 @@ func (b *BufferflowTinygPktMode) OnIncomingData(data string) {
 							b.onGotLineModeCounterFromTinyG(b.PacketCtrAvail + 1)
 
 							// Send cmd:"Complete" back
-							m := DataCmdComplete{"Complete", id, b.Port, b.q.LenOfCmds(), doneCmd}
+							m := DataCmdComplete{"Complete", id, b.port(), b.q.LenOfCmds(), doneCmd}
 							bm, err := json.Marshal(m)
 							if err == nil {
 								h.broadcastSys <- bm
@@ -635,7 +635,7 @@ func (b *BufferflowTinygPktMode) OnIncomingData(data string) {
 
 		// handle communication back to client
 		// for base serial data (this is not the cmd:"Write" or cmd:"Complete")
-		m := DataPerLine{b.Port, element + "\n"}
+		m := DataPerLine{b.port(), element + "\n"}
 		bm, err := json.Marshal(m)
 		if err == nil {
 			h.broadcastSys <- bm
@@ -675,12 +675,12 @@ func (b *BufferflowTinygPktMode) reSyncStart() {
 	//b.Unpause()
 	go func() {
 		time.Sleep(1000 * time.Millisecond)
-		spWriteJson("sendjson {\"P\":\"" + b.parent_serport.portConf.Name + "\",\"Data\":[{\"D\":\"" + "{\\\"rx\\\":null}\\n\", \"Buf\":\"NoBuf\", \"Id\":\"resync1\"}]}")
+		spWriteJson(nil, "sendjson {\"P\":\"" + b.parent_serport.name() + "\",\"Data\":[{\"D\":\"" + "{\\\"rx\\\":null}\\n\", \"Buf\":\"NoBuf\", \"Id\":\"resync1\"}]}")
 
 	}()
 	go func() {
 		time.Sleep(1200 * time.Millisecond)
-		spWriteJson("sendjson {\"P\":\"" + b.parent_serport.portConf.Name + "\",\"Data\":[{\"D\":\"" + "{\\\"rx\\\":null}\\n\", \"Buf\":\"NoBuf\", \"Id\":\"resync1\"}]}")
+		spWriteJson(nil, "sendjson {\"P\":\"" + b.parent_serport.name() + "\",\"Data\":[{\"D\":\"" + "{\\\"rx\\\":null}\\n\", \"Buf\":\"NoBuf\", \"Id\":\"resync1\"}]}")
 
 	}()
 }
@@ -884,7 +884,7 @@ func (b *BufferflowTinygPktMode) BreakApartCommands(cmd string) []string {
 			/*
 				go func() {
 					time.Sleep(1500 * time.Millisecond)
-					spWriteJson("sendjson {\"P\":\"" + b.parent_serport.portConf.Name + "\",\"Data\":[{\"D\":\"" + "{\\\"ej\\\":1}\\n\", \"Id\":\"internalInit0\"}]}")
+					spWriteJson(nil, "sendjson {\"P\":\"" + b.parent_serport.name() + "\",\"Data\":[{\"D\":\"" + "{\\\"ej\\\":1}\\n\", \"Id\":\"internalInit0\"}]}")
 
 				}()
 			*/
@@ -995,7 +995,7 @@ func (b *BufferflowTinygPktMode) SeeIfSpecificCommandsShouldWipeBuffer(cmd strin
 		// ask for a {rx:n} report after the wipe
 		go func() {
 			time.Sleep(100 * time.Millisecond)
-			spWriteJson("sendjson {\"P\":\"" + b.parent_serport.portConf.Name + "\",\"Data\":[{\"D\":\"" + "{\\\"rx\\\":null}\\n\", \"Buf\":\"NoBuf\", \"Id\":\"internalWipe1\"}]}")
+			spWriteJson(nil, "sendjson {\"P\":\"" + b.parent_serport.name() + "\",\"Data\":[{\"D\":\"" + "{\\\"rx\\\":null}\\n\", \"Buf\":\"NoBuf\", \"Id\":\"internalWipe1\"}]}")
 
 		}()
 
@@ -1086,12 +1086,12 @@ func (b *BufferflowTinygPktMode) rxQueryLoop(p *serport) {
 
 				// we'll write a lazy formatted version of json to reduce the amt of chars
 				// chewed up since we're doing this outside the scope of the serial buffer counter
-				n2, err := p.portIo.Write([]byte("{rx:n}\n"))
+				n2, err := p.io().Write([]byte("{rx:n}\n"))
 
 				log.Print("Just wrote ", n2, " bytes to serial: {rx:n}")
 
 				if err != nil {
-					errstr := "Error writing to " + p.portConf.Name + " " + err.Error() + " Closing port."
+					errstr := "Error writing to " + p.name() + " " + err.Error() + " Closing port."
 					log.Print(errstr)
 					h.broadcastSys <- []byte(errstr)
 					ticker.Stop() //stop query loop if we can't write to the port
@@ -0,0 +1,484 @@
+// Every command SPJS understands is declared once in the table below with
+// its name, the usage of its text form, the args its json form takes, a line
+// of help and the lowest role that may call it. Text dispatch, the json
+// commands, the REST api, the Commands list a client gets on connect, role
+// checks and the help command are all driven off this one table so they
+// can't drift apart.
+//
+// Text commands are matched on their first word. The old checkCmd() matched
+// on prefixes, so if the first word isn't a command name we fall back to
+// the longest command name it starts with. That way the order of the table
+// doesn't matter the way the order of the old if/else chain did.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type spjsCmd struct {
+	Name    string
+	Aliases []string // other names the text command answers to
+	Usage   string   // how to call the text command
+	Help    string
+
+	// the lowest role that may call this. empty means anybody may.
+	Role string
+
+	// what the json command takes in its Args. nil if it takes none.
+	Args interface{}
+
+	// Text runs the text command. It is called from inside the hub
+	// goroutine so anything that takes a while has to go off in its own
+	// goroutine.
+	Text func(c *connection, s string)
+
+	Json jsonCmdHandler
+
+	// per connection commands are run right from the connection's
+	// reader. They only reply to that connection and aren't echoed
+	// to everybody.
+	IsPerConnection bool
+}
+
+// the commands in the order they are listed to clients
+var spjsCmds []*spjsCmd
+
+// the commands by lowercase name and alias
+var spjsCmdsByName = make(map[string]*spjsCmd)
+
+// the Commands message every client gets when it connects
+var spjsCmdsMsg []byte
+
+func init() {
+	spjsCmds = []*spjsCmd{
+		{Name: "list", Role: roleViewer,
+			Usage: "list",
+			Help:  "Lists all available serial ports on your device",
+			Text:  func(c *connection, s string) { go spList() },
+			Json:  jsonCmdList},
+		{Name: "open", Role: roleOperator, Args: jsonCmdOpenArgs{},
+			Usage: "open [portName] [baud] [bufferAlgorithm (optional)] [lineSettings, i.e. 7E1 (optional)] [none|rtscts|xonxoff (optional)] [autoreconnect (optional)] [text|hex|base64 (optional)] [framing, i.e. slip or delimiter:0d0a (optional)]",
+			Help:  "Opens a serial port. Use open secondary to open it as a secondary port. The baud and buffer algorithm can be left out if the config file has a rule for the port. The line settings are 8N1 with no flow control if left out.",
+			Text:  textOpen,
+			Json:  jsonCmdOpen},
+		{Name: "openvirtual", Role: roleOperator, Args: jsonCmdOpenVirtualArgs{},
+			Usage: "openvirtual [name] [baud (optional)] [bufferAlgorithm (optional)]",
+			Help:  "Make a pseudo terminal pair and open one end as a port called name. The path of the other end is sent back so another program can attach to it. Linux only.",
+			Text:  func(c *connection, s string) { go textOpenVirtual(c, s) },
+			Json:  jsonCmdOpenVirtual},
+		{Name: "opensim", Role: roleOperator, Args: jsonCmdOpenSimArgs{},
+			Usage: "opensim [grbl|marlin|tinyg] [name (optional)] [bufferAlgorithm (optional)] [rxBufferBytes (optional)] [latencyMs (optional)]",
+			Help:  "Open a simulated Grbl, Marlin or TinyG as a port so buffer algorithms can be tried without a board. The name is sim plus the type if left out.",
+			Text:  func(c *connection, s string) { go textOpenSim(c, s) },
+			Json:  jsonCmdOpenSim},
+		{Name: "send", Role: roleOperator, Args: jsonCmdSendArgs{},
+			Usage: "send [portName] [cmd]",
+			Help:  "Queue data onto a port through its buffer algorithm",
+			Text:  func(c *connection, s string) { go spWrite(c, s) },
+			Json:  jsonCmdSend},
+		{Name: "sendnobuf", Role: roleOperator, Args: jsonCmdSendArgs{},
+			Usage: "sendnobuf [portName] [cmd]",
+			Help:  "Send data to a port skipping its buffer algorithm",
+			Text:  func(c *connection, s string) { go spWrite(c, s) },
+			Json:  jsonCmdSendNoBuf},
+		{Name: "sendjson", Role: roleOperator, Args: writeRequestJson{},
+			Usage: "sendjson {P:portName, Data:[{D:cmdStr, Id:idStr}]}",
+			Help:  "Queue a list of commands with ids onto a port",
+			Text:  func(c *connection, s string) { go spWriteJson(c, s) },
+			Json:  jsonCmdSendJson},
+		{Name: "close", Role: roleOperator, Args: jsonCmdPortArgs{},
+			Usage: "close [portName]",
+			Help:  "Close a serial port",
+			Text:  textClose,
+			Json:  jsonCmdClose},
+		{Name: "queue", Role: roleViewer, Args: jsonCmdPortArgs{},
+			Usage: "queue [portName]",
+			Help:  "Get the state of the queue of a port",
+			Text:  func(c *connection, s string) { go spQueueStatus(s) },
+			Json:  jsonCmdQueue},
+		{Name: "resumequeue", Role: roleOperator, Args: jsonCmdPortArgs{},
+			Usage: "resumequeue [portName]",
+			Help:  "Let the queue of a port carry on after it was held because the device went away",
+			Text:  func(c *connection, s string) { go textResumeQueue(c, s) },
+			Json:  jsonCmdResumeQueue},
+		{Name: "wipequeue", Role: roleOperator, Args: jsonCmdPortArgs{},
+			Usage: "wipequeue [portName]",
+			Help:  "Throw away everything queued for a port",
+			Text:  func(c *connection, s string) { go textWipeQueue(c, s) },
+			Json:  jsonCmdWipeQueue},
+		{Name: "fro", Role: roleOperator, Args: jsonCmdFroArgs{},
+			Usage: "fro [portName] [feedRateOverride (optional)]",
+			Help:  "Multiply the feed rate of the gcode going to a port, or leave out the value to get the current setting",
+			Text:  func(c *connection, s string) { go spFeedRateOverride(s) },
+			Json:  jsonCmdFro},
+		{Name: "setdtr", Role: roleOperator, Args: jsonCmdModemLineArgs{},
+			Usage: "setdtr [portName] [on|off]",
+			Help:  "Turn the DTR line of an open port on or off, i.e. to reset an Arduino or ESP32",
+			Text:  func(c *connection, s string) { go textSetModemLine(c, s) },
+			Json:  jsonCmdSetDtr},
+		{Name: "setrts", Role: roleOperator, Args: jsonCmdModemLineArgs{},
+			Usage: "setrts [portName] [on|off]",
+			Help:  "Turn the RTS line of an open port on or off, i.e. to key an RS-485 adapter",
+			Text:  func(c *connection, s string) { go textSetModemLine(c, s) },
+			Json:  jsonCmdSetRts},
+		{Name: "sendbreak", Role: roleOperator, Args: jsonCmdSendBreakArgs{},
+			Usage: "sendbreak [portName] [ms (optional)]",
+			Help:  "Hold an open port in break for ms milliseconds, 250 if left out",
+			Text:  func(c *connection, s string) { go textSendBreak(c, s) },
+			Json:  jsonCmdSendBreak},
+		{Name: "reconfigure", Aliases: []string{"setbaud"}, Role: roleOperator, Args: jsonCmdReconfigureArgs{},
+			Usage: "reconfigure [portName] [baud (optional)] [lineSettings, i.e. 7E1 (optional)] [none|rtscts|xonxoff (optional)]",
+			Help:  "Change the baud and line settings of an open port without closing it. The queue and buffer algorithm are kept. setbaud does the same.",
+			Text:  func(c *connection, s string) { go textReconfigure(c, s) },
+			Json:  jsonCmdReconfigure},
+		{Name: "share", Role: roleOperator, Args: jsonCmdShareArgs{},
+			Usage: "share [portName] [listenAddr, i.e. 2217 or 0.0.0.0:2217] [raw|rfc2217 (optional)]",
+			Help:  "Put an open port on the network as a raw or RFC 2217 tcp server. What network clients send goes to the port like sendnobuf. There is no auth on the tcp side, so it's on 127.0.0.1 unless you give a host, and only an admin can share on anything else.",
+			Text:  func(c *connection, s string) { go textShare(c, s) },
+			Json:  jsonCmdShare},
+		{Name: "unshare", Role: roleOperator, Args: jsonCmdUnshareArgs{},
+			Usage: "unshare [portName]",
+			Help:  "Stop sharing a port on the network and drop its network clients",
+			Text:  func(c *connection, s string) { go textUnshare(c, s) },
+			Json:  jsonCmdUnshare},
+		{Name: "bufferalgorithms", Aliases: []string{"bufferalgorithm"}, Role: roleViewer,
+			Usage: "bufferalgorithms",
+			Help:  "List the available buffer algorithms",
+			Text:  func(c *connection, s string) { go spBufferAlgorithms() },
+			Json:  jsonCmdBufferAlgorithms},
+		{Name: "baudrates", Aliases: []string{"baudrate"}, Role: roleViewer,
+			Usage: "baudrates",
+			Help:  "List common baud rates",
+			Text:  func(c *connection, s string) { go spBaudRates() },
+			Json:  jsonCmdBaudRates},
+		{Name: "restart", Role: roleAdmin, Args: jsonCmdShutdownArgs{},
+			Usage: "restart [now|drain|feedhold (optional)] [timeout:seconds (optional)]",
+			Help:  "Restart the serial port json server. The ports that are open get reopened by the new process.",
+			Text:  func(c *connection, s string) { go spShutdownCmd(s, true) },
+			Json:  jsonCmdRestart},
+		{Name: "exit", Role: roleAdmin, Args: jsonCmdShutdownArgs{},
+			Usage: "exit [now|drain|feedhold (optional)] [timeout:seconds (optional)]",
+			Help:  "Close all the ports and exit the serial port json server. drain waits for the queues to empty first and feedhold stops the machines first.",
+			Text:  func(c *connection, s string) { go spShutdownCmd(s, false) },
+			Json:  jsonCmdExit},
+		{Name: "broadcast", Role: roleOperator, Args: jsonCmdBroadcastArgs{},
+			Usage: "broadcast [anythingToRegurgitate]",
+			Help:  "Send a message to every connected client",
+			Text:  func(c *connection, s string) { go broadcast(s) },
+			Json:  jsonCmdBroadcast},
+		{Name: "hostname", Role: roleViewer,
+			Usage: "hostname",
+			Help:  "Get the hostname of this SPJS",
+			Text:  func(c *connection, s string) { getHostname() },
+			Json:  jsonCmdHostname},
+		{Name: "version", Role: roleViewer,
+			Usage: "version",
+			Help:  "Get the version of this SPJS",
+			Text:  func(c *connection, s string) { getVersion() },
+			Json:  jsonCmdVersionInfo},
+		{Name: "program", Role: roleAdmin, Args: jsonCmdProgramArgs{},
+			Usage: "program [portName] [core:architecture:name] [path/to/binOrHexFile]",
+			Help:  "Program a board from a file on the SPJS host",
+			Text:  textProgram,
+			Json:  jsonCmdProgram},
+		{Name: "programfromurl", Role: roleAdmin, Args: jsonCmdProgramArgs{},
+			Usage: "programfromurl [portName] [core:architecture:name] [urlToBinOrHexFile]",
+			Help:  "Download a file and program a board with it",
+			Text:  textProgramFromUrl,
+			Json:  jsonCmdProgramFromUrl},
+		{Name: "programkill", Role: roleAdmin,
+			Usage: "programkill",
+			Help:  "Kill the running programmer",
+			Text:  func(c *connection, s string) { go spHandlerProgramKill() },
+			Json:  jsonCmdProgramKill},
+		{Name: "execruntime", Role: roleViewer,
+			Usage: "execruntime",
+			Help:  "Get the OS and architecture of the SPJS host",
+			Text:  func(c *connection, s string) { execRuntime() },
+			Json:  jsonCmdExecRuntime},
+		{Name: "exec", Role: roleAdmin, Args: jsonCmdExecArgs{},
+			Usage: "exec [command] [arg1] [arg2] [...]",
+			Help:  "Run a command on the SPJS host",
+			Text:  func(c *connection, s string) { go execRun(s) },
+			Json:  jsonCmdExec},
+		{Name: "usblist", Role: roleViewer,
+			Usage: "usblist",
+			Help:  "List the USB devices on the SPJS host",
+			Text:  func(c *connection, s string) { SendUsbList() },
+			Json:  jsonCmdUsbList},
+		{Name: "cayenn-sendudp", Role: roleOperator, Args: jsonCmdCayennArgs{},
+			Usage: "cayenn-sendudp [ip] [msg]",
+			Help:  "Send a message to a Cayenn device over UDP",
+			Text:  func(c *connection, s string) { cayennSendUdp(s) },
+			Json:  jsonCmdCayennSendUdp},
+		{Name: "cayenn-sendtcp", Role: roleOperator, Args: jsonCmdCayennArgs{},
+			Usage: "cayenn-sendtcp [ip] [msg]",
+			Help:  "Send a message to a Cayenn device over TCP",
+			Text:  func(c *connection, s string) { cayennSendTcp(s) },
+			Json:  jsonCmdCayennSendTcp},
+		{Name: "bufflowdebug", Role: roleOperator, Args: jsonCmdBufFlowDebugArgs{},
+			Usage: "bufflowdebug [on|off]",
+			Help:  "Turn on or off the debug messages from the buffer algorithms",
+			Text:  func(c *connection, s string) { bufflowdebug(strings.ToLower(s)) },
+			Json:  jsonCmdBufFlowDebug},
+		{Name: "memstats", Role: roleViewer,
+			Usage: "memstats",
+			Help:  "Get Go memory statistics",
+			Text:  func(c *connection, s string) { memoryStats() },
+			Json:  jsonCmdMemStats},
+		{Name: "gc", Role: roleAdmin,
+			Usage: "gc",
+			Help:  "Force a garbage collection",
+			Text:  func(c *connection, s string) { garbageCollection() },
+			Json:  jsonCmdGc},
+		{Name: "subscribe",
+			Usage:           "subscribe [class or portName] [...]",
+			Help:            "Only get the event classes and ports you ask for",
+			Args:            jsonCmdSubscribeArgs{},
+			Text:            textSubscribe,
+			Json:            jsonCmdSubscribe,
+			IsPerConnection: true},
+		{Name: "unsubscribe",
+			Usage:           "unsubscribe [class or portName (optional)] [...]",
+			Help:            "Stop getting event classes or ports, or with nothing after it go back to getting everything",
+			Args:            jsonCmdSubscribeArgs{},
+			Text:            textUnsubscribe,
+			Json:            jsonCmdUnsubscribe,
+			IsPerConnection: true},
+		{Name: "subscriptions",
+			Usage:           "subscriptions",
+			Help:            "Get what you are subscribed to",
+			Text:            textSubscriptions,
+			Json:            jsonCmdSubscriptions,
+			IsPerConnection: true},
+		{Name: "claim", Role: roleOperator, Args: jsonCmdClaimArgs{},
+			Usage: "claim [portName] [takeover (optional)] [timeout:seconds (optional)]",
+			Help:  "Get exclusive control of writing to a port",
+			Text:  func(c *connection, s string) { go spClaimCmd(c, s) },
+			Json:  jsonCmdClaim},
+		{Name: "release", Role: roleOperator, Args: jsonCmdPortArgs{},
+			Usage: "release [portName]",
+			Help:  "Give up your claim on a port",
+			Text:  func(c *connection, s string) { go spReleaseCmd(c, s) },
+			Json:  jsonCmdRelease},
+		{Name: "clients", Role: roleViewer,
+			Usage: "clients",
+			Help:  "List the connected clients and the ports they have claimed",
+			Text:  func(c *connection, s string) { go spClients() },
+			Json:  jsonCmdClients},
+		{Name: "reloadconfig", Role: roleAdmin,
+			Usage: "reloadconfig",
+			Help:  "Reread the -config file without closing any ports",
+			Text:  func(c *connection, s string) { go spReloadConfig() },
+			Json:  jsonCmdReloadConfig},
+		{Name: "help", Args: jsonCmdHelpArgs{},
+			Usage:           "help [command (optional)]",
+			Help:            "Get the usage, args and required role of a command, or of all of them",
+			Text:            textHelp,
+			Json:            jsonCmdHelp,
+			IsPerConnection: true},
+	}
+
+	usages := []string{}
+	for _, sc := range spjsCmds {
+		spjsCmdsByName[sc.Name] = sc
+		for _, alias := range sc.Aliases {
+			spjsCmdsByName[alias] = sc
+		}
+		usages = append(usages, sc.Usage)
+	}
+	spjsCmdsMsg, _ = json.Marshal(map[string][]string{"Commands": usages})
+}
+
+// findTextCmd works out which command a text command is. nil if it isn't
+// one we know.
+func findTextCmd(m []byte) *spjsCmd {
+	fields := strings.Fields(strings.ToLower(string(m)))
+	if len(fields) == 0 {
+		return nil
+	}
+	if sc, isFound := spjsCmdsByName[fields[0]]; isFound {
+		return sc
+	}
+	var best *spjsCmd
+	bestLen := 0
+	for name, sc := range spjsCmdsByName {
+		if len(name) > bestLen && strings.HasPrefix(fields[0], name) {
+			best = sc
+			bestLen = len(name)
+		}
+	}
+	return best
+}
+
+func textOpen(c *connection, s string) {
+	// check if user wants to open this port as a secondary port
+	// this doesn't mean much other than allowing the UI to show
+	// a port as primary and make other ports sort of act less important
+	isSecondary := false
+	if strings.HasPrefix(s, "open secondary") {
+		isSecondary = true
+		// swap out the word secondary
+		s = strings.Replace(s, "open secondary", "open", 1)
+	}
+
+	// remove newline
+	args := strings.Split(strings.TrimSpace(s), " ")
+	if len(args) < 2 || len(args[1]) < 1 {
+		go spErr("You did not specify a serial port")
+		return
+	}
+
+	// the baud can be left out if the config file has a rule for the port
+	baud := 0
+	if len(args) > 2 {
+		baudStr := strings.Replace(args[2], "\n", "", -1)
+		var err error
+		baud, err = strconv.Atoi(baudStr)
+		if err != nil {
+			go spErr("Problem converting baud rate " + args[2])
+			return
+		}
+	}
+	// pass in buffer type now as string. if user does not
+	// ask for a buffer type pass in empty string. line settings like
+	// 7E1, flow control like rtscts and an encoding like hex can come
+	// along with it.
+	bufferAlgorithm := ""
+	var opts PortOptions
+	if len(args) > 3 {
+		lineArgs := []string{}
+		for _, arg := range args[3:] {
+			if strings.ToLower(arg) == "autoreconnect" {
+				opts.AutoReconnect = true
+			} else if len(arg) > 0 && isEncoding(arg) {
+				opts.Encoding = strings.ToLower(arg)
+			} else if fs, isFraming, err := parseFrameArg(arg); isFraming {
+				if err != nil {
+					go spErr(err.Error())
+					return
+				}
+				opts.FrameSettings = fs
+			} else {
+				lineArgs = append(lineArgs, arg)
+			}
+		}
+		var err error
+		opts.LineSettings, bufferAlgorithm, err = parseLineArgs(lineArgs)
+		if err != nil {
+			go spErr(err.Error())
+			return
+		}
+	}
+	go spHandlerOpen(args[1], baud, bufferAlgorithm, opts, isSecondary, nil)
+}
+
+func textClose(c *connection, s string) {
+	log.Printf("About to split close commands. cmd:\"%v\"", s)
+	// remove newline
+	args := strings.Split(strings.TrimSpace(s), " ")
+	log.Printf("The split args for close:%v", args)
+	if len(args) > 1 {
+		go spClose(args[1])
+	} else {
+		go spErr("You did not specify a port to close")
+	}
+}
+
+func textProgram(c *connection, s string) {
+	args := strings.Split(s, " ")
+	if len(args) > 3 {
+		var slice []string = args[3:len(args)]
+		go spProgram(args[1], args[2], strings.Join(slice, " "))
+	} else {
+		go spErr("You did not specify a port, a board to program and/or a filename")
+	}
+}
+
+func textProgramFromUrl(c *connection, s string) {
+	args := strings.Split(s, " ")
+	if len(args) == 4 {
+		go spProgramFromUrl(args[1], args[2], args[3])
+	} else {
+		go spErr("You did not specify a port, a board to program and/or a URL")
+	}
+}
+
+type CmdHelp struct {
+	Name    string
+	Aliases []string `json:",omitempty"`
+	Usage   string
+	Help    string
+	Role    string                 // the lowest role that may call it, or any
+	Args    map[string]interface{} `json:",omitempty"` // schema of the json Args
+}
+
+type CmdHelpList struct {
+	Cmd      string
+	Commands []CmdHelp
+}
+
+type jsonCmdHelpArgs struct {
+	Name string // leave out to get every command
+}
+
+func cmdHelp(sc *spjsCmd) CmdHelp {
+	ch := CmdHelp{Name: sc.Name, Aliases: sc.Aliases, Usage: sc.Usage, Help: sc.Help, Role: sc.Role}
+	if len(ch.Role) == 0 {
+		ch.Role = "any"
+	}
+	if sc.Args != nil {
+		ch.Args = openApiSchema(reflect.TypeOf(sc.Args))
+	}
+	return ch
+}
+
+// spHelpData gives back the help for one command, or every command if
+// name is empty
+func spHelpData(name string) (CmdHelpList, error) {
+	list := CmdHelpList{Cmd: "Help", Commands: []CmdHelp{}}
+	if len(name) == 0 {
+		for _, sc := range spjsCmds {
+			list.Commands = append(list.Commands, cmdHelp(sc))
+		}
+		sort.Slice(list.Commands, func(i, j int) bool { return list.Commands[i].Name < list.Commands[j].Name })
+		return list, nil
+	}
+	sc, isFound := spjsCmdsByName[strings.ToLower(name)]
+	if !isFound {
+		return list, errors.New("There is no command called " + name + ".")
+	}
+	list.Commands = append(list.Commands, cmdHelp(sc))
+	return list, nil
+}
+
+func textHelp(c *connection, s string) {
+	args := strings.Fields(s)
+	name := ""
+	if len(args) > 1 {
+		name = args[1]
+	}
+	var b []byte
+	list, err := spHelpData(name)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"Error": err.Error()})
+	} else {
+		b, _ = json.Marshal(list)
+	}
+	h.direct <- directMsg{c, b}
+}
+
+func jsonCmdHelp(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdHelpArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return spHelpData(a.Name)
+}
@@ -0,0 +1,324 @@
+// SPJS can take its settings from a json config file instead of a long
+// command line. Start it with -config spjs.json. Under Flags you can set
+// any of the command line flags by name. Under Ports you can give rules
+// that supply the defaults for a port so clients don't have to send the
+// baud and buffer algorithm on every open. A rule matches on the port
+// Name, the SerialNumber, the UsbVid/UsbPid and/or the UsbPath of the
+// device, and the first rule that matches wins. A rule can give the device
+// an Alias too.
+//   {"Flags":{"regex":"usb|acm", "gc":"max"},
+//    "Ports":[
+//      {"Name":"/dev/ttyACM0", "Baud":115200, "BufferAlgorithm":"grbl", "AutoOpen":true},
+//      {"UsbVid":"1d50", "UsbPid":"606d", "Baud":115200, "BufferAlgorithm":"tinygg2"},
+//      {"SerialNumber":"A9007XyZ", "Baud":9600, "DtrOn":true},
+//      {"Name":"/dev/ttyUSB1", "Baud":9600, "DataBits":7, "Parity":"even", "StopBits":1},
+//      {"SerialNumber":"85734323231351E0C1A1", "Baud":250000, "BufferAlgorithm":"marlin", "AutoReconnect":true},
+//      {"UsbPath":"1-1.3", "Alias":"laser", "Baud":115200, "BufferAlgorithm":"grbl"}
+//    ]}
+//
+// Flags given on the command line win over the file. Send SIGHUP or the
+// reloadconfig command to reread the file. Open ports are left alone. The
+// port rules apply the next time a port is opened and AutoOpen ports that
+// aren't open yet get opened. Flags are read all over SPJS while it runs
+// so a reload leaves them alone and changing one needs a restart.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type PortRule struct {
+	// what to match on. anything left empty matches every port.
+	Name         string
+	SerialNumber string
+	UsbVid       string
+	UsbPid       string
+	UsbPath      string // the hub port, i.e. 1-1.3. Linux only.
+
+	// a name that works anywhere the port's name does. see portalias.go.
+	Alias string
+
+	// the defaults for the port. a client that asks for a baud or
+	// buffer algorithm on open gets what it asked for.
+	Baud            int
+	BufferAlgorithm string
+	RtsOn           *bool // nil leaves RTS on like always
+	DtrOn           *bool // nil leaves DTR off like always
+	IsSecondary     bool
+	PortOptions
+
+	// open the port when SPJS starts or the config is reloaded
+	AutoOpen bool
+}
+
+type SpjsConfig struct {
+	Flags map[string]interface{}
+	Ports []PortRule
+}
+
+type ConfigStatus struct {
+	Cmd       string // ConfigLoaded or ConfigReloaded
+	File      string
+	PortRules int
+	Skipped   []string // flags in the file we left alone and why
+}
+
+var configMutex = &sync.Mutex{}
+var spjsConf = &SpjsConfig{}
+
+// flags given on the command line. the config file doesn't override these.
+var cmdLineFlags = make(map[string]bool)
+
+func (r *PortRule) needsPortInfo() bool {
+	return len(r.SerialNumber) > 0 || len(r.UsbVid) > 0 || len(r.UsbPid) > 0 || len(r.UsbPath) > 0
+}
+
+// usbId makes vid/pids comparable, i.e. 0x1D50 and 1d50
+func usbId(s string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "0x")
+}
+
+func (r *PortRule) matches(item SpPortItem) bool {
+	if len(r.Name) > 0 && !strings.EqualFold(r.Name, item.Name) {
+		return false
+	}
+	if len(r.SerialNumber) > 0 && r.SerialNumber != item.SerialNumber {
+		return false
+	}
+	if len(r.UsbVid) > 0 && usbId(r.UsbVid) != usbId(item.UsbVid) {
+		return false
+	}
+	if len(r.UsbPid) > 0 && usbId(r.UsbPid) != usbId(item.UsbPid) {
+		return false
+	}
+	if len(r.UsbPath) > 0 && r.UsbPath != item.UsbPath {
+		return false
+	}
+	return true
+}
+
+func configPortRules() []PortRule {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	return spjsConf.Ports
+}
+
+// findPortRule gives back the rule for a port, or nil if no rule matches.
+// We only go get the port list if a rule needs the serial number or vid/pid.
+func findPortRule(portname string) *PortRule {
+	rules := configPortRules()
+	item := SpPortItem{Name: portname}
+	for i := range rules {
+		if rules[i].needsPortInfo() {
+			item = findPortItem(portname)
+			break
+		}
+	}
+	for i := range rules {
+		if rules[i].matches(item) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func findPortItem(portname string) SpPortItem {
+	for _, item := range spListData().SerialPorts {
+		if strings.EqualFold(item.Name, portname) {
+			return item
+		}
+	}
+	return SpPortItem{Name: portname}
+}
+
+// loadConfigFile reads the config file and applies it. Nothing is changed
+// if the file has a problem.
+func loadConfigFile(path string, isReload bool) (ConfigStatus, error) {
+	status := ConfigStatus{Cmd: "ConfigLoaded", File: path, Skipped: []string{}}
+	if isReload {
+		status.Cmd = "ConfigReloaded"
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return status, err
+	}
+	var conf SpjsConfig
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return status, errors.New("Problem decoding config file " + path + ". " + err.Error())
+	}
+
+	// check everything before we touch anything
+	names := []string{}
+	values := map[string]string{}
+	for name, v := range conf.Flags {
+		if flag.Lookup(name) == nil || name == "config" {
+			return status, errors.New("There is no flag called " + name + " that the config file can set")
+		}
+		names = append(names, name)
+		values[name] = fmt.Sprint(v)
+	}
+	sort.Strings(names)
+	if v, isSet := values["slowclient"]; isSet && v != slowClientCoalesce && v != slowClientDrop && v != slowClientDisconnect {
+		return status, errors.New("slowclient in the config file must be coalesce, drop or disconnect")
+	}
+	for i, r := range conf.Ports {
+		if len(r.Name) == 0 && !r.needsPortInfo() {
+			return status, fmt.Errorf("Port rule %v in the config file needs a Name, SerialNumber, UsbVid, UsbPid or UsbPath to match on", i+1)
+		}
+		if err := checkPortAlias(conf.Ports[:i], r); err != nil {
+			return status, fmt.Errorf("Port rule %v in the config file has a bad Alias. %v", i+1, err)
+		}
+		if len(r.BufferAlgorithm) > 0 && !isBufferAlgorithm(r.BufferAlgorithm) {
+			return status, fmt.Errorf("Port rule %v in the config file has an unknown BufferAlgorithm %v", i+1, r.BufferAlgorithm)
+		}
+		if r.AutoOpen && r.Baud <= 0 {
+			return status, fmt.Errorf("Port rule %v in the config file is AutoOpen but has no Baud", i+1)
+		}
+		if err := r.LineSettings.check(); err != nil {
+			return status, fmt.Errorf("Port rule %v in the config file has bad line settings. %v", i+1, err)
+		}
+		if err := checkEncoding(r.Encoding, r.BufferAlgorithm); err != nil {
+			return status, fmt.Errorf("Port rule %v in the config file has a bad Encoding. %v", i+1, err)
+		}
+		if err := checkFraming(r.FrameSettings, r.BufferAlgorithm); err != nil {
+			return status, fmt.Errorf("Port rule %v in the config file has bad framing. %v", i+1, err)
+		}
+	}
+	if err := checkAliasesAgainstPorts(conf.Ports); err != nil {
+		return status, err
+	}
+
+	// set the flags, putting back the old values if any of them are bad
+	olds := map[string]string{}
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if cmdLineFlags[name] {
+			status.Skipped = append(status.Skipped, name+" (set on the command line)")
+			continue
+		}
+		// the rest of SPJS reads the flags with no lock so they're only
+		// set before it gets going
+		if isReload {
+			if f.Value.String() != values[name] {
+				status.Skipped = append(status.Skipped, name+" (needs a restart)")
+			}
+			continue
+		}
+		olds[name] = f.Value.String()
+		if err := f.Value.Set(values[name]); err != nil {
+			for oldName, old := range olds {
+				flag.Lookup(oldName).Value.Set(old)
+			}
+			return status, errors.New("Problem setting " + name + " from the config file. " + err.Error())
+		}
+	}
+
+	configMutex.Lock()
+	spjsConf = &conf
+	configMutex.Unlock()
+	status.PortRules = len(conf.Ports)
+	log.Printf("Loaded config file %v. %v port rules. Skipped flags:%v\n", path, len(conf.Ports), status.Skipped)
+	return status, nil
+}
+
+func isBufferAlgorithm(name string) bool {
+	for _, ba := range availableBufferAlgorithms {
+		if ba == name {
+			return true
+		}
+	}
+	return false
+}
+
+func reloadConfig() (ConfigStatus, error) {
+	if len(*configFile) == 0 {
+		return ConfigStatus{}, errors.New("SPJS was not started with a -config file to reload")
+	}
+	status, err := loadConfigFile(*configFile, true)
+	if err != nil {
+		return status, err
+	}
+	if len(*authFile) > 0 {
+		// pick up changed tokens and passwords
+		if err := loadAuthFile(*authFile); err != nil {
+			return status, errors.New("Reloaded config but could not reload the auth file. " + err.Error())
+		}
+	}
+	b, _ := json.Marshal(status)
+	h.broadcastSys <- b
+	go autoOpenPorts()
+	return status, nil
+}
+
+func spReloadConfig() {
+	if _, err := reloadConfig(); err != nil {
+		spErr(err.Error())
+	}
+}
+
+func jsonCmdReloadConfig(c *connection, args json.RawMessage) (interface{}, error) {
+	return reloadConfig()
+}
+
+// autoOpenPorts opens the ports that have an AutoOpen rule and aren't open
+// yet. One at a time so the events come out in the order of the rules.
+func autoOpenPorts() {
+	rules := configPortRules()
+	isAutoOpen := false
+	for _, r := range rules {
+		isAutoOpen = isAutoOpen || r.AutoOpen
+	}
+	if !isAutoOpen {
+		return
+	}
+	for _, item := range spListData().SerialPorts {
+		if item.IsOpen {
+			continue
+		}
+		var rule *PortRule
+		for i := range rules {
+			if rules[i].matches(item) {
+				rule = &rules[i]
+				break
+			}
+		}
+		if rule == nil || !rule.AutoOpen {
+			continue
+		}
+		log.Printf("Auto opening port %v from the config file\n", item.Name)
+		done := make(chan error, 1)
+		go spHandlerOpen(item.Name, rule.Baud, rule.BufferAlgorithm, rule.PortOptions, rule.IsSecondary, done)
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Printf("Could not auto open port %v. err:%v\n", item.Name, err)
+			}
+		case <-time.After(jsonCmdOpenTimeout):
+			log.Printf("Timed out auto opening port %v\n", item.Name)
+		}
+	}
+}
+
+// watchConfigSignal rereads the config file on SIGHUP
+func watchConfigSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		log.Println("Got SIGHUP. Reloading config file " + *configFile)
+		spReloadConfig()
+	}
+}
@@ -7,6 +7,8 @@ package main
 import (
 	"log"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -16,33 +18,170 @@ type connection struct {
 	ws *websocket.Conn
 
 	// Buffered channel of outbound messages.
-	send chan []byte
+	send chan outMsg
+
+	// Which event classes and ports this connection wants to hear about
+	subs subscription
+
+	// Who authenticated on this connection and what they may do
+	user string
+	role string
+
+	// Number we hand out so clients can tell each other apart, plus
+	// where they connected from
+	id   int64
+	addr string
+
+	// What we are holding for this connection if it can't keep up, and
+	// a nudge for the writer when something gets added to it
+	backlog backlog
+	wake    chan bool
+
+	// the session this connection belongs to, see resume.go
+	resumeToken string
+	// Seq of the last event the writer actually got out, so a resume
+	// replays what was still queued when we lost the socket. only
+	// touched with sync/atomic.
+	lastSeq int64
+}
+
+// outMsg is a message on its way to a client along with its Seq. seq is 0
+// for the hello messages that aren't events.
+type outMsg struct {
+	m   []byte
+	seq int64
+}
+
+// pongWait is how long we wait to hear back from a ping before we decide
+// the other end is gone
+func pongWait() time.Duration {
+	return 3 * time.Duration(*wsPing) * time.Second
 }
 
 func (c *connection) reader() {
+	if *wsPing > 0 {
+		c.ws.SetReadDeadline(time.Now().Add(pongWait()))
+		c.ws.SetPongHandler(func(string) error {
+			c.ws.SetReadDeadline(time.Now().Add(pongWait()))
+			return nil
+		})
+	}
 	for {
 		_, message, err := c.ws.ReadMessage()
 		if err != nil {
 			break
 		}
 
-		h.broadcast <- message
+		// structured json commands get a reply just to this connection,
+		// everything else is a legacy text command
+		if isJsonCmd(message) {
+			go runJsonCmd(c, message)
+			continue
+		}
+
+		sc := findTextCmd(message)
+		if sc != nil && !mayRun(c.role, sc.Name) {
+			sendAuthErr(c, sc.Name)
+			continue
+		}
+
+		// things like subscriptions are per connection so they never
+		// reach the hub
+		if sc != nil && sc.IsPerConnection {
+			sc.Text(c, string(message))
+			continue
+		}
+
+		h.commands <- cmdMsg{c, message}
 	}
 	c.ws.Close()
 }
 
 func (c *connection) writer() {
-	for message := range c.send {
-		err := c.ws.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
-			break
+	var ping <-chan time.Time
+	if *wsPing > 0 {
+		ticker := time.NewTicker(time.Duration(*wsPing) * time.Second)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		select {
+		case out, ok := <-c.send:
+			if !ok {
+				c.ws.Close()
+				return
+			}
+			if !c.write(out) {
+				c.ws.Close()
+				return
+			}
+			// only dig into the backlog once the channel is empty so
+			// everything goes out in the order it came in
+			if len(c.send) == 0 && !c.writeBacklog() {
+				c.ws.Close()
+				return
+			}
+		case <-c.wake:
+			if len(c.send) == 0 && !c.writeBacklog() {
+				c.ws.Close()
+				return
+			}
+		case <-ping:
+			if err := c.ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(pongWait())); err != nil {
+				log.Printf("Client %v did not take our ping. err:%v\n", c.id, err)
+				c.ws.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *connection) write(out outMsg) bool {
+	if *wsPing > 0 {
+		c.ws.SetWriteDeadline(time.Now().Add(pongWait()))
+	}
+	if c.ws.WriteMessage(websocket.TextMessage, out.m) != nil {
+		return false
+	}
+	if out.seq > 0 {
+		atomic.StoreInt64(&c.lastSeq, out.seq)
+	}
+	return true
+}
+
+// writeBacklog sends everything the hub parked for us and then the
+// Overflow notice once we have caught up
+func (c *connection) writeBacklog() bool {
+	for {
+		msgs, notice := c.takeBacklog()
+		for _, m := range msgs {
+			if !c.write(m) {
+				return false
+			}
+		}
+		if notice != nil {
+			return c.write(outMsg{m: notice})
+		}
+		if msgs == nil {
+			return true
 		}
 	}
-	c.ws.Close()
 }
 
 func wsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Print("Started a new websocket handler")
+	if isShuttingDown() {
+		http.Error(w, errShuttingDown.Error(), 503)
+		return
+	}
+	user, role, ok := authenticate(r)
+	if !ok {
+		log.Printf("Rejected websocket from %v that did not authenticate\n", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"spjs\"")
+		http.Error(w, "Not authorized", 401)
+		return
+	}
 	ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
 	if _, ok := err.(websocket.HandshakeError); ok {
 		http.Error(w, "Not a websocket handshake", 400)
@@ -51,7 +190,7 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	//c := &connection{send: make(chan []byte, 256), ws: ws}
-	c := &connection{send: make(chan []byte, 256*10), ws: ws}
+	c := &connection{send: make(chan outMsg, 256*10), ws: ws, user: user, role: role, id: nextClientId(), addr: r.RemoteAddr, wake: make(chan bool, 1), resumeToken: r.URL.Query().Get("resume")}
 	h.register <- c
 	defer func() { h.unregister <- c }()
 	go c.writer()
@@ -0,0 +1,161 @@
+// Encodings get binary protocols, i.e. bootloaders, Modbus or sensors with
+// packed frames, through the json without mangling them. A port opened with
+// hex or base64 has what it reads sent in D as hex or base64, and what comes
+// in for it on send, sendnobuf or sendjson is decoded before it's written,
+// so every byte makes it there and back exactly. text is the old way where
+// the data goes as is.
+//
+// Only what clients send is decoded. A write with no connection comes from
+// SPJS itself, i.e. a buffer algorithm setting up a TinyG, and is always
+// text whatever the port's encoding.
+//
+// Encodings go with the default and timed buffer algorithms. The others
+// split what the device sends into lines of text.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+const (
+	encodingText   = "text"
+	encodingHex    = "hex"
+	encodingBase64 = "base64"
+)
+
+func isEncoding(name string) bool {
+	switch strings.ToLower(name) {
+	case "", encodingText, encodingHex, encodingBase64:
+		return true
+	}
+	return false
+}
+
+// checkEncoding makes sure the buffer algorithm leaves the data alone
+func checkEncoding(encoding string, buftype string) error {
+	if !isEncoding(encoding) {
+		return errors.New("Encoding must be text, hex or base64")
+	}
+	encoding = strings.ToLower(encoding)
+	if encoding == "" || encoding == encodingText {
+		return nil
+	}
+	switch buftype {
+	case "", "default", "timed":
+		return nil
+	}
+	return errors.New("The " + buftype + " buffer algorithm sends back lines of text so it can't be used with the " + encoding + " encoding. Use default or timed.")
+}
+
+func encodeData(encoding string, data string) string {
+	switch encoding {
+	case encodingHex:
+		return hex.EncodeToString([]byte(data))
+	case encodingBase64:
+		return base64.StdEncoding.EncodeToString([]byte(data))
+	}
+	return data
+}
+
+// decodeData turns hex or base64 back into bytes. Hex can have spaces in
+// it, i.e. 01 03 00 00 00 0a c5 cd, and base64 can leave off the padding.
+func decodeData(encoding string, data string) (string, error) {
+	switch encoding {
+	case encodingHex:
+		b, err := hex.DecodeString(strings.Join(strings.Fields(data), ""))
+		if err != nil {
+			return "", errors.New("Could not decode the hex data. " + err.Error())
+		}
+		return string(b), nil
+	case encodingBase64:
+		data = strings.TrimSpace(data)
+		b, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			b, err = base64.RawStdEncoding.DecodeString(data)
+		}
+		if err != nil {
+			return "", errors.New("Could not decode the base64 data. " + err.Error())
+		}
+		return string(b), nil
+	}
+	return data, nil
+}
+
+// encodingFor gives back the encoding a send to the port uses, which is
+// the port's own unless the command gave one
+func encodingFor(myport *serport, encoding string) (string, error) {
+	if !isEncoding(encoding) {
+		return "", errors.New("Encoding must be text, hex or base64")
+	}
+	if len(encoding) == 0 {
+		return myport.encoding, nil
+	}
+	return strings.ToLower(encoding), nil
+}
+
+// decodePortData decodes what a client is sending to a port
+func decodePortData(c *connection, portname string, data string, encoding string) (string, error) {
+	if c == nil {
+		return data, nil
+	}
+	myport, isFound := findPortByName(portname)
+	if !isFound {
+		// spWritePort() tells them
+		return data, nil
+	}
+	encoding, err := encodingFor(myport, encoding)
+	if err != nil {
+		return "", err
+	}
+	return decodeData(encoding, data)
+}
+
+// decodeJsonReq decodes the D of each command in a sendjson request
+func decodeJsonReq(c *connection, m *writeRequestJson) error {
+	if c == nil {
+		return nil
+	}
+	myport, isFound := findPortByName(m.P)
+	if !isFound {
+		return nil
+	}
+	encoding, err := encodingFor(myport, m.Encoding)
+	if err != nil {
+		return err
+	}
+	for i := range m.Data {
+		if m.Data[i].D, err = decodeData(encoding, m.Data[i].D); err != nil {
+			return errors.New("Command " + m.Data[i].Id + ". " + err.Error())
+		}
+	}
+	return nil
+}
+
+// encodeCmds encodes what we queued for the Queued event
+func (p *serport) encodeCmds(cmds []string) []string {
+	if len(p.encoding) == 0 {
+		return cmds
+	}
+	encoded := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		encoded[i] = encodeData(p.encoding, cmd)
+	}
+	return encoded
+}
+
+// encodeReportData is encodeCmds for the Queued event of a sendjson
+func (p *serport) encodeReportData(data []qReportJsonData) []qReportJsonData {
+	if len(p.encoding) == 0 {
+		return data
+	}
+	encoded := make([]qReportJsonData, len(data))
+	for i, qrd := range data {
+		qrd.D = encodeData(p.encoding, qrd.D)
+		encoded[i] = qrd
+	}
+	return encoded
+}
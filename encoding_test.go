@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func allBytes() string {
+	b := make([]byte, 256)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return string(b)
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	for _, enc := range []string{encodingText, encodingHex, encodingBase64} {
+		for _, data := range []string{"", "G0 X0\n", "\x00\xff\x01\x80\r\n\xc3", allBytes()} {
+			got, err := decodeData(enc, encodeData(enc, data))
+			if err != nil {
+				t.Errorf("%v %q: %v", enc, data, err)
+			} else if got != data {
+				t.Errorf("%v: got %q, want %q", enc, got, data)
+			}
+		}
+	}
+}
+
+func TestDecodeData(t *testing.T) {
+	tests := []struct {
+		enc     string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{encodingHex, "0103000a", "\x01\x03\x00\x0a", false},
+		{encodingHex, "01 03 00 0A\n", "\x01\x03\x00\x0a", false},
+		{encodingHex, "0", "", true},
+		{encodingHex, "zz", "", true},
+		{encodingBase64, "AP8B", "\x00\xff\x01", false},
+		{encodingBase64, "AAE=", "\x00\x01", false},
+		{encodingBase64, "AAE", "\x00\x01", false},
+		{encodingBase64, " AAE=\n", "\x00\x01", false},
+		{encodingBase64, "A", "", true},
+		{encodingBase64, "!!!!", "", true},
+		{encodingText, "01 zz", "01 zz", false},
+		{"", "01 zz", "01 zz", false},
+	}
+	for _, tt := range tests {
+		got, err := decodeData(tt.enc, tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v %q: err %v, wantErr %v", tt.enc, tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%v %q: got %q, want %q", tt.enc, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeData(t *testing.T) {
+	tests := []struct {
+		enc  string
+		in   string
+		want string
+	}{
+		{encodingHex, "\x00\xff\x0a", "00ff0a"},
+		{encodingBase64, "\x00\xff\x0a", "AP8K"},
+		{encodingBase64, "\x00", "AA=="},
+		{encodingText, "\x00\xff", "\x00\xff"},
+		{"", "abc", "abc"},
+	}
+	for _, tt := range tests {
+		if got := encodeData(tt.enc, tt.in); got != tt.want {
+			t.Errorf("%v %q: got %q, want %q", tt.enc, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCheckEncoding(t *testing.T) {
+	tests := []struct {
+		enc     string
+		buftype string
+		wantErr bool
+	}{
+		{"", "grbl", false},
+		{"text", "tinyg", false},
+		{"hex", "", false},
+		{"HEX", "default", false},
+		{"base64", "timed", false},
+		{"hex", "grbl", true},
+		{"base64", "marlin", true},
+		{"ebcdic", "", true},
+	}
+	for _, tt := range tests {
+		if err := checkEncoding(tt.enc, tt.buftype); (err != nil) != tt.wantErr {
+			t.Errorf("%v with %v: err %v, wantErr %v", tt.enc, tt.buftype, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMergeEncodedDataMsgs(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		wantD  string
+		wantOk bool
+	}{
+		{`{"P":"a","D":"ab"}`, `{"P":"a","D":"cd"}`, "abcd", true},
+		{`{"P":"a","D":"00ff","Encoding":"hex"}`, `{"P":"a","D":"01","Encoding":"hex"}`, "00ff01", true},
+		// the padding in the middle has to go
+		{`{"P":"a","D":"AAE=","Encoding":"base64"}`, `{"P":"a","D":"Ag==","Encoding":"base64"}`, "AAEC", true},
+		{`{"P":"a","D":"00","Encoding":"hex"}`, `{"P":"a","D":"AA=="}`, "", false},
+	}
+	for _, tt := range tests {
+		merged, ok := mergeDataMsgs([]byte(tt.a), []byte(tt.b))
+		if ok != tt.wantOk {
+			t.Errorf("%v + %v: ok %v, want %v", tt.a, tt.b, ok, tt.wantOk)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		var m SpPortMessage
+		if err := json.Unmarshal(merged, &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.D != tt.wantD {
+			t.Errorf("%v + %v: got D %q, want %q", tt.a, tt.b, m.D, tt.wantD)
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	//	"bytes"
 	"fmt"
 	"strings"
+	"sync/atomic"
 
 	"golang.org/x/crypto/ssh"
 	//	"go/scanner"
@@ -51,11 +52,9 @@ func execRun(command string) {
 	}
 
 	// grab username and password
-	isAttemptedUserPassValidation := false
 	reUser := regexp.MustCompile("(?i)^user:[a-zA-z0-9_\\-]+")
 	user := reUser.FindString(cleanCmd)
 	if len(user) > 0 {
-		isAttemptedUserPassValidation = true
 		// we found a username at the start of the exec command, use it
 		cleanCmd = reUser.ReplaceAllString(cleanCmd, "")
 		cleanCmd = strings.TrimPrefix(cleanCmd, " ")
@@ -73,7 +72,16 @@ func execRun(command string) {
 	// trim front and back of string
 	cleanCmd = regexp.MustCompile("^\\s*").ReplaceAllString(cleanCmd, "")
 	cleanCmd = regexp.MustCompile("\\s*$").ReplaceAllString(cleanCmd, "")
-	line := cleanCmd
+
+	execRunCmd(id, user, pass, cleanCmd)
+}
+
+// execRunCmd runs an already parsed exec request, streaming progress to all
+// clients, and hands back the final Done/Error status so callers like the json
+// command protocol can reply with it directly.
+func execRunCmd(id string, user string, pass string, line string) ExecCmd {
+	atomic.AddInt64(&metricExecRuns, 1)
+	isAttemptedUserPassValidation := len(user) > 0
 	argArr := []string{line}
 
 	// OLD APPROACH
@@ -115,7 +123,7 @@ func execRun(command string) {
 			mapD := ExecCmd{ExecStatus: "Error", Id: id, Cmd: cmd, Args: argArr, Output: errMsg}
 			mapB, _ := json.Marshal(mapD)
 			h.broadcastSys <- mapB
-			return
+			return mapD
 		} else {
 			log.Println("User:%s and password were valid. Running command.", user)
 		}
@@ -125,7 +133,7 @@ func execRun(command string) {
 		mapD := ExecCmd{ExecStatus: "Error", Id: id, Cmd: cmd, Args: argArr, Output: "Error trying to execute terminal command. No user/pass provided or command line switch was not specified to allow exec command. Provide a valied username/password or restart spjs with -allowexec command line option to exec command."}
 		mapB, _ := json.Marshal(mapD)
 		h.broadcastSys <- mapB
-		return
+		return mapD
 	} else {
 		log.Println("Running cmd cuz -allowexec specified as command line option.")
 	}
@@ -145,7 +153,7 @@ func execRun(command string) {
 		mapD := ExecCmd{ExecStatus: "Error", Id: id, Cmd: cmd, Args: argArr, Output: err.Error()}
 		mapB, _ := json.Marshal(mapD)
 		h.broadcastSys <- mapB
-		return
+		return mapD
 	}
 
 	scanner := bufio.NewScanner(cmdReader)
@@ -166,11 +174,12 @@ func execRun(command string) {
 		mapD := ExecCmd{ExecStatus: "Error", Id: id, Cmd: cmd, Args: argArr, Output: fmt.Sprintf("Error starting Cmd", err)}
 		mapB, _ := json.Marshal(mapD)
 		h.broadcastSys <- mapB
-		return
+		return mapD
 	}
 
 	// block here until command done
 	err = oscmd.Wait()
+	var mapD ExecCmd
 	/*if err != nil {
 			fmt.Fprintln(os.Stderr, "Error waiting for Cmd", err)
 	//		os.Exit(1)
@@ -184,19 +193,20 @@ func execRun(command string) {
 		log.Printf("Command finished with error: %v "+string(cmdOutput), err)
 		//h.broadcastSys <- []byte("Could not program the board")
 		//mapD := map[string]string{"ProgrammerStatus": "Error", "Msg": "Could not program the board. It is also possible your serial port is locked by another app and thus we can't grab it to use for programming. Make sure all other apps that may be trying to access this serial port are disconnected or exited.", "Output": string(cmdOutput)}
-		mapD := ExecCmd{ExecStatus: "Error", Id: id, Cmd: cmd, Args: argArr, Output: string(cmdOutput) + err.Error()}
+		mapD = ExecCmd{ExecStatus: "Error", Id: id, Cmd: cmd, Args: argArr, Output: string(cmdOutput) + err.Error()}
 		mapB, _ := json.Marshal(mapD)
 		h.broadcastSys <- mapB
 	} else {
 		log.Printf("Finished without error. Good stuff. stdout: " + string(cmdOutput))
 		//h.broadcastSys <- []byte("Flash OK!")
-		mapD := ExecCmd{ExecStatus: "Done", Id: id, Cmd: cmd, Args: argArr, Output: string(cmdOutput)}
+		mapD = ExecCmd{ExecStatus: "Done", Id: id, Cmd: cmd, Args: argArr, Output: string(cmdOutput)}
 		mapB, _ := json.Marshal(mapD)
 		h.broadcastSys <- mapB
 		// analyze stdin
 
 	}
 
+	return mapD
 }
 
 type ExecRuntime struct {
@@ -211,13 +221,17 @@ type ExecRuntime struct {
 // what OS we're on so you know the style of commands to send
 func execRuntime() {
 	// create the struct and send data back
-	info := ExecRuntime{"Done", runtime.GOOS, runtime.GOARCH, runtime.GOROOT(), runtime.NumCPU()}
+	info := execRuntimeInfo()
 	bm, err := json.Marshal(info)
 	if err == nil {
 		h.broadcastSys <- bm
 	}
 }
 
+func execRuntimeInfo() ExecRuntime {
+	return ExecRuntime{"Done", runtime.GOOS, runtime.GOARCH, runtime.GOROOT(), runtime.NumCPU()}
+}
+
 func checkUserPass(user string, pass string) bool {
 	// We check the validity of the username/password
 	// An SSH client is represented with a ClientConn. Currently only
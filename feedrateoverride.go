@@ -3,6 +3,7 @@ package main
 import (
 	//"fmt"
 	"encoding/json"
+	"errors"
 	"log"
 	"regexp"
 	"strconv"
@@ -49,23 +50,18 @@ func spFeedRateOverride(arg string) {
 
 	//log.Println("The data is:" + args[2] + "---")
 
-	// see if we have this port open
-	myport, isFound := findPortByName(portname)
-
-	if !isFound {
-		// we couldn't find the port, so send err
-		//isFroOn = false
-		spErr("We could not find the serial port " + portname + " that you were trying to apply the feedrate override to. This error is ok actually because it just means you have not opened the serial port yet.")
-		return
-	}
-
 	// see if they are just querying status
 	if len(args) == 2 {
+		myport, isFound := findPortByName(portname)
+		if !isFound {
+			spErr(errFroPortNotFound(portname).Error())
+			return
+		}
 		sendStatusOnFeedrateOverride(myport)
 		return
 	}
 
-	// we found our port, so now parse our multiplier
+	// parse our multiplier
 	fro, err := strconv.ParseFloat(strings.TrimSpace(args[2]), 32)
 	if err != nil {
 		errstr := "Could not parse feedrate override multiplier value: " + args[2]
@@ -74,14 +70,50 @@ func spFeedRateOverride(arg string) {
 		return
 	}
 
-	myport.isFeedRateOverrideOn = true
+	frj, err := spFeedRateOverrideSet(portname, float32(fro))
+	if err != nil {
+		spErr(err.Error())
+		return
+	}
+
+	//ls, err := json.MarshalIndent(frj, "", "\t")
+	ls, err := json.Marshal(frj)
+	if err != nil {
+		log.Println(err)
+		h.broadcastSys <- []byte("Error creating json on feedrate override report " +
+			err.Error())
+	} else {
+		//log.Print("Printing out json byte data...")
+		//log.Print(ls)
+		h.broadcastSys <- ls
+	}
+}
 
-	myport.feedRateOverride = float32(fro)
+func errFroPortNotFound(portname string) error {
+	//isFroOn = false
+	return errors.New("We could not find the serial port " + portname + " that you were trying to apply the feedrate override to. This error is ok actually because it just means you have not opened the serial port yet.")
+}
 
+// spFeedRateOverrideSet applies a feedrate override multiplier to an open
+// port. A multiplier of 0 turns the override off.
+func spFeedRateOverrideSet(portname string, fro float32) (froRequestJson, error) {
 	var frj froRequestJson
+
+	// see if we have this port open
+	myport, isFound := findPortByName(portname)
+
+	if !isFound {
+		// we couldn't find the port, so send err
+		return frj, errFroPortNotFound(portname)
+	}
+
+	myport.isFeedRateOverrideOn = true
+
+	myport.feedRateOverride = fro
+
 	frj.Cmd = "FeedRateOverride"
 	frj.FeedRateOverride = myport.feedRateOverride
-	frj.Port = myport.portConf.Name
+	frj.Port = myport.name()
 	frj.Desc = "Successfully set the feedrate override."
 
 	if frj.FeedRateOverride <= 0.0 {
@@ -93,7 +125,17 @@ func spFeedRateOverride(arg string) {
 		frj.IsOn = true
 	}
 
-	//ls, err := json.MarshalIndent(frj, "", "\t")
+	// if we made it this far we truly have a feedrate override in play
+	// so set boolean that we need to inject it into the next line
+	isFroNeedTriggered = true
+
+	return frj, nil
+}
+
+func sendStatusOnFeedrateOverride(myport *serport) {
+	// they just want a status
+	frj := feedRateOverrideStatus(myport)
+
 	ls, err := json.Marshal(frj)
 	if err != nil {
 		log.Println(err)
@@ -104,19 +146,14 @@ func spFeedRateOverride(arg string) {
 		//log.Print(ls)
 		h.broadcastSys <- ls
 	}
-
-	// if we made it this far we truly have a feedrate override in play
-	// so set boolean that we need to inject it into the next line
-	isFroNeedTriggered = true
-
+	return
 }
 
-func sendStatusOnFeedrateOverride(myport *serport) {
-	// they just want a status
+func feedRateOverrideStatus(myport *serport) froRequestJson {
 	var frj froRequestJson
 	frj.Cmd = "FeedRateOverride"
 	frj.FeedRateOverride = myport.feedRateOverride
-	frj.Port = myport.portConf.Name
+	frj.Port = myport.name()
 	frj.Desc = "Providing you status of feed rate override."
 
 	if frj.FeedRateOverride <= 0.0 {
@@ -124,18 +161,7 @@ func sendStatusOnFeedrateOverride(myport *serport) {
 	} else {
 		frj.IsOn = true
 	}
-
-	ls, err := json.Marshal(frj)
-	if err != nil {
-		log.Println(err)
-		h.broadcastSys <- []byte("Error creating json on feedrate override report " +
-			err.Error())
-	} else {
-		//log.Print("Printing out json byte data...")
-		//log.Print(ls)
-		h.broadcastSys <- ls
-	}
-	return
+	return frj
 }
 
 // Here is where we actually apply the feedrate override on a line of gcode
@@ -0,0 +1,378 @@
+// Framing. The default buffer algorithm sends back whatever each read off
+// the port happened to get, so a packet can come in two pieces or two
+// packets in one and every UI has to put them back together itself. Open a
+// port with a Framing and SPJS does that instead, sending one event per
+// complete frame.
+//   delimiter  frames end with FrameDelimiter, given in hex, i.e. 0d0a. \n
+//              if left out. the delimiter is taken off.
+//   fixed      frames are FrameSize bytes
+//   length     frames start with a FrameSize byte length (1, 2 or 4) of
+//              what follows it, big endian unless FrameLittleEndian. the
+//              length is taken off.
+//   idle       a frame ends when nothing comes in for FrameIdleMs, 20 if
+//              left out
+//   slip       RFC 1055 SLIP frames, unescaped
+//   cobs       zero terminated COBS frames, decoded
+// In the text open command it's one of slip, cobs, delimiter:0d0a,
+// fixed:16, length:2, length:2le or idle:50.
+//
+// Each frame's event has Frame set and a slow client gets them one by one
+// rather than merged like other port data.
+//
+// Framing goes with the default buffer algorithm. Encodings work with it,
+// which is what you want for anything but text.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	framingDelimiter = "delimiter"
+	framingFixed     = "fixed"
+	framingLength    = "length"
+	framingIdle      = "idle"
+	framingSlip      = "slip"
+	framingCobs      = "cobs"
+
+	// a frame that gets this big without ending is sent as is so a device
+	// that never sends the end of a frame can't eat up all our memory
+	maxFrameSize = 65536
+
+	defaultFrameIdleMs = 20
+
+	slipEnd    = 0xC0
+	slipEsc    = 0xDB
+	slipEscEnd = 0xDC
+	slipEscEsc = 0xDD
+)
+
+type FrameSettings struct {
+	Framing           string `json:",omitempty"` // delimiter, fixed, length, idle, slip or cobs
+	FrameDelimiter    string `json:",omitempty"` // hex, i.e. 0d0a. 0a if left out.
+	FrameSize         int    `json:",omitempty"` // bytes in a fixed frame or in the length
+	FrameLittleEndian bool   `json:",omitempty"` // the length is little endian
+	FrameIdleMs       int    `json:",omitempty"` // gap that ends an idle frame. 20 if left out.
+}
+
+func (fs FrameSettings) withDefaults(def FrameSettings) FrameSettings {
+	if len(fs.Framing) == 0 {
+		fs = def
+	}
+	fs.Framing = strings.ToLower(fs.Framing)
+	return fs
+}
+
+// check makes sure the settings make sense. Leaving them out is fine.
+func (fs FrameSettings) check() error {
+	switch strings.ToLower(fs.Framing) {
+	case "", framingSlip, framingCobs:
+	case framingDelimiter:
+		if _, err := fs.delimiter(); err != nil {
+			return err
+		}
+	case framingFixed:
+		if fs.FrameSize <= 0 || fs.FrameSize > maxFrameSize {
+			return errors.New("FrameSize must be from 1 to " + strconv.Itoa(maxFrameSize) + " for fixed framing")
+		}
+	case framingLength:
+		if fs.FrameSize != 1 && fs.FrameSize != 2 && fs.FrameSize != 4 {
+			return errors.New("FrameSize must be 1, 2 or 4 for length framing")
+		}
+	case framingIdle:
+		if fs.FrameIdleMs < 0 {
+			return errors.New("FrameIdleMs can't be less than 0")
+		}
+	default:
+		return errors.New("Framing must be delimiter, fixed, length, idle, slip or cobs")
+	}
+	return nil
+}
+
+// checkFraming makes sure the buffer algorithm lets us send back the data
+func checkFraming(fs FrameSettings, buftype string) error {
+	if err := fs.check(); err != nil {
+		return err
+	}
+	if len(fs.Framing) == 0 {
+		return nil
+	}
+	switch buftype {
+	case "", "default":
+		return nil
+	}
+	return errors.New("The " + buftype + " buffer algorithm sends back data its own way so it can't be used with " + fs.Framing + " framing. Use default.")
+}
+
+func (fs FrameSettings) delimiter() ([]byte, error) {
+	if len(fs.FrameDelimiter) == 0 {
+		return []byte{'\n'}, nil
+	}
+	d, err := hex.DecodeString(strings.Join(strings.Fields(fs.FrameDelimiter), ""))
+	if err != nil || len(d) == 0 {
+		return nil, errors.New("FrameDelimiter must be hex, i.e. 0d0a")
+	}
+	return d, nil
+}
+
+// parseFrameArg parses the text open form, i.e. delimiter:0d0a. It gives
+// back false if the arg isn't framing.
+func parseFrameArg(arg string) (FrameSettings, bool, error) {
+	var fs FrameSettings
+	parts := strings.SplitN(strings.ToLower(arg), ":", 2)
+	fs.Framing = parts[0]
+	val := ""
+	if len(parts) > 1 {
+		val = parts[1]
+	}
+	var err error
+	switch fs.Framing {
+	case framingSlip, framingCobs:
+	case framingDelimiter:
+		fs.FrameDelimiter = val
+	case framingFixed:
+		fs.FrameSize, err = strconv.Atoi(val)
+	case framingLength:
+		if strings.HasSuffix(val, "le") {
+			fs.FrameLittleEndian = true
+			val = strings.TrimSuffix(val, "le")
+		}
+		fs.FrameSize, err = strconv.Atoi(val)
+	case framingIdle:
+		if len(val) > 0 {
+			fs.FrameIdleMs, err = strconv.Atoi(val)
+		}
+	default:
+		return fs, false, nil
+	}
+	if err != nil {
+		return fs, true, errors.New("Could not parse the framing " + arg)
+	}
+	return fs, true, fs.check()
+}
+
+// framer puts what the port reads back together into frames and hands each
+// one to emit along with when its first byte came off the port
+type framer struct {
+	fs        FrameSettings
+	delim     []byte
+	emit      func(frame string, readTs int64)
+	lock      sync.Mutex
+	buf       []byte
+	readTs    int64
+	isEscaped bool // slip
+	idle      *time.Timer
+}
+
+func newFramer(fs FrameSettings, emit func(frame string, readTs int64)) *framer {
+	f := &framer{fs: fs, emit: emit}
+	f.delim, _ = fs.delimiter()
+	if f.fs.FrameIdleMs == 0 {
+		f.fs.FrameIdleMs = defaultFrameIdleMs
+	}
+	return f
+}
+
+// reset throws away a partial frame, i.e. when the port is reopened
+func (f *framer) reset() {
+	f.lock.Lock()
+	f.buf = nil
+	f.isEscaped = false
+	f.lock.Unlock()
+}
+
+func (f *framer) stop() {
+	f.lock.Lock()
+	if f.idle != nil {
+		f.idle.Stop()
+	}
+	f.lock.Unlock()
+}
+
+// add takes what was just read and sends back any frames it finished
+func (f *framer) add(data []byte, readTs int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch f.fs.Framing {
+	case framingSlip:
+		f.addSlip(data, readTs)
+		return
+	case framingCobs:
+		f.addCobs(data, readTs)
+		return
+	}
+
+	if len(f.buf) == 0 {
+		f.readTs = readTs
+	}
+	f.buf = append(f.buf, data...)
+
+	switch f.fs.Framing {
+	case framingDelimiter:
+		for {
+			i := bytes.Index(f.buf, f.delim)
+			if i < 0 {
+				break
+			}
+			f.send(f.buf[:i])
+			f.buf = f.buf[i+len(f.delim):]
+			f.readTs = readTs
+		}
+	case framingFixed:
+		for len(f.buf) >= f.fs.FrameSize {
+			f.send(f.buf[:f.fs.FrameSize])
+			f.buf = f.buf[f.fs.FrameSize:]
+			f.readTs = readTs
+		}
+	case framingLength:
+		for len(f.buf) >= f.fs.FrameSize {
+			length := f.frameLength()
+			if length > maxFrameSize {
+				log.Printf("Got a frame length of %v which is more than %v. Throwing away %v bytes.\n", length, maxFrameSize, len(f.buf))
+				f.buf = nil
+				return
+			}
+			// it fits in an int now, even on 32 bit arm
+			n := int(length)
+			if len(f.buf) < f.fs.FrameSize+n {
+				break
+			}
+			f.send(f.buf[f.fs.FrameSize : f.fs.FrameSize+n])
+			f.buf = f.buf[f.fs.FrameSize+n:]
+			f.readTs = readTs
+		}
+	case framingIdle:
+		if f.idle == nil {
+			f.idle = time.AfterFunc(time.Duration(f.fs.FrameIdleMs)*time.Millisecond, f.flush)
+		} else {
+			f.idle.Reset(time.Duration(f.fs.FrameIdleMs) * time.Millisecond)
+		}
+	}
+
+	if len(f.buf) >= maxFrameSize {
+		log.Printf("Frame got to %v bytes without ending. Sending it as is.\n", len(f.buf))
+		f.send(f.buf)
+		f.buf = nil
+	}
+	if len(f.buf) == 0 {
+		// don't hang on to a big array we're done with
+		f.buf = nil
+	}
+}
+
+// flush sends the idle frame once nothing has come in for a while
+func (f *framer) flush() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.buf) > 0 {
+		f.send(f.buf)
+		f.buf = nil
+	}
+}
+
+// frameLength stays a uint32 so a length of 2GB or more can't go negative
+// as an int on 32 bit systems and get past the maxFrameSize check
+func (f *framer) frameLength() uint32 {
+	prefix := f.buf[:f.fs.FrameSize]
+	var order binary.ByteOrder = binary.BigEndian
+	if f.fs.FrameLittleEndian {
+		order = binary.LittleEndian
+	}
+	switch f.fs.FrameSize {
+	case 1:
+		return uint32(prefix[0])
+	case 2:
+		return uint32(order.Uint16(prefix))
+	}
+	return order.Uint32(prefix)
+}
+
+func (f *framer) addSlip(data []byte, readTs int64) {
+	for _, c := range data {
+		if len(f.buf) == 0 {
+			f.readTs = readTs
+		}
+		switch {
+		case c == slipEnd:
+			// an END with nothing before it just marks the start
+			if len(f.buf) > 0 {
+				f.send(f.buf)
+			}
+			f.buf = f.buf[:0]
+			f.isEscaped = false
+			continue
+		case c == slipEsc:
+			f.isEscaped = true
+			continue
+		case f.isEscaped && c == slipEscEnd:
+			c = slipEnd
+		case f.isEscaped && c == slipEscEsc:
+			c = slipEsc
+		}
+		f.isEscaped = false
+		f.buf = append(f.buf, c)
+		if len(f.buf) >= maxFrameSize {
+			log.Printf("SLIP frame got to %v bytes without an END. Sending it as is.\n", len(f.buf))
+			f.send(f.buf)
+			f.buf = f.buf[:0]
+		}
+	}
+}
+
+func (f *framer) addCobs(data []byte, readTs int64) {
+	for _, c := range data {
+		if len(f.buf) == 0 {
+			f.readTs = readTs
+		}
+		if c != 0 {
+			f.buf = append(f.buf, c)
+			if len(f.buf) >= maxFrameSize {
+				log.Printf("COBS frame got to %v bytes without a zero. Throwing it away.\n", len(f.buf))
+				f.buf = f.buf[:0]
+			}
+			continue
+		}
+		if len(f.buf) > 0 {
+			frame, err := cobsDecode(f.buf)
+			if err != nil {
+				log.Println("Throwing away a COBS frame. " + err.Error())
+			} else {
+				f.send(frame)
+			}
+		}
+		f.buf = f.buf[:0]
+	}
+}
+
+// send hands a copy of the frame to emit since the buffer gets reused
+func (f *framer) send(frame []byte) {
+	f.emit(string(frame), f.readTs)
+}
+
+func cobsDecode(in []byte) ([]byte, error) {
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); {
+		code := int(in[i])
+		i++
+		end := i + code - 1
+		if end > len(in) {
+			return nil, errors.New("COBS frame is cut short")
+		}
+		out = append(out, in[i:end]...)
+		i = end
+		if code < 0xFF && i < len(in) {
+			out = append(out, 0)
+		}
+	}
+	return out, nil
+}
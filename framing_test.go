@@ -0,0 +1,185 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// frames feeds the chunks to a framer and gives back the frames it sent
+func frames(fs FrameSettings, chunks ...string) []string {
+	var lock sync.Mutex
+	got := []string{}
+	f := newFramer(fs, func(frame string, readTs int64) {
+		lock.Lock()
+		got = append(got, frame)
+		lock.Unlock()
+	})
+	for _, chunk := range chunks {
+		f.add([]byte(chunk), 1)
+	}
+	if fs.Framing == framingIdle {
+		time.Sleep(time.Duration(fs.FrameIdleMs*5) * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	return got
+}
+
+func TestFramer(t *testing.T) {
+	delim := FrameSettings{Framing: framingDelimiter}
+	crlf := FrameSettings{Framing: framingDelimiter, FrameDelimiter: "0d0a"}
+	fixed := FrameSettings{Framing: framingFixed, FrameSize: 3}
+	len1 := FrameSettings{Framing: framingLength, FrameSize: 1}
+	len2 := FrameSettings{Framing: framingLength, FrameSize: 2}
+	len2le := FrameSettings{Framing: framingLength, FrameSize: 2, FrameLittleEndian: true}
+	len4 := FrameSettings{Framing: framingLength, FrameSize: 4}
+	len4le := FrameSettings{Framing: framingLength, FrameSize: 4, FrameLittleEndian: true}
+	slip := FrameSettings{Framing: framingSlip}
+	cobs := FrameSettings{Framing: framingCobs}
+	run254 := strings.Repeat("a", 254)
+
+	tests := []struct {
+		name   string
+		fs     FrameSettings
+		chunks []string
+		want   []string
+	}{
+		{"delimiter newline", delim, []string{"ok\nok\n"}, []string{"ok", "ok"}},
+		{"delimiter across chunks", crlf, []string{"ab\r", "\ncd\r\nef", "\r\n"}, []string{"ab", "cd", "ef"}},
+		{"delimiter empty frame", delim, []string{"a\n\nb\n"}, []string{"a", "", "b"}},
+		{"delimiter partial left", delim, []string{"a\nb"}, []string{"a"}},
+		{"delimiter binary", FrameSettings{Framing: framingDelimiter, FrameDelimiter: "00ff"}, []string{"\x01\x00", "\xff\x02\x00\xff"}, []string{"\x01", "\x02"}},
+		{"fixed", fixed, []string{"abcdefg"}, []string{"abc", "def"}},
+		{"fixed across chunks", fixed, []string{"a", "bc", "d", "efghi"}, []string{"abc", "def", "ghi"}},
+		{"length 1", len1, []string{"\x02ab\x01c"}, []string{"ab", "c"}},
+		{"length 1 empty frame", len1, []string{"\x00\x01a"}, []string{"", "a"}},
+		{"length 2 big endian", len2, []string{"\x00\x02ab\x00", "\x03cde"}, []string{"ab", "cde"}},
+		{"length 2 little endian", len2le, []string{"\x02\x00ab\x03", "\x00cde"}, []string{"ab", "cde"}},
+		{"length 2 prefix split", len2, []string{"\x00", "\x01", "z"}, []string{"z"}},
+		{"length 2 waits for the rest", len2, []string{"\x01\x00ab"}, []string{}},
+		{"length 4 big endian", len4, []string{"\x00\x00\x00\x02ab"}, []string{"ab"}},
+		{"length 4 little endian", len4le, []string{"\x02\x00", "\x00\x00a", "b"}, []string{"ab"}},
+		{"length 4 too big", len4, []string{"\x00\x01\x00\x01abc", "\x00\x00\x00\x01z"}, []string{"z"}},
+		{"length 4 0xFFFFFFFF", len4, []string{"\xff\xff\xff\xffabc", "\x00\x00\x00\x02ok"}, []string{"ok"}},
+		{"length 4 le 0xFFFFFFFF", len4le, []string{"\xff\xff\xff\xffabc", "\x02\x00\x00\x00ok"}, []string{"ok"}},
+		{"slip", slip, []string{"\xc0abc\xc0"}, []string{"abc"}},
+		{"slip leading ends", slip, []string{"\xc0\xc0\xc0a\xc0\xc0b\xc0"}, []string{"a", "b"}},
+		{"slip escapes", slip, []string{"a\xdb\xdcb\xdb\xddc\xc0"}, []string{"a\xc0b\xdbc"}},
+		{"slip escape across chunks", slip, []string{"a\xdb", "\xdcb\xc0"}, []string{"a\xc0b"}},
+		{"slip bad escape kept", slip, []string{"a\xdbb\xc0"}, []string{"ab"}},
+		{"slip partial left", slip, []string{"a\xc0b"}, []string{"a"}},
+		{"cobs", cobs, []string{"\x03\x11\x22\x02\x33\x00"}, []string{"\x11\x22\x00\x33"}},
+		{"cobs code 1", cobs, []string{"\x01\x01\x00"}, []string{"\x00"}},
+		{"cobs trailing zero", cobs, []string{"\x03ab\x01\x00"}, []string{"ab\x00"}},
+		{"cobs 0xFF run", cobs, []string{"\xff" + run254 + "\x00"}, []string{run254}},
+		{"cobs 0xFF run then more", cobs, []string{"\xff" + run254, "\x02b\x00"}, []string{run254 + "b"}},
+		{"cobs across chunks", cobs, []string{"\x03a", "b", "\x00\x02c\x00"}, []string{"ab", "c"}},
+		{"cobs cut short", cobs, []string{"\x05ab\x00\x02c\x00"}, []string{"c"}},
+		{"idle", FrameSettings{Framing: framingIdle, FrameIdleMs: 10}, []string{"ab", "cd"}, []string{"abcd"}},
+	}
+	for _, tt := range tests {
+		got := frames(tt.fs, tt.chunks...)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFramerTooBig(t *testing.T) {
+	got := frames(FrameSettings{Framing: framingDelimiter}, strings.Repeat("a", maxFrameSize), "b\n")
+	if len(got) != 2 || len(got[0]) != maxFrameSize || got[1] != "b" {
+		t.Errorf("got %v frames", len(got))
+	}
+}
+
+func TestFramerReadTs(t *testing.T) {
+	var ts []int64
+	f := newFramer(FrameSettings{Framing: framingDelimiter}, func(frame string, readTs int64) {
+		ts = append(ts, readTs)
+	})
+	f.add([]byte("a"), 1)
+	f.add([]byte("b\nc"), 2)
+	f.add([]byte("\n"), 3)
+	// a frame goes out with when its first byte came in
+	if want := []int64{1, 2}; !reflect.DeepEqual(ts, want) {
+		t.Errorf("got %v, want %v", ts, want)
+	}
+}
+
+func TestParseFrameArg(t *testing.T) {
+	tests := []struct {
+		arg       string
+		want      FrameSettings
+		isFraming bool
+		wantErr   bool
+	}{
+		{"slip", FrameSettings{Framing: framingSlip}, true, false},
+		{"COBS", FrameSettings{Framing: framingCobs}, true, false},
+		{"delimiter", FrameSettings{Framing: framingDelimiter}, true, false},
+		{"delimiter:0d0a", FrameSettings{Framing: framingDelimiter, FrameDelimiter: "0d0a"}, true, false},
+		{"delimiter:zz", FrameSettings{Framing: framingDelimiter, FrameDelimiter: "zz"}, true, true},
+		{"fixed:16", FrameSettings{Framing: framingFixed, FrameSize: 16}, true, false},
+		{"fixed:0", FrameSettings{Framing: framingFixed}, true, true},
+		{"fixed:x", FrameSettings{Framing: framingFixed}, true, true},
+		{"length:2", FrameSettings{Framing: framingLength, FrameSize: 2}, true, false},
+		{"length:4le", FrameSettings{Framing: framingLength, FrameSize: 4, FrameLittleEndian: true}, true, false},
+		{"length:3", FrameSettings{Framing: framingLength, FrameSize: 3}, true, true},
+		{"idle", FrameSettings{Framing: framingIdle}, true, false},
+		{"idle:50", FrameSettings{Framing: framingIdle, FrameIdleMs: 50}, true, false},
+		{"grbl", FrameSettings{}, false, false},
+		{"7E1", FrameSettings{}, false, false},
+	}
+	for _, tt := range tests {
+		got, isFraming, err := parseFrameArg(tt.arg)
+		if isFraming != tt.isFraming || (err != nil) != tt.wantErr {
+			t.Errorf("%v: isFraming %v err %v, want %v and wantErr %v", tt.arg, isFraming, err, tt.isFraming, tt.wantErr)
+			continue
+		}
+		if isFraming && !tt.wantErr && got != tt.want {
+			t.Errorf("%v: got %+v, want %+v", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestCheckFraming(t *testing.T) {
+	tests := []struct {
+		fs      FrameSettings
+		buftype string
+		wantErr bool
+	}{
+		{FrameSettings{}, "grbl", false},
+		{FrameSettings{Framing: framingSlip}, "", false},
+		{FrameSettings{Framing: framingSlip}, "default", false},
+		{FrameSettings{Framing: framingSlip}, "timed", true},
+		{FrameSettings{Framing: framingCobs}, "tinyg", true},
+		{FrameSettings{Framing: "morse"}, "", true},
+		{FrameSettings{Framing: framingFixed, FrameSize: maxFrameSize + 1}, "", true},
+		{FrameSettings{Framing: framingIdle, FrameIdleMs: -1}, "", true},
+	}
+	for _, tt := range tests {
+		if err := checkFraming(tt.fs, tt.buftype); (err != nil) != tt.wantErr {
+			t.Errorf("%+v with %v: err %v, wantErr %v", tt.fs, tt.buftype, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFramesNotMerged(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		wantOk bool
+	}{
+		{`{"P":"a","D":"ab","Frame":true}`, `{"P":"a","D":"cd","Frame":true}`, false},
+		{`{"P":"a","D":"ab"}`, `{"P":"a","D":"cd","Frame":true}`, false},
+		{`{"P":"a","D":"ab","Frame":true}`, `{"P":"a","D":"cd"}`, false},
+		{`{"P":"a","D":"0a","Encoding":"hex","Frame":true}`, `{"P":"a","D":"0b","Encoding":"hex","Frame":true}`, false},
+		{`{"P":"a","D":"ab","Frame":false}`, `{"P":"a","D":"cd"}`, true},
+	}
+	for _, tt := range tests {
+		if _, ok := mergeDataMsgs([]byte(tt.a), []byte(tt.b)); ok != tt.wantOk {
+			t.Errorf("%v + %v: ok %v, want %v", tt.a, tt.b, ok, tt.wantOk)
+		}
+	}
+}
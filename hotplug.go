@@ -0,0 +1,103 @@
+// Hotplug. Clients used to have to poll list to notice a device being
+// plugged in, and every list walks all of /sys on Linux. Instead we keep
+// an eye on a cheap signature of the ports the OS has, which lives in the
+// hotplug_*.go file for your OS, and only when that changes do we build the
+// full port list and diff it against the last one. Every client then gets a
+// PortAdded or PortRemoved event with the same metadata as the port list,
+// i.e. vid/pid, serial number and friendly name.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how long we give the OS to finish setting up a device after it shows up,
+// i.e. for udev to make the /dev node, before we look up its metadata
+var hotplugSettle = 500 * time.Millisecond
+
+// a close can take a port off the list without the OS noticing anything,
+// i.e. one that was unplugged while it was open, so closes nudge us
+var hotplugNudge = make(chan bool, 1)
+
+type PortHotplugMsg struct {
+	Cmd  string // PortAdded or PortRemoved
+	Port string
+	SpPortItem
+}
+
+func nudgeHotplug() {
+	select {
+	case hotplugNudge <- true:
+	default:
+	}
+}
+
+// watchHotplug runs forever. The -hotplug flag is looked at on every pass so
+// a reloaded config file can turn it on or off.
+func watchHotplug() {
+	known := hotplugPorts()
+	lastSig := ""
+	if sig, err := portSignature(); err == nil {
+		lastSig = sig
+	}
+
+	for {
+		if *hotplug <= 0 {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		select {
+		case <-time.After(time.Duration(*hotplug) * time.Millisecond):
+			sig, err := portSignature()
+			if err != nil || sig == lastSig {
+				continue
+			}
+			lastSig = sig
+			time.Sleep(hotplugSettle)
+		case <-hotplugNudge:
+		}
+
+		now := hotplugPorts()
+		for name, item := range now {
+			if _, isFound := known[name]; !isFound {
+				log.Printf("Port %v was plugged in\n", item.Name)
+				h.broadcastSys <- hotplugMsg("PortAdded", item)
+			}
+		}
+		for name, item := range known {
+			if _, isFound := now[name]; !isFound {
+				log.Printf("Port %v was unplugged\n", item.Name)
+				h.broadcastSys <- hotplugMsg("PortRemoved", item)
+			}
+		}
+		known = now
+	}
+}
+
+// hotplugPorts gives back the port list keyed by lower case name since
+// Windows doesn't care about case
+func hotplugPorts() map[string]SpPortItem {
+	ports := make(map[string]SpPortItem)
+	for _, item := range spListData().SerialPorts {
+		ports[strings.ToLower(item.Name)] = item
+	}
+	return ports
+}
+
+func hotplugMsg(cmd string, item SpPortItem) []byte {
+	b, _ := json.Marshal(PortHotplugMsg{Cmd: cmd, Port: item.Name, SpPortItem: item})
+	return b
+}
+
+// joinSignature turns a list of names into a signature that doesn't care
+// what order the OS gave them to us in
+func joinSignature(names []string) string {
+	sort.Strings(names)
+	return strings.Join(names, "\n")
+}
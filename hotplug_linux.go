@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+)
+
+// portSignature lists /sys/class/tty, which is one directory read, rather
+// than walking all of /sys like the port list does. Any tty coming or going
+// shows up here.
+func portSignature() (string, error) {
+	d, err := os.Open("/sys/class/tty")
+	if err != nil {
+		return "", err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return "", err
+	}
+	return joinSignature(names), nil
+}
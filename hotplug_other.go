@@ -0,0 +1,18 @@
+// +build !linux
+
+package main
+
+import (
+	"github.com/facchinm/go-serial"
+)
+
+// portSignature asks the serial library for just the port names, which is
+// a registry read on Windows and a look at /dev on the Mac, and leaves the
+// metadata for when something changed
+func portSignature() (string, error) {
+	names, err := serial.GetPortsList()
+	if err != nil {
+		return "", err
+	}
+	return joinSignature(names), nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 
@@ -14,8 +15,8 @@ import (
 	"encoding/json"
 	"runtime"
 	"runtime/debug"
-	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 type hub struct {
@@ -33,6 +34,28 @@ type hub struct {
 
 	// Unregister requests from connections.
 	unregister chan *connection
+
+	// Messages meant for one connection only, i.e. json command replies
+	direct chan directMsg
+
+	// Inbound text commands along with the connection that sent them
+	commands chan cmdMsg
+
+	// Requests for the list of connected clients
+	listClients chan chan []*connection
+}
+
+// directMsg is a message for a single connection rather than all of them
+type directMsg struct {
+	c *connection
+	m []byte
+}
+
+// cmdMsg is a text command and who sent it. c is nil when the command
+// came from inside SPJS rather than from a websocket.
+type cmdMsg struct {
+	c *connection
+	m []byte
 }
 
 var h = hub{
@@ -44,6 +67,9 @@ var h = hub{
 	//broadcastSys: make(chan []byte),
 	register:    make(chan *connection),
 	unregister:  make(chan *connection),
+	direct:      make(chan directMsg, 1000),
+	commands:    make(chan cmdMsg, 1000),
+	listClients: make(chan chan []*connection),
 	connections: make(map[*connection]bool),
 }
 
@@ -53,11 +79,24 @@ func (h *hub) run() {
 		case c := <-h.register:
 			h.connections[c] = true
 			// send supported commands
-			c.send <- []byte("{\"Version\" : \"" + version + "\"} ")
-			c.send <- []byte("{\"Commands\" : [\"list\", \"open [portName] [baud] [bufferAlgorithm (optional)]\", \"send [portName] [cmd]\", \"sendnobuf [portName] [cmd]\", \"sendjson {P:portName, Data:[{D:cmdStr, Id:idStr}]}\",  \"close [portName]\", \"bufferalgorithms\", \"baudrates\", \"restart\", \"exit\", \"broadcast [anythingToRegurgitate]\", \"hostname\", \"version\", \"program [portName] [core:architecture:name] [path/to/binOrHexFile]\", \"programfromurl [portName] [core:architecture:name] [urlToBinOrHexFile]\", \"execruntime\", \"exec [command] [arg1] [arg2] [...]\"]} ")
-			c.send <- []byte("{\"Hostname\" : \"" + *hostname + "\"} ")
+			c.send <- outMsg{m: []byte("{\"Version\" : \"" + version + "\"} ")}
+			c.send <- outMsg{m: spjsCmdsMsg}
+			c.send <- outMsg{m: []byte("{\"Hostname\" : \"" + *hostname + "\"} ")}
+			if currentAuthConf() != nil {
+				c.send <- outMsg{m: []byte("{\"User\" : \"" + c.user + "\", \"Role\" : \"" + c.role + "\"} ")}
+			}
+			h.startSession(c)
 		case c := <-h.unregister:
+			// a slow client we dropped is already gone. its reader still
+			// unregisters once it stops, and ending the session again would
+			// skip what happened in between on resume.
+			if _, ok := h.connections[c]; !ok {
+				continue
+			}
 			delete(h.connections, c)
+			releaseAllLeases(c)
+			stopAllShares(c)
+			endSession(c)
 			// put close in func cuz it was creating panics and want
 			// to isolate
 			func() {
@@ -73,287 +112,92 @@ func (h *hub) run() {
 				close(c.send)
 			}()
 		case m := <-h.broadcast:
-			//log.Print("Got a broadcast")
-			//log.Print(m)
-			//log.Print(len(m))
-			if len(m) > 0 {
-				//log.Print(string(m))
-				//log.Print(h.broadcast)
-				checkCmd(m)
-				//log.Print("-----")
-
-				for c := range h.connections {
-					select {
-					case c.send <- m:
-						//log.Print("did broadcast to ")
-						//log.Print(c.ws.RemoteAddr())
-						//c.send <- []byte("hello world")
-					default:
-						delete(h.connections, c)
-						close(c.send)
-						go c.ws.Close()
-					}
-				}
+			h.runCmd(nil, m)
+		case cm := <-h.commands:
+			h.runCmd(cm.c, cm.m)
+		case reply := <-h.listClients:
+			conns := []*connection{}
+			for c := range h.connections {
+				conns = append(conns, c)
 			}
+			reply <- conns
+		case dm := <-h.direct:
+			// the connection may have gone away while its command ran
+			if _, ok := h.connections[dm.c]; !ok {
+				break
+			}
+			m, seq := stampMsg(dm.m)
+			h.deliver(dm.c, m, seq, &msgTopic{Class: topicSystem})
 		case m := <-h.broadcastSys:
 			//log.Printf("Got a system broadcast: %v\n", string(m))
 			//log.Print(string(m))
 			//log.Print("-----")
 
-			for c := range h.connections {
-				select {
-				case c.send <- m:
-					//log.Print("did broadcast to ")
-					//log.Print(c.ws.RemoteAddr())
-					//c.send <- []byte("hello world")
-				default:
-					delete(h.connections, c)
-					close(c.send)
-					go c.ws.Close()
-				}
+			m, seq := stampMsg(m)
+
+			// count port events for /metrics and keep them around
+			// for clients that resume
+			topic := classifyMsg(m)
+			countEvent(topic)
+			recordHistory(m, topic, seq)
+			h.fanOut(m, seq, &topic)
+		}
+		atomic.StoreInt64(&metricClients, int64(len(h.connections)))
+	}
+}
+
+// runCmd runs a text command and then echoes it to everybody
+func (h *hub) runCmd(c *connection, m []byte) {
+	//log.Print("Got a broadcast")
+	//log.Print(m)
+	//log.Print(len(m))
+	if len(m) > 0 {
+		//log.Print(string(m))
+		//log.Print(h.broadcast)
+		checkCmd(c, m)
+		//log.Print("-----")
+
+		// the echo of a command is its own event class
+		h.fanOut(m, 0, &msgTopic{Class: topicCommand})
+	}
+}
+
+// fanOut sends m to every connection whose subscriptions want it. We only
+// work out what kind of message it is if somebody is actually filtering.
+// Pass in t if the caller already knows the topic.
+func (h *hub) fanOut(m []byte, seq int64, t *msgTopic) {
+	for c := range h.connections {
+		if c.subs.isFiltering() {
+			if t == nil {
+				topic := classifyMsg(m)
+				t = &topic
+			}
+			if !c.subs.wants(*t) {
+				continue
 			}
 		}
+		h.deliver(c, m, seq, t)
 	}
 }
 
-func checkCmd(m []byte) {
+// checkCmd runs a text command. The commands themselves live in the
+// table in commands.go.
+func checkCmd(c *connection, m []byte) {
 	//log.Print("Inside checkCmd")
 	s := string(m[:])
 	log.Print(s)
 
-	sl := strings.ToLower(s)
-
-	if strings.HasPrefix(sl, "open") {
-
-		// check if user wants to open this port as a secondary port
-		// this doesn't mean much other than allowing the UI to show
-		// a port as primary and make other ports sort of act less important
-		isSecondary := false
-		if strings.HasPrefix(s, "open secondary") {
-			isSecondary = true
-			// swap out the word secondary
-			s = strings.Replace(s, "open secondary", "open", 1)
-		}
-
-		// remove newline
-		args := strings.Split(strings.TrimSpace(s), " ")
-		if len(args) < 3 {
-			go spErr("You did not specify a port and baud rate in your open cmd")
-			return
-		}
-		if len(args[1]) < 1 {
-			go spErr("You did not specify a serial port")
-			return
-		}
-
-		baudStr := strings.Replace(args[2], "\n", "", -1)
-		baud, err := strconv.Atoi(baudStr)
-		if err != nil {
-			go spErr("Problem converting baud rate " + args[2])
-			return
-		}
-		// pass in buffer type now as string. if user does not
-		// ask for a buffer type pass in empty string
-		bufferAlgorithm := ""
-		if len(args) > 3 {
-			// cool. we got a buffer type request
-			buftype := strings.Replace(args[3], "\n", "", -1)
-			bufferAlgorithm = buftype
-		}
-		go spHandlerOpen(args[1], baud, bufferAlgorithm, isSecondary)
-
-	} else if strings.HasPrefix(sl, "close") {
-
-		log.Printf("About to split close commands. cmd:\"%v\"", s)
-		// remove newline
-		args := strings.Split(strings.TrimSpace(s), " ")
-		//args := strings.Split(s, " ")
-		log.Printf("The split args for close:%v", args)
-		if len(args) > 1 {
-			go spClose(args[1])
-		} else {
-			go spErr("You did not specify a port to close")
-		}
-
-	} else if strings.HasPrefix(sl, "programkill") {
-
-		// kill the running process (assumes singleton for now)
-		go spHandlerProgramKill()
-
-	} else if strings.HasPrefix(sl, "programfromurl") {
-
-		args := strings.Split(s, " ")
-		if len(args) == 4 {
-			go spProgramFromUrl(args[1], args[2], args[3])
-		} else {
-			go spErr("You did not specify a port, a board to program and/or a URL")
-		}
-
-	} else if strings.HasPrefix(sl, "program") {
-
-		args := strings.Split(s, " ")
-		if len(args) > 3 {
-			var slice []string = args[3:len(args)]
-			go spProgram(args[1], args[2], strings.Join(slice, " "))
-		} else {
-			go spErr("You did not specify a port, a board to program and/or a filename")
-		}
+	if isShuttingDown() {
+		go spErr(errShuttingDown.Error())
+		return
+	}
 
-	} else if strings.HasPrefix(sl, "sendjson") {
-		// will catch sendjson
-
-		go spWriteJson(s)
-
-	} else if strings.HasPrefix(sl, "send") {
-		// will catch send and sendnobuf
-
-		//args := strings.Split(s, "send ")
-		go spWrite(s)
-
-	} else if strings.HasPrefix(sl, "list") {
-		go spList()
-		//go getListViaWmiPnpEntity()
-	} else if strings.HasPrefix(sl, "fro") {
-		// User is wanting us to tweak the feedrate on-the-fly
-		go spFeedRateOverride(s)
-
-	} else if strings.HasPrefix(sl, "bufferalgorithm") {
-		go spBufferAlgorithms()
-	} else if strings.HasPrefix(sl, "baudrate") {
-		go spBaudRates()
-	} else if strings.HasPrefix(sl, "broadcast") {
-		go broadcast(s)
-	} else if strings.HasPrefix(sl, "restart") {
-		restart()
-	} else if strings.HasPrefix(sl, "exit") {
-		exit()
-	} else if strings.HasPrefix(sl, "memstats") {
-		memoryStats()
-	} else if strings.HasPrefix(sl, "gc") {
-		garbageCollection()
-	} else if strings.HasPrefix(sl, "bufflowdebug") {
-		bufflowdebug(sl)
-	} else if strings.HasPrefix(sl, "hostname") {
-		getHostname()
-	} else if strings.HasPrefix(sl, "version") {
-		getVersion()
-	} else if strings.HasPrefix(sl, "execruntime") {
-		execRuntime()
-	} else if strings.HasPrefix(sl, "exec") {
-		go execRun(s)
-	} else if strings.HasPrefix(sl, "cayenn-sendudp") {
-		cayennSendUdp(s)
-	} else if strings.HasPrefix(sl, "cayenn-sendtcp") {
-		cayennSendTcp(s)
-	} else if strings.HasPrefix(sl, "usblist") {
-		SendUsbList()
-		/*
-			} else if strings.HasPrefix(sl, "gethost") {
-				hostname, err := gpio.Host()
-				if err != nil {
-					go h.sendErr(err.Error())
-				}
-				go h.sendMsg("Host", hostname)
-
-			} else if strings.HasPrefix(sl, "getpinmap") {
-				pinMap, err := gpio.PinMap()
-				if err != nil {
-					go h.sendErr(err.Error())
-				}
-				go h.sendMsg("PinMap", pinMap)
-			} else if strings.HasPrefix(sl, "getpinstates") {
-				pinStates, err := gpio.PinStates()
-				if err != nil {
-					go h.sendErr(err.Error())
-				}
-				go h.sendMsg("PinStates", pinStates)
-
-			} else if strings.HasPrefix(sl, "initpin") {
-				// format : setpin pinId dir pullup
-				args := strings.Split(s, " ")
-				if len(args) < 4 {
-					go h.sendErr("You did not specify a pin and a direction [0|1|low|high] and a name")
-					return
-				}
-				if len(args[1]) < 1 {
-					go h.sendErr("You did not specify a pin")
-					return
-				}
-				pin := args[1]
-				dirStr := args[2]
-				name := args[4]
-				dir := In
-				switch {
-				case dirStr == "1" || dirStr == "out" || dirStr == "output":
-					dir = Out
-				case dirStr == "0" || dirStr == "in" || dirStr == "input":
-					dir = In
-				case dirStr == "pwm":
-					dir = PWM
-				}
-				pullup := Pull_None
-				switch {
-				case args[3] == "1" || args[3] == "up":
-					pullup = Pull_Up
-				case args[3] == "0" || args[3] == "down":
-					pullup = Pull_Down
-				}
-				err := gpio.PinInit(pin, dir, pullup, name)
-				if err != nil {
-					go h.sendErr(err.Error())
-				}
-			} else if strings.HasPrefix(sl, "removepin") {
-				// format : removepin pinId
-				args := strings.Split(s, " ")
-				if len(args) < 2 {
-					go h.sendErr("You did not specify a pin id")
-					return
-				}
-				err := gpio.PinRemove(args[1])
-				if err != nil {
-					go h.sendErr(err.Error())
-				}
-			} else if strings.HasPrefix(sl, "setpin") {
-				// format : setpin pinId high/low/1/0
-				args := strings.Split(s, " ")
-				if len(args) < 3 {
-					go h.sendErr("You did not specify a pin and a state [0|1|low|high]")
-					return
-				}
-				if len(args[1]) < 1 {
-					go h.sendErr("You did not specify a pin")
-					return
-				}
-				pin := args[1]
-				stateStr := args[2]
-				state := 0
-				switch {
-				case stateStr == "1" || stateStr == "high":
-					state = 1
-				case stateStr == "0" || stateStr == "low":
-					state = 0
-				default:
-					// assume its a pwm value...if it converts to integer in 0-255 range
-					s, err := strconv.Atoi(stateStr)
-					if err != nil {
-						go h.sendErr("Invalid value, must be between 0 and 255 : " + stateStr)
-						return
-					}
-					if s < 0 || s > 255 {
-						go h.sendErr("Invalid value, must be between 0 and 255 : " + stateStr)
-						return
-					}
-					state = s
-				}
-
-				err := gpio.PinSet(pin, byte(state))
-				if err != nil {
-					go h.sendErr(err.Error())
-				}
-		*/
-	} else {
+	sc := findTextCmd(m)
+	if sc == nil || sc.Text == nil {
 		go spErr("Could not understand command.")
+		return
 	}
+	sc.Text(c, s)
 
 	//log.Print("Done with checkCmd")
 }
@@ -397,21 +241,15 @@ func garbageCollection() {
 	memoryStats()
 }
 
-func exit() {
-	log.Println("Starting new spjs process")
-	h.broadcastSys <- []byte("{\"Exiting\" : true}")
-	log.Fatal("Exited current spjs cuz asked to")
-
-}
-
-func restart() {
+// launchSelf starts a new spjs process for a restart. statePath is the file
+// of ports for it to reopen, if we saved one.
+func launchSelf(statePath string) {
 	// relaunch ourself and exit
 	// the relaunch works because we pass a cmdline in
 	// that has serial-port-json-server only initialize 5 seconds later
 	// which gives us time to exit and unbind from serial ports and TCP/IP
 	// sockets like :8989
 	log.Println("Starting new spjs process")
-	h.broadcastSys <- []byte("{\"Restarting\" : true}")
 
 	// figure out current path of executable so we know how to restart
 	// this process
@@ -436,18 +274,17 @@ func restart() {
 	}
 	fmt.Printf("exePath using osext: %v\n", exePath)
 
-	// figure out garbageCollection flag
-	//isGcFlag := "false"
-
-	var cmd *exec.Cmd
-	/*if *isGC {
-		//isGcFlag = "true"
-		cmd = exec.Command(exePath, "-ls", "-addr", *addr, "-regex", *regExpFilter, "-gc")
-	} else {
-		cmd = exec.Command(exePath, "-ls", "-addr", *addr, "-regex", *regExpFilter)
-
-	}*/
-	cmd = exec.Command(exePath, "-ls", "-addr", *addr, "-regex", *regExpFilter, "-gc", *gcType)
+	// pass along every flag from our command line so the new process has
+	// the same exec, tls, hotplug and so on. the ones the config file set
+	// come back when it loads the config file.
+	args := []string{"-ls"}
+	flag.Visit(func(f *flag.Flag) {
+		if cmdLineFlags[f.Name] && f.Name != "ls" && f.Name != "restore" {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	args = append(args, "-restore", statePath)
+	cmd := exec.Command(exePath, args...)
 
 	//cmd := exec.Command("./serial-port-json-server", "ls")
 	err := cmd.Start()
@@ -457,7 +294,6 @@ func restart() {
 	} else {
 		h.broadcastSys <- []byte("{\"Restarted\" : true}")
 	}
-	log.Fatal("Exited current spjs for restart")
 	//log.Printf("Waiting for command to finish...")
 	//err = cmd.Wait()
 	//log.Printf("Command finished with error: %v", err)
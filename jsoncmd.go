@@ -0,0 +1,400 @@
+// The json command protocol lets a client send a structured command such as
+//   {"Id":"123", "Cmd":"open", "Args":{"Port":"COM7", "Baud":115200}}
+// instead of the free-form text commands checkCmd() understands. Every json
+// command gets exactly one reply sent back only to the connection that asked,
+// carrying the same Id, so clients no longer have to guess which broadcast
+// belongs to which action. The normal broadcasts (Open, Queued, Complete, etc)
+// still go out to everybody just like they do for text commands.
+// Field names are matched case-insensitively, so "id"/"cmd"/"args" work too.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// bump this if the envelope or reply format ever changes incompatibly
+const jsonCmdVersion = 1
+
+// how long we wait on an open to tell us how it went before giving up
+var jsonCmdOpenTimeout = 10 * time.Second
+
+type JsonCmd struct {
+	V    int // protocol version, 0 is treated as the current version
+	Id   string
+	Cmd  string
+	Args json.RawMessage
+}
+
+type JsonCmdReply struct {
+	V           int
+	Id          string
+	ReplyTo     string
+	ReplyStatus string      // Done or Error
+	Result      interface{} `json:",omitempty"`
+	Error       string      `json:",omitempty"`
+}
+
+type jsonCmdHandler func(c *connection, args json.RawMessage) (interface{}, error)
+
+// isJsonCmd tells us whether an inbound websocket message is a json command
+// envelope. Legacy text commands never start with a {
+func isJsonCmd(m []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(m), []byte("{"))
+}
+
+func runJsonCmd(c *connection, m []byte) {
+	var req JsonCmd
+	err := json.Unmarshal(m, &req)
+	if err != nil {
+		log.Printf("Problem decoding json command. json:%v, err:%v\n", string(m), err)
+		sendJsonCmdReply(c, req, nil, errors.New("Problem decoding json command. "+err.Error()))
+		return
+	}
+	log.Printf("Got json command. id:%v, cmd:%v, args:%v\n", req.Id, req.Cmd, string(req.Args))
+
+	if isShuttingDown() {
+		sendJsonCmdReply(c, req, nil, errShuttingDown)
+		return
+	}
+
+	if req.V > jsonCmdVersion {
+		sendJsonCmdReply(c, req, nil, fmt.Errorf("Json command version %v is not supported. This server speaks version %v.", req.V, jsonCmdVersion))
+		return
+	}
+
+	sc, ok := spjsCmdsByName[strings.ToLower(req.Cmd)]
+	if !ok || sc.Json == nil {
+		sendJsonCmdReply(c, req, nil, errors.New("Could not understand command "+req.Cmd+"."))
+		return
+	}
+
+	if !mayRun(c.role, sc.Name) {
+		sendJsonCmdReply(c, req, nil, errNotAllowed(c, sc.Name))
+		return
+	}
+
+	result, err := sc.Json(c, req.Args)
+	sendJsonCmdReply(c, req, result, err)
+}
+
+func sendJsonCmdReply(c *connection, req JsonCmd, result interface{}, err error) {
+	reply := JsonCmdReply{
+		V:           jsonCmdVersion,
+		Id:          req.Id,
+		ReplyTo:     strings.ToLower(req.Cmd),
+		ReplyStatus: "Done",
+		Result:      result,
+	}
+	if err != nil {
+		reply.ReplyStatus = "Error"
+		reply.Error = err.Error()
+	}
+	b, merr := json.Marshal(reply)
+	if merr != nil {
+		log.Println("Failed to marshal json command reply. err:", merr)
+		return
+	}
+	h.direct <- directMsg{c, b}
+}
+
+// parseJsonCmdArgs decodes the args of a command into v. Commands that take
+// no args are fine with an empty or missing Args.
+func parseJsonCmdArgs(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(args, v); err != nil {
+		return errors.New("Problem decoding args. " + err.Error())
+	}
+	return nil
+}
+
+type jsonCmdPortArgs struct {
+	Port string
+}
+
+type jsonCmdOpenArgs struct {
+	Port            string
+	Baud            int
+	BufferAlgorithm string
+	IsSecondary     bool
+	PortOptions
+}
+
+type jsonCmdSendArgs struct {
+	Port     string
+	Data     string
+	Encoding string // leave out to use the port's
+}
+
+type jsonCmdFroArgs struct {
+	Port             string
+	FeedRateOverride *float32 // leave out to just get the status
+}
+
+type jsonCmdProgramArgs struct {
+	Port  string
+	Board string
+	File  string
+	Url   string
+}
+
+type jsonCmdExecArgs struct {
+	Cmd  string
+	User string
+	Pass string
+}
+
+type jsonCmdCayennArgs struct {
+	Ip  string
+	Msg string
+}
+
+type jsonCmdBufFlowDebugArgs struct {
+	Mode string // on or off
+}
+
+type jsonCmdBroadcastArgs struct {
+	Msg string
+}
+
+func jsonCmdList(c *connection, args json.RawMessage) (interface{}, error) {
+	return spListData(), nil
+}
+
+func jsonCmdOpen(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdOpenArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if len(a.Port) < 1 {
+		return nil, errors.New("You did not specify a serial port")
+	}
+
+	done := make(chan error, 1)
+	go spHandlerOpen(a.Port, a.Baud, a.BufferAlgorithm, a.PortOptions, a.IsSecondary, done)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	case <-time.After(jsonCmdOpenTimeout):
+		return nil, errors.New("Timed out waiting for port " + a.Port + " to open")
+	}
+	return a, nil
+}
+
+func jsonCmdClose(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdPortArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, spClosePort(a.Port)
+}
+
+func jsonCmdSend(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdSendArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	data, err := decodePortData(c, a.Port, a.Data, a.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	return nil, spWritePort(c, a.Port, data, true)
+}
+
+func jsonCmdSendNoBuf(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdSendArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	data, err := decodePortData(c, a.Port, a.Data, a.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	return nil, spWritePort(c, a.Port, data, false)
+}
+
+func jsonCmdSendJson(c *connection, args json.RawMessage) (interface{}, error) {
+	// the args are exactly what the text sendjson command takes
+	var m writeRequestJson
+	if err := parseJsonCmdArgs(args, &m); err != nil {
+		return nil, err
+	}
+	return nil, spWriteJsonReq(c, m)
+}
+
+func jsonCmdQueue(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdPortArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return spQueueStatusData(a.Port)
+}
+
+func jsonCmdFro(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdFroArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if a.FeedRateOverride == nil {
+		myport, isFound := findPortByName(a.Port)
+		if !isFound {
+			return nil, errFroPortNotFound(a.Port)
+		}
+		return feedRateOverrideStatus(myport), nil
+	}
+	frj, err := spFeedRateOverrideSet(a.Port, *a.FeedRateOverride)
+	if err != nil {
+		return nil, err
+	}
+	return frj, nil
+}
+
+func jsonCmdBufferAlgorithms(c *connection, args json.RawMessage) (interface{}, error) {
+	return availableBufferAlgorithms, nil
+}
+
+func jsonCmdBaudRates(c *connection, args json.RawMessage) (interface{}, error) {
+	return availableBaudRates, nil
+}
+
+func jsonCmdBroadcast(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdBroadcastArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if len(a.Msg) == 0 {
+		return nil, errors.New("You did not specify a message to broadcast")
+	}
+	broadcast("broadcast " + a.Msg)
+	return nil, nil
+}
+
+func jsonCmdRestart(c *connection, args json.RawMessage) (interface{}, error) {
+	return jsonCmdShutdown(args, true)
+}
+
+func jsonCmdExit(c *connection, args json.RawMessage) (interface{}, error) {
+	return jsonCmdShutdown(args, false)
+}
+
+func jsonCmdMemStats(c *connection, args json.RawMessage) (interface{}, error) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return memStats, nil
+}
+
+func jsonCmdGc(c *connection, args json.RawMessage) (interface{}, error) {
+	garbageCollection()
+	return jsonCmdMemStats(c, args)
+}
+
+func jsonCmdBufFlowDebug(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdBufFlowDebugArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	mode := strings.ToLower(a.Mode)
+	if mode != "" && mode != "on" && mode != "off" {
+		return nil, errors.New("Mode must be on or off")
+	}
+	bufflowdebug("bufflowdebug " + mode)
+	return *bufFlowDebugType, nil
+}
+
+func jsonCmdHostname(c *connection, args json.RawMessage) (interface{}, error) {
+	return *hostname, nil
+}
+
+func jsonCmdVersionInfo(c *connection, args json.RawMessage) (interface{}, error) {
+	return version, nil
+}
+
+func jsonCmdProgram(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdProgramArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if len(a.Port) == 0 || len(a.Board) == 0 || len(a.File) == 0 {
+		return nil, errors.New("You did not specify a port, a board to program and/or a filename")
+	}
+	// the ProgrammerStatus broadcasts carry the detail, we just
+	// reply once the programmer has finished
+	spProgram(a.Port, a.Board, a.File)
+	return nil, nil
+}
+
+func jsonCmdProgramFromUrl(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdProgramArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if len(a.Port) == 0 || len(a.Board) == 0 || len(a.Url) == 0 {
+		return nil, errors.New("You did not specify a port, a board to program and/or a URL")
+	}
+	spProgramFromUrl(a.Port, a.Board, a.Url)
+	return nil, nil
+}
+
+func jsonCmdProgramKill(c *connection, args json.RawMessage) (interface{}, error) {
+	spHandlerProgramKill()
+	return nil, nil
+}
+
+func jsonCmdExecRuntime(c *connection, args json.RawMessage) (interface{}, error) {
+	return execRuntimeInfo(), nil
+}
+
+func jsonCmdExec(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdExecArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(a.Cmd)) == 0 {
+		return nil, errors.New("You did not specify a command to exec")
+	}
+	res := execRunCmd("", a.User, a.Pass, strings.TrimSpace(a.Cmd))
+	if res.ExecStatus == "Error" {
+		return res, errors.New(res.Output)
+	}
+	return res, nil
+}
+
+func jsonCmdCayennSendUdp(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdCayennArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if len(a.Ip) < 7 {
+		return nil, errors.New("Error parsing IP address for cayenn-sendudp")
+	}
+	cayennSendUdpMsg(a.Ip, ":8988", a.Msg)
+	return nil, nil
+}
+
+func jsonCmdCayennSendTcp(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdCayennArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if len(a.Ip) < 7 {
+		return nil, errors.New("Error parsing IP address for cayenn-sendtcp")
+	}
+	cayennSendTcpMsg(a.Ip, ":8988", a.Msg)
+	return nil, nil
+}
+
+func jsonCmdUsbList(c *connection, args json.RawMessage) (interface{}, error) {
+	return GetUsbList(), nil
+}
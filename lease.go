@@ -0,0 +1,278 @@
+// Port leases let one websocket connection claim exclusive control of a
+// port so two people driving the same machine don't end up with their jogs
+// and jobs interleaved in sendBuffered. A port nobody has claimed can be
+// written to by anybody just like before. Once claimed, send, sendnobuf and
+// sendjson from any other connection are rejected until the holder releases
+// it, disconnects, lets it time out, or somebody claims it with takeover.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type portLease struct {
+	c *connection
+
+	// how long the lease survives without the holder writing to the
+	// port. 0 means it never times out.
+	timeout  time.Duration
+	lastUsed time.Time
+}
+
+func (l *portLease) isExpired() bool {
+	return l.timeout > 0 && time.Since(l.lastUsed) > l.timeout
+}
+
+var leaseMutex = &sync.Mutex{}
+var leases = make(map[*serport]*portLease)
+
+// each websocket connection gets a number so clients can tell each other apart
+var lastClientId int64
+
+func nextClientId() int64 {
+	return atomic.AddInt64(&lastClientId, 1)
+}
+
+type LeaseEvent struct {
+	Cmd      string // Claimed or Released
+	Port     string
+	ClientId int64
+	User     string
+	Timeout  int `json:",omitempty"` // seconds
+	Desc     string
+}
+
+type SpClient struct {
+	Id     int64
+	User   string
+	Role   string
+	Addr   string
+	Claims []string
+}
+
+type SpClientList struct {
+	Clients []SpClient
+}
+
+func broadcastLeaseEvent(cmd string, p *serport, c *connection, timeout time.Duration, desc string) {
+	ev := LeaseEvent{Cmd: cmd, Port: p.name(), ClientId: c.id, User: c.user, Timeout: int(timeout / time.Second), Desc: desc}
+	b, _ := json.Marshal(ev)
+	h.broadcastSys <- b
+}
+
+// spClaim gives c the lease on a port. If somebody else holds it we only
+// take it from them if takeover is set.
+func spClaim(c *connection, portname string, takeover bool, timeout time.Duration) error {
+	myport, isFound := findPortByName(portname)
+	if !isFound {
+		return errors.New("We could not find the serial port " + portname + " that you were trying to claim.")
+	}
+
+	leaseMutex.Lock()
+	l, isClaimed := leases[myport]
+	if isClaimed && l.c != c && !l.isExpired() && !takeover {
+		leaseMutex.Unlock()
+		return errLeaseHeld(myport, l)
+	}
+	leases[myport] = &portLease{c: c, timeout: timeout, lastUsed: time.Now()}
+	leaseMutex.Unlock()
+
+	desc := "Got claim on port."
+	if isClaimed && l.c != c {
+		desc = "Took over claim on port from client " + strconv.FormatInt(l.c.id, 10) + "."
+	}
+	log.Printf("Client %v claimed port %v. %v\n", c.id, myport.name(), desc)
+	broadcastLeaseEvent("Claimed", myport, c, timeout, desc)
+	return nil
+}
+
+func spRelease(c *connection, portname string) error {
+	myport, isFound := findPortByName(portname)
+	if !isFound {
+		return errors.New("We could not find the serial port " + portname + " that you were trying to release.")
+	}
+
+	leaseMutex.Lock()
+	l, isClaimed := leases[myport]
+	if !isClaimed || l.c != c {
+		leaseMutex.Unlock()
+		return errors.New("You do not hold the claim on port " + myport.name() + ".")
+	}
+	delete(leases, myport)
+	leaseMutex.Unlock()
+
+	broadcastLeaseEvent("Released", myport, c, 0, "Got release on port.")
+	return nil
+}
+
+// releaseAllLeases is called when a connection goes away so its ports
+// don't stay locked forever
+func releaseAllLeases(c *connection) {
+	leaseMutex.Lock()
+	released := []*serport{}
+	for p, l := range leases {
+		if l.c == c {
+			delete(leases, p)
+			released = append(released, p)
+		}
+	}
+	leaseMutex.Unlock()
+
+	for _, p := range released {
+		go broadcastLeaseEvent("Released", p, c, 0, "Client disconnected.")
+	}
+}
+
+// dropLease forgets the lease on a port that is being closed
+func dropLease(p *serport) {
+	leaseMutex.Lock()
+	delete(leases, p)
+	leaseMutex.Unlock()
+}
+
+// checkLease makes sure c is allowed to write to p. A nil connection is
+// SPJS itself, i.e. a bufferflow sending its own init commands, which is
+// always allowed.
+func checkLease(c *connection, p *serport) error {
+	if c == nil {
+		return nil
+	}
+	leaseMutex.Lock()
+	defer leaseMutex.Unlock()
+	l, isClaimed := leases[p]
+	if !isClaimed {
+		return nil
+	}
+	if l.c == c {
+		l.lastUsed = time.Now()
+		return nil
+	}
+	if l.isExpired() {
+		log.Printf("Claim on port %v by client %v timed out\n", p.name(), l.c.id)
+		delete(leases, p)
+		return nil
+	}
+	return errLeaseHeld(p, l)
+}
+
+// leaseErr is what you get for writing to a port somebody else has claimed
+type leaseErr struct {
+	msg string
+}
+
+func (e leaseErr) Error() string {
+	return e.msg
+}
+
+func errLeaseHeld(p *serport, l *portLease) error {
+	holder := "client " + strconv.FormatInt(l.c.id, 10)
+	if len(l.c.user) > 0 {
+		holder += " (" + l.c.user + ")"
+	}
+	return leaseErr{"Port " + p.name() + " is claimed by " + holder + ". Use claim with takeover if you need control of it."}
+}
+
+// leasedPorts gives back the names of the ports c holds
+func leasedPorts(c *connection) []string {
+	leaseMutex.Lock()
+	defer leaseMutex.Unlock()
+	ports := []string{}
+	for p, l := range leases {
+		if l.c == c && !l.isExpired() {
+			ports = append(ports, p.name())
+		}
+	}
+	return ports
+}
+
+// spClientsData asks the hub for who is connected. Don't call this from
+// inside the hub goroutine or it will deadlock.
+func spClientsData() SpClientList {
+	reply := make(chan []*connection)
+	h.listClients <- reply
+	conns := <-reply
+
+	list := SpClientList{Clients: []SpClient{}}
+	for _, c := range conns {
+		list.Clients = append(list.Clients, SpClient{Id: c.id, User: c.user, Role: c.role, Addr: c.addr, Claims: leasedPorts(c)})
+	}
+	return list
+}
+
+func spClients() {
+	b, _ := json.Marshal(spClientsData())
+	h.broadcastSys <- b
+}
+
+// spClaimCmd parses the text version of claim, i.e.
+//   claim COM7 [takeover] [timeout:60]
+func spClaimCmd(c *connection, s string) {
+	args := strings.Fields(s)
+	if len(args) < 2 {
+		spErr("You did not specify a port to claim")
+		return
+	}
+	takeover := false
+	timeout := 0
+	for _, arg := range args[2:] {
+		al := strings.ToLower(arg)
+		if al == "takeover" {
+			takeover = true
+		} else if strings.HasPrefix(al, "timeout:") {
+			secs, err := strconv.Atoi(strings.TrimPrefix(al, "timeout:"))
+			if err != nil {
+				spErr("Problem converting timeout " + arg)
+				return
+			}
+			timeout = secs
+		}
+	}
+	if err := spClaim(c, args[1], takeover, time.Duration(timeout)*time.Second); err != nil {
+		spErr(err.Error())
+	}
+}
+
+func spReleaseCmd(c *connection, s string) {
+	args := strings.Fields(s)
+	if len(args) < 2 {
+		spErr("You did not specify a port to release")
+		return
+	}
+	if err := spRelease(c, args[1]); err != nil {
+		spErr(err.Error())
+	}
+}
+
+type jsonCmdClaimArgs struct {
+	Port     string
+	Takeover bool
+	Timeout  int // seconds
+}
+
+func jsonCmdClaim(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdClaimArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, spClaim(c, a.Port, a.Takeover, time.Duration(a.Timeout)*time.Second)
+}
+
+func jsonCmdRelease(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdPortArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, spRelease(c, a.Port)
+}
+
+func jsonCmdClients(c *connection, args json.RawMessage) (interface{}, error) {
+	return spClientsData(), nil
+}
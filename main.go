@@ -34,6 +34,24 @@ var (
 	//homeTempl *template.Template
 	isLaunchSelf = flag.Bool("ls", false, "launch self 5 seconds later")
 	isAllowExec  = flag.Bool("allowexec", false, "Allow terminal commands to be executed")
+	restoreFile  = flag.String("restore", "", "File of ports to reopen. restart passes this to the new process so you don't normally set it yourself")
+	configFile   = flag.String("config", "", "Json config file that can set any of these flags plus per port defaults like baud, buffer algorithm and auto open. Reread on SIGHUP or the reloadconfig command")
+	authFile     = flag.String("authfile", "", "Json file of users, tokens/passwords and roles. If set, websocket clients must authenticate and can only run the commands their role allows")
+
+	// what to do with a websocket client that can't keep up and how often we
+	// ping clients to make sure they are still there
+	slowClient = flag.String("slowclient", "coalesce", "What to do when a websocket client can't keep up. coalesce = (default) hold back messages for it and merge raw port data into fewer messages, drop = hold back messages but throw away raw port data, disconnect = drop the client like older versions did. Complete, Error, OpenFail and other control events are always kept unless you use disconnect")
+	wsPing     = flag.Int("wsping", 5, "Seconds between websocket pings. A client that doesn't answer for 3 pings in a row is disconnected. 0 turns pings off")
+
+	// how much we remember so a client that reconnects can catch up
+	historySize  = flag.Int("history", 500, "How many recent events to keep per port so clients that resume their session can be replayed what they missed. 0 turns history off")
+	resumeWindow = flag.Int("resumewindow", 300, "Seconds a dropped client has to come back with its resume token")
+
+	// how often we look for serial ports being plugged in or unplugged
+	hotplug = flag.Int("hotplug", 1000, "Milliseconds between looks for serial ports being plugged in or unplugged. Clients get a PortAdded or PortRemoved event when one is. 0 turns it off")
+
+	// whether to put Seq/Ts/Mono on every json event
+	isStamp = flag.Bool("stamp", true, "Stamp every json event with a sequence number (Seq), the server time (Ts) and a monotonic time (Mono). Use -stamp=false to turn off")
 
 	// regular expression to sort the serial port list
 	// typically this wouldn't be provided, but if the user wants to clean
@@ -88,6 +106,14 @@ func main() {
 	// setup logging
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
+	// the config file fills in whatever wasn't on the command line
+	flag.Visit(func(f *flag.Flag) { cmdLineFlags[f.Name] = true })
+	if len(*configFile) > 0 {
+		if _, err := loadConfigFile(*configFile, false); err != nil {
+			log.Fatal("Error loading config file: ", err)
+		}
+	}
+
 	// see if we are supposed to wait 5 seconds
 	if *isLaunchSelf {
 		launchSelfLater()
@@ -119,6 +145,17 @@ func main() {
 		log.Println("Enabling exec commands because you passed in -allowexec")
 	}
 
+	if *slowClient != slowClientCoalesce && *slowClient != slowClientDrop && *slowClient != slowClientDisconnect {
+		log.Fatal("The -slowclient option must be coalesce, drop or disconnect")
+	}
+
+	if len(*authFile) > 0 {
+		if err := loadAuthFile(*authFile); err != nil {
+			log.Fatal("Error loading auth file: ", err)
+		}
+		log.Println("Websocket authentication is on because you passed in -authfile")
+	}
+
 	ip, err := externalIP()
 	if err != nil {
 		log.Println(err)
@@ -182,6 +219,24 @@ func main() {
 	go udpServerRun()
 	go tcpServerRun()
 
+	// reopen what was open before a restart, then open the ports the
+	// config file asks for, one at a time
+	go func() {
+		if len(*restoreFile) > 0 {
+			restorePorts(*restoreFile)
+		}
+		autoOpenPorts()
+	}()
+
+	// reread the config on SIGHUP and shut down cleanly on ctrl-c
+	if len(*configFile) > 0 {
+		go watchConfigSignal()
+	}
+	go watchShutdownSignal()
+
+	// tell clients about ports being plugged in or unplugged
+	go watchHotplug()
+
 	// Setup GPIO server
 	// Ignore GPIO for now, but it would be nice to get GPIO going natively
 	//gpio.PreInit()
@@ -190,6 +245,8 @@ func main() {
 
 	http.HandleFunc("/", homeHandler)
 	http.HandleFunc("/ws", wsHandler)
+	http.HandleFunc(restPrefix+"/", restHandler)
+	http.HandleFunc("/metrics", metricsHandler)
 
 	go startHttp(ip)
 	go startHttps(ip)
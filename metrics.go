@@ -0,0 +1,179 @@
+// Metrics for monitoring SPJS from Prometheus or anything else that can
+// scrape its text format. They are served at /metrics. We write the text
+// format by hand rather than pull in the Prometheus client library since
+// all we need is a handful of counters and gauges.
+//
+// Per port counters are kept by port name and survive the port being
+// closed and reopened so they only ever go up, like Prometheus expects.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// portStats are only ever touched with sync/atomic
+type portStats struct {
+	bytesRead      int64
+	bytesWritten   int64
+	linesCompleted int64
+	errors         int64
+	opens          int64
+	closes         int64
+	openFails      int64
+
+	// how long sends sat waiting in BlockUntilReady() because the
+	// bufferflow had the port paused
+	pausedNanos int64
+}
+
+var portStatsMutex = &sync.Mutex{}
+var portStatsByName = make(map[string]*portStats)
+
+var metricClients int64
+var metricProgrammerRuns int64
+var metricExecRuns int64
+
+func portStatsFor(portname string) *portStats {
+	portStatsMutex.Lock()
+	defer portStatsMutex.Unlock()
+	ps, isFound := portStatsByName[portname]
+	if !isFound {
+		ps = &portStats{}
+		portStatsByName[portname] = ps
+	}
+	return ps
+}
+
+// countEvent picks out the port events we keep count of as they go
+// through the hub
+func countEvent(t msgTopic) {
+	if len(t.Port) == 0 {
+		return
+	}
+	var counter *int64
+	ps := portStatsFor(t.Port)
+	switch t.Cmd {
+	case "Complete", "CompleteFake":
+		counter = &ps.linesCompleted
+	case "Error":
+		counter = &ps.errors
+	case "Open":
+		counter = &ps.opens
+	case "Close":
+		counter = &ps.closes
+	case "OpenFail":
+		counter = &ps.openFails
+	default:
+		return
+	}
+	atomic.AddInt64(counter, 1)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := authenticate(r); !ok {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"spjs\"")
+		http.Error(w, "Not authorized", 401)
+		return
+	}
+
+	var b bytes.Buffer
+	writeMetric(&b, "spjs_info", "gauge", "Version of this SPJS", []metricSample{{"version=\"" + metricLabel(version) + "\"", 1}})
+	writeMetric(&b, "spjs_uptime_seconds", "gauge", "Seconds since SPJS started", []metricSample{{"", time.Since(serverStart).Seconds()}})
+	writeMetric(&b, "spjs_websocket_clients", "gauge", "Connected websocket clients", []metricSample{{"", float64(atomic.LoadInt64(&metricClients))}})
+	writeMetric(&b, "spjs_hub_channel_depth", "gauge", "Messages waiting in the hub channels", []metricSample{
+		{"channel=\"broadcast\"", float64(len(h.broadcast))},
+		{"channel=\"broadcastSys\"", float64(len(h.broadcastSys))},
+		{"channel=\"direct\"", float64(len(h.direct))},
+		{"channel=\"commands\"", float64(len(h.commands))},
+	})
+
+	queued := []metricSample{}
+	for _, p := range sh.portList() {
+		queued = append(queued, metricSample{metricPortLabel(p.name()), float64(p.itemsInBuffer)})
+	}
+	writeMetric(&b, "spjs_port_items_in_buffer", "gauge", "Commands queued in SPJS for an open port", queued)
+
+	portStatsMutex.Lock()
+	names := []string{}
+	for name := range portStatsByName {
+		names = append(names, name)
+	}
+	portStatsMutex.Unlock()
+	sort.Strings(names)
+
+	perPort := func(get func(ps *portStats) float64) []metricSample {
+		samples := []metricSample{}
+		for _, name := range names {
+			samples = append(samples, metricSample{metricPortLabel(name), get(portStatsFor(name))})
+		}
+		return samples
+	}
+	writeMetric(&b, "spjs_port_bytes_read_total", "counter", "Bytes read from a port",
+		perPort(func(ps *portStats) float64 { return float64(atomic.LoadInt64(&ps.bytesRead)) }))
+	writeMetric(&b, "spjs_port_bytes_written_total", "counter", "Bytes written to a port",
+		perPort(func(ps *portStats) float64 { return float64(atomic.LoadInt64(&ps.bytesWritten)) }))
+	writeMetric(&b, "spjs_port_lines_completed_total", "counter", "Complete and CompleteFake responses for a port",
+		perPort(func(ps *portStats) float64 { return float64(atomic.LoadInt64(&ps.linesCompleted)) }))
+	writeMetric(&b, "spjs_port_errors_total", "counter", "Error responses for a port",
+		perPort(func(ps *portStats) float64 { return float64(atomic.LoadInt64(&ps.errors)) }))
+	writeMetric(&b, "spjs_port_bufferflow_paused_seconds_total", "counter", "Time sends spent held back by the buffer algorithm of a port",
+		perPort(func(ps *portStats) float64 { return time.Duration(atomic.LoadInt64(&ps.pausedNanos)).Seconds() }))
+	writeMetric(&b, "spjs_port_opens_total", "counter", "Times a port was opened",
+		perPort(func(ps *portStats) float64 { return float64(atomic.LoadInt64(&ps.opens)) }))
+	writeMetric(&b, "spjs_port_closes_total", "counter", "Times a port was closed",
+		perPort(func(ps *portStats) float64 { return float64(atomic.LoadInt64(&ps.closes)) }))
+	writeMetric(&b, "spjs_port_open_failures_total", "counter", "OpenFail events for a port",
+		perPort(func(ps *portStats) float64 { return float64(atomic.LoadInt64(&ps.openFails)) }))
+
+	writeMetric(&b, "spjs_programmer_runs_total", "counter", "Times the programmer was run", []metricSample{{"", float64(atomic.LoadInt64(&metricProgrammerRuns))}})
+	writeMetric(&b, "spjs_exec_runs_total", "counter", "Times exec was run", []metricSample{{"", float64(atomic.LoadInt64(&metricExecRuns))}})
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	writeMetric(&b, "go_goroutines", "gauge", "Number of goroutines", []metricSample{{"", float64(runtime.NumGoroutine())}})
+	writeMetric(&b, "go_memstats_alloc_bytes", "gauge", "Bytes allocated and still in use", []metricSample{{"", float64(memStats.Alloc)}})
+	writeMetric(&b, "go_memstats_heap_inuse_bytes", "gauge", "Bytes in in-use heap spans", []metricSample{{"", float64(memStats.HeapInuse)}})
+	writeMetric(&b, "go_memstats_heap_objects", "gauge", "Number of allocated objects", []metricSample{{"", float64(memStats.HeapObjects)}})
+	writeMetric(&b, "go_memstats_sys_bytes", "gauge", "Bytes obtained from the OS", []metricSample{{"", float64(memStats.Sys)}})
+	writeMetric(&b, "go_gc_cycles_total", "counter", "Completed garbage collection cycles", []metricSample{{"", float64(memStats.NumGC)}})
+	writeMetric(&b, "go_gc_pause_seconds_total", "counter", "Time spent in garbage collection pauses", []metricSample{{"", time.Duration(memStats.PauseTotalNs).Seconds()}})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+func writeMetric(b *bytes.Buffer, name string, kind string, help string, samples []metricSample) {
+	fmt.Fprintf(b, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+	for _, s := range samples {
+		if len(s.labels) > 0 {
+			fmt.Fprintf(b, "%v{%v} %v\n", name, s.labels, s.value)
+		} else {
+			fmt.Fprintf(b, "%v %v\n", name, s.value)
+		}
+	}
+}
+
+func metricPortLabel(portname string) string {
+	return "port=\"" + metricLabel(portname) + "\""
+}
+
+// metricLabel escapes a label value, i.e. a windows port name like \\.\COM10
+func metricLabel(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return strings.Replace(s, "\n", "\\n", -1)
+}
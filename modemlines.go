@@ -0,0 +1,236 @@
+// Modem lines of an open port. setdtr and setrts drive the DTR and RTS
+// outputs, i.e. to reset an ESP32 or Arduino or key an RS-485 adapter, and
+// sendbreak holds the line in break. Every open port also gets a watcher
+// that sends a ModemLines event when CTS, DSR, DCD or RI change, so you can
+// tell when a device drops carrier.
+//
+// These count as writing to the port so they respect claims like send does.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ModemLines struct {
+	Cmd  string // ModemLines
+	Port string
+
+	// what we drive
+	Dtr bool
+	Rts bool
+
+	// what the device drives
+	Cts bool
+	Dsr bool
+	Dcd bool
+	Ri  bool
+}
+
+// lineController is implemented by port io that drives its own modem lines
+// rather than leave it to the OS
+type lineController interface {
+	SetDTR(on bool) error
+	SetRTS(on bool) error
+	SendBreak(d time.Duration) error
+	ModemLines() (ModemLines, error)
+}
+
+var errModemNotSupported = errors.New("This port can't do that with its modem lines on this OS")
+
+// how often the watcher looks at the modem lines
+var modemLinesPoll = 100 * time.Millisecond
+
+var defaultBreak = 250 * time.Millisecond
+
+type jsonCmdModemLineArgs struct {
+	Port string
+	On   bool
+}
+
+type jsonCmdSendBreakArgs struct {
+	Port string
+	Ms   int // how long to hold the break. 250 if left out.
+}
+
+func (p *serport) setDTR(on bool) error {
+	if lc, ok := p.io().(lineController); ok {
+		return lc.SetDTR(on)
+	}
+	return osSetDTR(p.io(), on)
+}
+
+func (p *serport) setRTS(on bool) error {
+	if lc, ok := p.io().(lineController); ok {
+		return lc.SetRTS(on)
+	}
+	return osSetRTS(p.io(), on)
+}
+
+func (p *serport) sendBreak(d time.Duration) error {
+	if lc, ok := p.io().(lineController); ok {
+		return lc.SendBreak(d)
+	}
+	return osSendBreak(p.io(), d)
+}
+
+func (p *serport) modemLines() (ModemLines, error) {
+	var ml ModemLines
+	var err error
+	if lc, ok := p.io().(lineController); ok {
+		ml, err = lc.ModemLines()
+	} else {
+		ml, err = osModemLines(p.io())
+	}
+	ml.Cmd = "ModemLines"
+	ml.Port = p.name()
+	return ml, err
+}
+
+// watchModemLines sends a ModemLines event when the port is opened and then
+// every time the lines change. It quietly gives up on ports that can't tell
+// us their lines.
+func (p *serport) watchModemLines() {
+	var last ModemLines
+	isFirst := true
+	for !p.isClosing {
+		ml, err := p.modemLines()
+		if err != nil {
+			if isFirst {
+				log.Printf("Not watching the modem lines of port %v. err:%v\n", p.name(), err)
+			}
+			return
+		}
+		if isFirst || ml != last {
+			b, _ := json.Marshal(ml)
+			h.broadcastSys <- b
+			shareModemLines(p, ml)
+		}
+		last = ml
+		isFirst = false
+		time.Sleep(modemLinesPoll)
+	}
+}
+
+// spSetModemLine sets DTR or RTS on a port for c
+func spSetModemLine(c *connection, portname string, line string, on bool) error {
+	myport, isFound := findPortByName(portname)
+	if !isFound {
+		return errors.New("We could not find the serial port " + portname + " to set " + strings.ToUpper(line) + " on.")
+	}
+	if err := checkLease(c, myport); err != nil {
+		return err
+	}
+	var err error
+	if line == "dtr" {
+		err = myport.setDTR(on)
+	} else {
+		err = myport.setRTS(on)
+	}
+	if err != nil {
+		return errors.New("Could not set " + strings.ToUpper(line) + " on port " + portname + ". " + err.Error())
+	}
+	log.Printf("Set %v %v on port %v\n", strings.ToUpper(line), on, portname)
+	// remember it for when the port gets reconfigured
+	myport.lock.Lock()
+	if line == "dtr" {
+		myport.portConf.DtrOn = on
+	} else {
+		myport.portConf.RtsOn = on
+	}
+	myport.lock.Unlock()
+	return nil
+}
+
+func spSendBreak(c *connection, portname string, d time.Duration) error {
+	myport, isFound := findPortByName(portname)
+	if !isFound {
+		return errors.New("We could not find the serial port " + portname + " to send a break on.")
+	}
+	if err := checkLease(c, myport); err != nil {
+		return err
+	}
+	if d <= 0 {
+		d = defaultBreak
+	}
+	log.Printf("Sending a %v break on port %v\n", d, portname)
+	if err := myport.sendBreak(d); err != nil {
+		return errors.New("Could not send a break on port " + portname + ". " + err.Error())
+	}
+	return nil
+}
+
+// textSetModemLine handles setdtr and setrts, i.e.
+//   setdtr COM4 off
+func textSetModemLine(c *connection, s string) {
+	args := strings.Fields(s)
+	if len(args) != 3 {
+		spErr("You need to give a port and on or off, i.e. " + args[0] + " COM4 on")
+		return
+	}
+	var on bool
+	switch strings.ToLower(args[2]) {
+	case "on", "true", "1":
+		on = true
+	case "off", "false", "0":
+		on = false
+	default:
+		spErr("Did not understand " + args[2] + ". Use on or off.")
+		return
+	}
+	line := strings.TrimPrefix(strings.ToLower(args[0]), "set")
+	if err := spSetModemLine(c, args[1], line, on); err != nil {
+		spErr(err.Error())
+	}
+}
+
+// textSendBreak handles sendbreak, i.e.
+//   sendbreak COM4 500
+func textSendBreak(c *connection, s string) {
+	args := strings.Fields(s)
+	if len(args) < 2 {
+		spErr("You did not specify a port to send a break on")
+		return
+	}
+	ms := 0
+	if len(args) > 2 {
+		var err error
+		ms, err = strconv.Atoi(args[2])
+		if err != nil {
+			spErr("Problem converting the break length " + args[2])
+			return
+		}
+	}
+	if err := spSendBreak(c, args[1], time.Duration(ms)*time.Millisecond); err != nil {
+		spErr(err.Error())
+	}
+}
+
+func jsonCmdSetDtr(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdModemLineArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, spSetModemLine(c, a.Port, "dtr", a.On)
+}
+
+func jsonCmdSetRts(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdModemLineArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, spSetModemLine(c, a.Port, "rts", a.On)
+}
+
+func jsonCmdSendBreak(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdSendBreakArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, spSendBreak(c, a.Port, time.Duration(a.Ms)*time.Millisecond)
+}
@@ -0,0 +1,454 @@
+// Network ports. A port named tcp://host:port is a raw tcp connection to a
+// serial bridge like ser2net or ESP-Link, which passes bytes straight through
+// and sets the baud on its own end. A port named rfc2217://host:port talks
+// telnet with the COM-PORT-OPTION of RFC 2217 to the bridge, so the baud,
+// line settings and modem lines are set from SPJS like a local port.
+//
+// Either one is a serport like any other once it's open, so the buffer
+// algorithms, Queued and Complete events and feed rate override work over
+// it unchanged.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnlauer/goserial"
+)
+
+const (
+	netPrefixTcp     = "tcp://"
+	netPrefixRfc2217 = "rfc2217://"
+
+	deviceClassNetwork = "network"
+)
+
+var netDialTimeout = 5 * time.Second
+
+// how long we wait for the bridge to say it changed the baud
+var rfc2217AckTimeout = 2 * time.Second
+
+// telnet
+const (
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250
+	telnetSE   = 240
+
+	telnetBinary  = 0
+	telnetSGA     = 3
+	telnetComPort = 44
+)
+
+// COM-PORT-OPTION commands. the bridge answers with the same one plus 100.
+const (
+	rfc2217Signature        = 0
+	rfc2217SetBaud          = 1
+	rfc2217SetDataSize      = 2
+	rfc2217SetParity        = 3
+	rfc2217SetStopSize      = 4
+	rfc2217SetControl       = 5
+	rfc2217NotifyLineState  = 6
+	rfc2217NotifyModemState = 7
+	rfc2217SetLineMask      = 10
+	rfc2217SetModemMask     = 11
+	rfc2217PurgeData        = 12
+	rfc2217ServerOffset     = 100
+)
+
+// SET-CONTROL values
+const (
+	rfc2217FlowQuery   = 0
+	rfc2217FlowNone    = 1
+	rfc2217FlowXonXoff = 2
+	rfc2217FlowRtsCts  = 3
+	rfc2217BreakQuery  = 4
+	rfc2217BreakOn     = 5
+	rfc2217BreakOff    = 6
+	rfc2217DtrQuery    = 7
+	rfc2217DtrOn       = 8
+	rfc2217DtrOff      = 9
+	rfc2217RtsQuery    = 10
+	rfc2217RtsOn       = 11
+	rfc2217RtsOff      = 12
+)
+
+// how SET-PARITY and SET-STOPSIZE number things
+var (
+	rfc2217Parities  = map[string]byte{parityNone: 1, parityOdd: 2, parityEven: 3, parityMark: 4, paritySpace: 5}
+	rfc2217StopSizes = map[float64]byte{1: 1, 2: 2, 1.5: 3}
+)
+
+func isNetPort(portname string) bool {
+	name := strings.ToLower(portname)
+	return strings.HasPrefix(name, netPrefixTcp) || strings.HasPrefix(name, netPrefixRfc2217)
+}
+
+func openNetPort(conf *serial.Config, ls LineSettings) (io.ReadWriteCloser, error) {
+	name := strings.ToLower(conf.Name)
+	isRfc2217 := strings.HasPrefix(name, netPrefixRfc2217)
+	addr := conf.Name[len(netPrefixTcp):]
+	if isRfc2217 {
+		addr = conf.Name[len(netPrefixRfc2217):]
+	}
+	addr = strings.TrimSuffix(addr, "/")
+
+	dialer := net.Dialer{Timeout: netDialTimeout, KeepAlive: 30 * time.Second}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !isRfc2217 {
+		return &tcpPort{Conn: conn}, nil
+	}
+
+	p := &rfc2217Port{conn: conn, dtr: conf.DtrOn, rts: conf.RtsOn, acks: make(chan []byte, 16)}
+	p.telnet = telnetStream{onNegotiate: p.onNegotiate, onSubnegotiation: p.onSubnegotiation}
+	if err := p.start(conf.Baud, ls); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// tcpPort is a raw tcp connection to a bridge
+type tcpPort struct {
+	net.Conn
+}
+
+func (p *tcpPort) Reconfigure(baud int, ls LineSettings) error {
+	return errors.New("The baud of a tcp:// port is set on the bridge. Open it as rfc2217:// to change it from here.")
+}
+
+// rfc2217Port is a telnet connection to a bridge that does RFC 2217
+type rfc2217Port struct {
+	conn net.Conn
+
+	// writes of data and of commands mustn't get mixed up
+	writeLock sync.Mutex
+
+	// what Read has gotten partway through
+	telnet telnetStream
+	rbuf   []byte
+
+	lock       sync.Mutex
+	dtr, rts   bool
+	modemState byte
+	isRefused  bool // the bridge said it doesn't do COM-PORT-OPTION
+
+	// answers to our COM-PORT-OPTION commands, for the ones that wait
+	acks chan []byte
+}
+
+// where Read is in the telnet stream
+const (
+	telnetData = iota
+	telnetGotIAC
+	telnetGotVerb
+	telnetInSB
+	telnetInSBGotIAC
+)
+
+// telnetStream pulls the data out of a telnet stream and hands the
+// negotiations and subnegotiations to its callbacks. It remembers where it
+// was so a command can be split across reads.
+type telnetStream struct {
+	state            int
+	verb             byte
+	sbData           []byte
+	onNegotiate      func(verb byte, option byte)
+	onSubnegotiation func(sb []byte)
+}
+
+// decode puts the data from in into out, which must be at least as long,
+// and gives back how much it put there
+func (t *telnetStream) decode(in []byte, out []byte) int {
+	n := 0
+	for _, c := range in {
+		switch t.state {
+		case telnetData:
+			if c == telnetIAC {
+				t.state = telnetGotIAC
+			} else {
+				out[n] = c
+				n++
+			}
+		case telnetGotIAC:
+			switch c {
+			case telnetIAC:
+				// an escaped 255 in the data
+				out[n] = c
+				n++
+				t.state = telnetData
+			case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+				t.verb = c
+				t.state = telnetGotVerb
+			case telnetSB:
+				t.sbData = t.sbData[:0]
+				t.state = telnetInSB
+			default:
+				t.state = telnetData
+			}
+		case telnetGotVerb:
+			t.onNegotiate(t.verb, c)
+			t.state = telnetData
+		case telnetInSB:
+			if c == telnetIAC {
+				t.state = telnetInSBGotIAC
+			} else {
+				t.sbData = append(t.sbData, c)
+			}
+		case telnetInSBGotIAC:
+			if c == telnetSE {
+				t.onSubnegotiation(t.sbData)
+				t.state = telnetData
+			} else {
+				t.sbData = append(t.sbData, c)
+				t.state = telnetInSB
+			}
+		}
+	}
+	return n
+}
+
+// start asks for binary mode and COM-PORT-OPTION and sets up the line
+func (p *rfc2217Port) start(baud int, ls LineSettings) error {
+	negotiate := []byte{
+		telnetIAC, telnetWILL, telnetComPort,
+		telnetIAC, telnetWILL, telnetBinary, telnetIAC, telnetDO, telnetBinary,
+		telnetIAC, telnetWILL, telnetSGA, telnetIAC, telnetDO, telnetSGA,
+	}
+	if err := p.writeRaw(negotiate); err != nil {
+		return err
+	}
+	if err := p.sendLine(baud, ls); err != nil {
+		return err
+	}
+	p.sendCommand(rfc2217SetModemMask, 0xff)
+	if err := p.SetDTR(p.dtr); err != nil {
+		return err
+	}
+	return p.SetRTS(p.rts)
+}
+
+// sendLine sends the baud, if there is one, and the line settings
+func (p *rfc2217Port) sendLine(baud int, ls LineSettings) error {
+	ls = ls.withDefaults(LineSettings{})
+	if baud > 0 {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(baud))
+		if err := p.sendCommand(rfc2217SetBaud, b...); err != nil {
+			return err
+		}
+	}
+
+	for _, cmd := range [][]byte{{rfc2217SetDataSize, byte(ls.DataBits)}, {rfc2217SetParity, rfc2217Parities[ls.Parity]},
+		{rfc2217SetStopSize, rfc2217StopSizes[ls.StopBits]}, {rfc2217SetControl, rfc2217Flow(ls.FlowControl)}} {
+		if err := p.sendCommand(cmd[0], cmd[1:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rfc2217Flow(flow string) byte {
+	switch flow {
+	case flowXonXoff:
+		return rfc2217FlowXonXoff
+	case flowRtsCts:
+		return rfc2217FlowRtsCts
+	}
+	return rfc2217FlowNone
+}
+
+// sendCommand sends a COM-PORT-OPTION subnegotiation, escaping any IAC in
+// its value
+func (p *rfc2217Port) sendCommand(cmd byte, val ...byte) error {
+	b := []byte{telnetIAC, telnetSB, telnetComPort, cmd}
+	b = append(b, telnetEscape(val)...)
+	b = append(b, telnetIAC, telnetSE)
+	return p.writeRaw(b)
+}
+
+func (p *rfc2217Port) writeRaw(b []byte) error {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	_, err := p.conn.Write(b)
+	return err
+}
+
+func telnetEscape(b []byte) []byte {
+	return bytes.Replace(b, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC}, -1)
+}
+
+func (p *rfc2217Port) Write(b []byte) (int, error) {
+	if err := p.writeRaw(telnetEscape(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read hands back the data and deals with the telnet commands mixed in with
+// it. It keeps reading until it has some data since the reader takes a read
+// of nothing to mean the port went away.
+func (p *rfc2217Port) Read(b []byte) (int, error) {
+	if len(p.rbuf) < len(b) {
+		p.rbuf = make([]byte, len(b))
+	}
+	buf := p.rbuf[:len(b)]
+	for {
+		n, err := p.conn.Read(buf)
+		out := p.telnet.decode(buf[:n], b)
+		if out > 0 || err != nil {
+			return out, err
+		}
+	}
+}
+
+// onNegotiate answers the bridge. We'll do binary, suppress go ahead and
+// COM-PORT-OPTION and nothing else.
+func (p *rfc2217Port) onNegotiate(verb byte, option byte) {
+	isOurs := option == telnetBinary || option == telnetSGA || option == telnetComPort
+	switch verb {
+	case telnetDO:
+		if !isOurs {
+			go p.writeRaw([]byte{telnetIAC, telnetWONT, option})
+		}
+	case telnetWILL:
+		if !isOurs {
+			go p.writeRaw([]byte{telnetIAC, telnetDONT, option})
+		}
+	case telnetDONT, telnetWONT:
+		if option == telnetComPort {
+			log.Println("The bridge does not do RFC 2217 COM-PORT-OPTION so the baud and modem lines can't be set from here")
+			p.lock.Lock()
+			p.isRefused = true
+			p.lock.Unlock()
+		}
+	}
+}
+
+func (p *rfc2217Port) onSubnegotiation(sb []byte) {
+	if len(sb) < 2 || sb[0] != telnetComPort {
+		return
+	}
+	cmd := sb[1]
+	if cmd == rfc2217NotifyModemState+rfc2217ServerOffset && len(sb) > 2 {
+		p.lock.Lock()
+		p.modemState = sb[2]
+		p.lock.Unlock()
+		return
+	}
+	// hand it to whoever is waiting, if anybody is
+	select {
+	case p.acks <- append([]byte{}, sb[1:]...):
+	default:
+	}
+}
+
+func (p *rfc2217Port) Close() error {
+	return p.conn.Close()
+}
+
+func (p *rfc2217Port) refused() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.isRefused {
+		return errors.New("The bridge does not do RFC 2217 so this can't be changed from here")
+	}
+	return nil
+}
+
+// Reconfigure changes the baud and line settings on the bridge. It waits
+// for the bridge to say which baud it set, since one that can't do the baud
+// we asked for answers with the one it's using.
+func (p *rfc2217Port) Reconfigure(baud int, ls LineSettings) error {
+	if err := p.refused(); err != nil {
+		return err
+	}
+	// forget answers nobody waited for
+	for len(p.acks) > 0 {
+		<-p.acks
+	}
+	if err := p.sendLine(baud, ls); err != nil {
+		return err
+	}
+	timeout := time.After(rfc2217AckTimeout)
+	for {
+		select {
+		case ack := <-p.acks:
+			if ack[0] != rfc2217SetBaud+rfc2217ServerOffset || len(ack) < 5 {
+				continue
+			}
+			if got := int(binary.BigEndian.Uint32(ack[1:5])); got != baud {
+				return errors.New("The bridge set the baud to " + strconv.Itoa(got) + " rather than " + strconv.Itoa(baud))
+			}
+			return nil
+		case <-timeout:
+			return errors.New("The bridge did not answer when we asked it to change the baud")
+		}
+	}
+}
+
+func (p *rfc2217Port) SetDTR(on bool) error {
+	if err := p.refused(); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.dtr = on
+	p.lock.Unlock()
+	val := byte(rfc2217DtrOff)
+	if on {
+		val = rfc2217DtrOn
+	}
+	return p.sendCommand(rfc2217SetControl, val)
+}
+
+func (p *rfc2217Port) SetRTS(on bool) error {
+	if err := p.refused(); err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.rts = on
+	p.lock.Unlock()
+	val := byte(rfc2217RtsOff)
+	if on {
+		val = rfc2217RtsOn
+	}
+	return p.sendCommand(rfc2217SetControl, val)
+}
+
+func (p *rfc2217Port) SendBreak(d time.Duration) error {
+	if err := p.refused(); err != nil {
+		return err
+	}
+	if err := p.sendCommand(rfc2217SetControl, rfc2217BreakOn); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return p.sendCommand(rfc2217SetControl, rfc2217BreakOff)
+}
+
+// ModemLines gives back what the bridge last told us. The bridge only tells
+// us when something changes.
+func (p *rfc2217Port) ModemLines() (ModemLines, error) {
+	if err := p.refused(); err != nil {
+		return ModemLines{}, err
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return ModemLines{Dtr: p.dtr, Rts: p.rts, Cts: p.modemState&0x10 != 0, Dsr: p.modemState&0x20 != 0,
+		Ri: p.modemState&0x40 != 0, Dcd: p.modemState&0x80 != 0}, nil
+}
@@ -0,0 +1,115 @@
+// Port aliases. /dev/ttyUSB0 and /dev/ttyUSB1 swap around on a reboot, so a
+// port rule in the config file can give the device it matches an Alias,
+// i.e. mill, and clients use that instead. Bind it to something that stays
+// put, like the SerialNumber, the UsbVid/UsbPid, or the UsbPath of the hub
+// port it's plugged into.
+//   {"Ports":[
+//     {"Alias":"mill", "SerialNumber":"A9007XyZ", "Baud":115200, "BufferAlgorithm":"grbl"},
+//     {"Alias":"laser", "UsbVid":"1a86", "UsbPid":"7523", "Baud":115200},
+//     {"Alias":"lathe", "UsbPath":"1-1.3", "Baud":9600}
+//   ]}
+//
+// An alias works anywhere a port name does. Events still carry the real
+// name and the port list has the alias next to it.
+
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// what the OS calls serial ports, i.e. COM3, ttyUSB0 or cu.usbserial. an
+// alias that looks like one would hide the real port.
+var reOsPortName = regexp.MustCompile(`(?i)^(com\d+|tty.*|cu\..*)$`)
+
+// checkPortAlias makes sure an alias can be told apart from the ones in
+// the rules before it and doesn't look like a real port
+func checkPortAlias(before []PortRule, r PortRule) error {
+	if len(r.Alias) == 0 {
+		return nil
+	}
+	if strings.ContainsAny(r.Alias, " \t/\\:") {
+		return errors.New("An alias can't have spaces, slashes or colons in it")
+	}
+	if reOsPortName.MatchString(r.Alias) {
+		return errors.New("An alias can't look like a port name, i.e. COM3, ttyUSB0 or cu.usbserial")
+	}
+	for _, other := range before {
+		if strings.EqualFold(other.Alias, r.Alias) {
+			return errors.New("Another rule already has the alias " + r.Alias)
+		}
+	}
+	return nil
+}
+
+// checkAliasesAgainstPorts makes sure no alias is the name of a port we can
+// see right now, i.e. a virtual port or a COM port, since the alias would
+// win when that name is opened
+func checkAliasesAgainstPorts(rules []PortRule) error {
+	hasAlias := false
+	for _, r := range rules {
+		hasAlias = hasAlias || len(r.Alias) > 0
+	}
+	if !hasAlias {
+		return nil
+	}
+	for _, item := range spListData().SerialPorts {
+		for i, r := range rules {
+			if len(r.Alias) > 0 && strings.EqualFold(r.Alias, item.Name) {
+				return errors.New("Port rule " + strconv.Itoa(i+1) + " in the config file has the alias " + r.Alias + " which is already the name of a port")
+			}
+		}
+	}
+	return nil
+}
+
+func hasPortAliases() bool {
+	for _, r := range configPortRules() {
+		if len(r.Alias) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func findAliasRule(alias string) *PortRule {
+	rules := configPortRules()
+	for i := range rules {
+		if len(rules[i].Alias) > 0 && strings.EqualFold(rules[i].Alias, alias) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// portAlias gives back the alias of a device, or "" if it doesn't have one
+func portAlias(item SpPortItem) string {
+	for _, r := range configPortRules() {
+		if len(r.Alias) > 0 && r.matches(item) {
+			return r.Alias
+		}
+	}
+	return ""
+}
+
+// resolvePortAlias gives back the device an alias is bound to and the
+// alias. A real port name comes back as is along with its alias, if it has
+// one.
+func resolvePortAlias(portname string) (string, string, error) {
+	if !hasPortAliases() {
+		return portname, "", nil
+	}
+	rule := findAliasRule(portname)
+	if rule == nil {
+		return portname, portAlias(findPortItem(portname)), nil
+	}
+	for _, item := range spListData().SerialPorts {
+		if rule.matches(item) {
+			return item.Name, rule.Alias, nil
+		}
+	}
+	return portname, rule.Alias, errors.New("The device for " + rule.Alias + " is not plugged in")
+}
@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -40,6 +41,7 @@ func spProgramFromUrl(portname string, boardname string, url string) {
 }
 
 func spProgram(portname string, boardname string, filePath string) {
+	atomic.AddInt64(&metricProgrammerRuns, 1)
 
 	isFound, flasher, mycmd := assembleCompilerCommand(boardname, portname, filePath)
 	mapD := map[string]string{"ProgrammerStatus": "CommandReady", "IsFound": strconv.FormatBool(isFound), "Flasher": flasher, "Cmd": strings.Join(mycmd, " ")}
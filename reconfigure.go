@@ -0,0 +1,122 @@
+// Changing the baud or line settings of a port used to mean a close and an
+// open, which tore down the bufferflow, threw away everything queued and
+// made every UI reset on the Close and Open events. reconfigure, or setbaud,
+// changes them on the open port instead. The queue and the bufferflow are
+// left alone and everybody gets a Reconfigured event.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// lineConfigurer is implemented by port io that changes its own baud and
+// line settings rather than leave it to the OS
+type lineConfigurer interface {
+	Reconfigure(baud int, ls LineSettings) error
+}
+
+type ReconfiguredMsg struct {
+	Cmd  string // Reconfigured
+	Port string
+	Baud int
+	LineSettings
+	OldBaud int
+	OldLine string // i.e. 8N1
+}
+
+type jsonCmdReconfigureArgs struct {
+	Port string
+	Baud int // leave out to keep the baud
+	LineSettings
+}
+
+// reconfigure changes the line. Whatever is left out of baud and ls stays
+// the way it is.
+func (p *serport) reconfigure(baud int, ls LineSettings) error {
+	if err := ls.check(); err != nil {
+		return err
+	}
+	if baud <= 0 {
+		baud = p.portConf.Baud
+	}
+	ls = ls.withDefaults(p.line)
+
+	var err error
+	if lc, ok := p.io().(lineConfigurer); ok {
+		err = lc.Reconfigure(baud, ls)
+	} else {
+		err = osReconfigure(p.io(), baud, ls)
+	}
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.portConf.Baud = baud
+	p.lock.Unlock()
+	p.line = ls
+	return nil
+}
+
+func spReconfigure(c *connection, portname string, baud int, ls LineSettings) (ReconfiguredMsg, error) {
+	var msg ReconfiguredMsg
+	myport, isFound := findPortByName(portname)
+	if !isFound {
+		return msg, errors.New("We could not find the serial port " + portname + " that you were trying to reconfigure.")
+	}
+	if err := checkLease(c, myport); err != nil {
+		return msg, err
+	}
+
+	oldBaud, oldLine := myport.portConf.Baud, myport.line
+	if err := myport.reconfigure(baud, ls); err != nil {
+		return msg, errors.New("Could not reconfigure port " + portname + ". " + err.Error())
+	}
+	log.Printf("Reconfigured port %v from %v baud %v to %v baud %v\n", portname, oldBaud, oldLine.shortForm(), myport.portConf.Baud, myport.line.shortForm())
+
+	msg = ReconfiguredMsg{Cmd: "Reconfigured", Port: myport.name(), Baud: myport.portConf.Baud,
+		LineSettings: myport.line, OldBaud: oldBaud, OldLine: oldLine.shortForm()}
+	b, _ := json.Marshal(msg)
+	h.broadcastSys <- b
+	return msg, nil
+}
+
+// textReconfigure handles reconfigure and setbaud, i.e.
+//   setbaud COM4 115200
+//   reconfigure /dev/ttyUSB0 9600 7E1 rtscts
+func textReconfigure(c *connection, s string) {
+	args := strings.Fields(s)
+	if len(args) < 3 {
+		spErr("You need to give a port and a baud and/or line settings, i.e. reconfigure COM4 115200 8N1")
+		return
+	}
+	baud := 0
+	lineArgs := args[2:]
+	if b, err := strconv.Atoi(args[2]); err == nil {
+		baud = b
+		lineArgs = args[3:]
+	}
+	ls, other, err := parseLineArgs(lineArgs)
+	if err == nil && len(other) > 0 {
+		err = errors.New("Did not understand " + other + ". The buffer algorithm can't be changed without closing the port.")
+	}
+	if err != nil {
+		spErr(err.Error())
+		return
+	}
+	if _, err := spReconfigure(c, args[1], baud, ls); err != nil {
+		spErr(err.Error())
+	}
+}
+
+func jsonCmdReconfigure(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdReconfigureArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return spReconfigure(c, a.Port, a.Baud, a.LineSettings)
+}
@@ -0,0 +1,227 @@
+// Auto reconnect. A loose USB cable used to kill the session. The reader saw
+// the port go away, the port was closed, and somebody had to open it again
+// and start over. A port opened with AutoReconnect instead stays open while
+// we wait for the same device to come back, going by its serial number or
+// vid/pid since it may well come back under a different name, i.e.
+// /dev/ttyUSB1 instead of /dev/ttyUSB0. Once it's back we reopen it with the
+// same baud, line settings and bufferflow.
+//
+// The queue is held from the moment the device goes away. It stays held after
+// we reconnect since the machine may have been reset and nobody should get
+// the rest of a job sent to it by surprise. Use resumequeue to carry on or
+// wipequeue to throw it away.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// how often we look for the device to come back
+var reconnectPoll = 2 * time.Second
+
+type ReconnectMsg struct {
+	Cmd          string // Reconnecting or Reconnected
+	Port         string
+	OldPort      string `json:",omitempty"` // if the device came back under a new name
+	SerialNumber string
+	UsbVid       string
+	UsbPid       string
+	QCnt         int
+	IsHeld       bool
+	Desc         string
+}
+
+func (p *serport) isHeld() bool {
+	return atomic.LoadInt32(&p.held) == 1
+}
+
+func (p *serport) setHeld(isHeld bool) {
+	if isHeld {
+		atomic.StoreInt32(&p.held, 1)
+	} else {
+		atomic.StoreInt32(&p.held, 0)
+	}
+}
+
+// waitWhileHeld blocks the writer while the queue is held. It gives back
+// false if the queue was wiped since the writer took its command off it.
+func (p *serport) waitWhileHeld(wipes int64) bool {
+	for p.isHeld() && !p.isClosing {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return atomic.LoadInt64(&p.wipes) == wipes
+}
+
+// rememberDevice looks up the serial number and vid/pid of the device so we
+// can find it again if it goes away
+func (p *serport) rememberDevice() {
+	p.device = findPortItem(p.name())
+	log.Printf("Will reconnect port %v if it goes away. serial number:%v, vid:%v, pid:%v\n", p.name(), p.device.SerialNumber, p.device.UsbVid, p.device.UsbPid)
+}
+
+func (p *serport) isSameDevice(item SpPortItem) bool {
+	if len(p.device.SerialNumber) > 0 {
+		return item.SerialNumber == p.device.SerialNumber
+	}
+	if len(p.device.UsbVid) > 0 || len(p.device.UsbPid) > 0 {
+		return usbId(item.UsbVid) == usbId(p.device.UsbVid) && usbId(item.UsbPid) == usbId(p.device.UsbPid)
+	}
+	return strings.EqualFold(item.Name, p.name())
+}
+
+// findDevice looks for our device in the port list. If there's more than
+// one that fits, i.e. two boards with the same vid/pid and no serial number,
+// the one with our old name wins.
+func (p *serport) findDevice() (string, bool) {
+	name := ""
+	for _, item := range spListData().SerialPorts {
+		if !p.isSameDevice(item) {
+			continue
+		}
+		// somebody else has it open
+		if other, isFound := findPortByName(item.Name); isFound && other != p {
+			continue
+		}
+		if strings.EqualFold(item.Name, p.name()) {
+			return item.Name, true
+		}
+		if len(name) == 0 {
+			name = item.Name
+		}
+	}
+	return name, len(name) > 0
+}
+
+func (p *serport) reconnectMsg(cmd string, oldName string, desc string) []byte {
+	m := ReconnectMsg{Cmd: cmd, Port: p.name(), SerialNumber: p.device.SerialNumber,
+		UsbVid: p.device.UsbVid, UsbPid: p.device.UsbPid, QCnt: p.itemsInBuffer, IsHeld: p.isHeld(), Desc: desc}
+	if oldName != p.name() {
+		m.OldPort = oldName
+	}
+	b, _ := json.Marshal(m)
+	return b
+}
+
+// reconnect holds the queue and waits for the device to come back. It gives
+// back false if the port was closed while we waited.
+func (p *serport) reconnect() bool {
+	p.isReconnecting = true
+	defer func() { p.isReconnecting = false }()
+	p.setHeld(true)
+	oldName := p.name()
+	log.Printf("Lost port %v. Waiting for it to come back.\n", oldName)
+	h.broadcastSys <- p.reconnectMsg("Reconnecting", oldName, "Lost the port. Waiting for the device to come back. The queue is held.")
+
+	for !p.isClosing {
+		time.Sleep(reconnectPoll)
+		name, isFound := p.findDevice()
+		if !isFound || p.isClosing {
+			continue
+		}
+
+		p.lock.RLock()
+		conf := *p.portConf
+		p.lock.RUnlock()
+		conf.Name = name
+		sp, err := openPortIo(&conf, p.line)
+		if err != nil {
+			log.Printf("Found port %v again but could not open it. err:%v\n", name, err)
+			continue
+		}
+		if p.isClosing {
+			sp.Close()
+			break
+		}
+		p.lock.Lock()
+		p.portConf.Name = name
+		p.portIo = sp
+		p.lock.Unlock()
+		p.bufferwatcher.SetPort(name)
+		p.stats = portStatsFor(name)
+		atomic.AddInt64(&p.stats.opens, 1)
+		log.Printf("Reconnected port %v as %v\n", oldName, name)
+		h.broadcastSys <- p.reconnectMsg("Reconnected", oldName, "Reconnected the port. The queue is still held. Send resumequeue to carry on or wipequeue to throw it away.")
+		go p.watchModemLines()
+		return true
+	}
+	return false
+}
+
+// spResumeQueue lets a held queue carry on
+func spResumeQueue(c *connection, portname string) error {
+	myport, isFound := findPortByName(portname)
+	if !isFound {
+		return errors.New("We could not find the serial port " + portname + " to resume the queue of.")
+	}
+	if err := checkLease(c, myport); err != nil {
+		return err
+	}
+	if myport.isReconnecting {
+		return errors.New("Port " + portname + " is still waiting to reconnect")
+	}
+	myport.setHeld(false)
+	log.Printf("Resumed the queue of port %v\n", portname)
+	b, _ := json.Marshal(SpQueueStatus{Cmd: "QueueResumed", Port: myport.name(), QCnt: myport.itemsInBuffer, BufferType: myport.BufferType})
+	h.broadcastSys <- b
+	return nil
+}
+
+// spWipeQueue throws away everything queued for a port
+func spWipeQueue(c *connection, portname string) error {
+	myport, isFound := findPortByName(portname)
+	if !isFound {
+		return errors.New("We could not find the serial port " + portname + " to wipe the queue of.")
+	}
+	if err := checkLease(c, myport); err != nil {
+		return err
+	}
+	wipeQueue(myport)
+	if !myport.isReconnecting {
+		myport.setHeld(false)
+	}
+	return nil
+}
+
+func textResumeQueue(c *connection, s string) {
+	args := strings.Fields(s)
+	if len(args) < 2 {
+		spErr("You did not specify a port to resume the queue of")
+		return
+	}
+	if err := spResumeQueue(c, args[1]); err != nil {
+		spErr(err.Error())
+	}
+}
+
+func textWipeQueue(c *connection, s string) {
+	args := strings.Fields(s)
+	if len(args) < 2 {
+		spErr("You did not specify a port to wipe the queue of")
+		return
+	}
+	if err := spWipeQueue(c, args[1]); err != nil {
+		spErr(err.Error())
+	}
+}
+
+func jsonCmdResumeQueue(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdPortArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, spResumeQueue(c, a.Port)
+}
+
+func jsonCmdWipeQueue(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdPortArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, spWipeQueue(c, a.Port)
+}
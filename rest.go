@@ -0,0 +1,296 @@
+// The REST api is a plain http way into the same commands the websocket
+// takes, for scripts and CI rigs that just want to list ports or push a
+// line without speaking websocket and picking through broadcasts. Every
+// route runs the matching json command handler and hands back its result
+// synchronously. The broadcasts (Open, Queued, Complete, etc) still go out
+// to the websocket clients as usual.
+//
+// Port names go in the path. Since names like /dev/ttyACM0 have slashes you
+// can either url encode them (%2Fdev%2FttyACM0) or just use the friendly
+// name from the port list (ttyACM0).
+//
+// The routes are described by an OpenAPI document at /api/v1/openapi.json
+// that is built from the same table the router uses, so it can't drift.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+const restPrefix = "/api/v1"
+
+type restRoute struct {
+	Method string
+	Path   string // relative to restPrefix, {port} is replaced with the port name
+	Cmd    string // the json command that does the work
+	Desc   string
+
+	// the args the json command takes from the request body. nil if
+	// the route takes no body.
+	Body interface{}
+
+	// which arg the {port} in the path gets put into
+	PortArg string
+
+	// status to send back when the command itself fails
+	FailStatus int
+}
+
+var restRoutes = []restRoute{
+	{Method: "GET", Path: "/ports", Cmd: "list", Desc: "List the serial ports along with their open state, baud and buffer algorithm", FailStatus: 500},
+	{Method: "POST", Path: "/ports/{port}/open", Cmd: "open", Desc: "Open a serial port", Body: jsonCmdOpenArgs{}, PortArg: "Port", FailStatus: 500},
+	{Method: "POST", Path: "/ports/{port}/close", Cmd: "close", Desc: "Close a serial port", PortArg: "Port", FailStatus: 500},
+	{Method: "POST", Path: "/ports/{port}/send", Cmd: "send", Desc: "Queue data onto a port through its buffer algorithm", Body: jsonCmdSendArgs{}, PortArg: "Port", FailStatus: 400},
+	{Method: "POST", Path: "/ports/{port}/sendnobuf", Cmd: "sendnobuf", Desc: "Send data to a port skipping its buffer algorithm", Body: jsonCmdSendArgs{}, PortArg: "Port", FailStatus: 400},
+	{Method: "POST", Path: "/ports/{port}/sendjson", Cmd: "sendjson", Desc: "Queue a list of commands with ids onto a port", Body: writeRequestJson{}, PortArg: "P", FailStatus: 400},
+	{Method: "GET", Path: "/ports/{port}/queue", Cmd: "queue", Desc: "Get the state of the queue of a port", PortArg: "Port", FailStatus: 400},
+	{Method: "POST", Path: "/ports/{port}/fro", Cmd: "fro", Desc: "Set the feed rate override of a port, or leave out FeedRateOverride to just get it", Body: jsonCmdFroArgs{}, PortArg: "Port", FailStatus: 400},
+	{Method: "POST", Path: "/program", Cmd: "program", Desc: "Program a board from a file on the SPJS host", Body: jsonCmdProgramArgs{}, FailStatus: 500},
+	{Method: "POST", Path: "/programfromurl", Cmd: "programfromurl", Desc: "Download a file and program a board with it", Body: jsonCmdProgramArgs{}, FailStatus: 500},
+	{Method: "POST", Path: "/programkill", Cmd: "programkill", Desc: "Kill the running programmer", FailStatus: 500},
+	{Method: "GET", Path: "/usb", Cmd: "usblist", Desc: "List the USB devices on the host", FailStatus: 500},
+	{Method: "GET", Path: "/clients", Cmd: "clients", Desc: "List the connected websocket clients and the ports they have claimed", FailStatus: 500},
+	{Method: "GET", Path: "/bufferalgorithms", Cmd: "bufferalgorithms", Desc: "List the available buffer algorithms", FailStatus: 500},
+	{Method: "GET", Path: "/baudrates", Cmd: "baudrates", Desc: "List common baud rates", FailStatus: 500},
+	{Method: "GET", Path: "/version", Cmd: "version", Desc: "Get the SPJS version", FailStatus: 500},
+	{Method: "GET", Path: "/hostname", Cmd: "hostname", Desc: "Get the SPJS hostname", FailStatus: 500},
+	{Method: "GET", Path: "/execruntime", Cmd: "execruntime", Desc: "Get the OS and architecture of the SPJS host", FailStatus: 500},
+	{Method: "POST", Path: "/exec", Cmd: "exec", Desc: "Run a command on the SPJS host", Body: jsonCmdExecArgs{}, FailStatus: 500},
+	{Method: "GET", Path: "/memstats", Cmd: "memstats", Desc: "Get Go memory statistics", FailStatus: 500},
+}
+
+type restErr struct {
+	Error string
+}
+
+func restHandler(w http.ResponseWriter, r *http.Request) {
+	user, role, ok := authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"spjs\"")
+		restReply(w, 401, restErr{"Not authorized"})
+		return
+	}
+
+	// split the escaped path so a %2F inside a port name stays put
+	path := strings.TrimPrefix(r.URL.EscapedPath(), restPrefix)
+	if path == "/openapi.json" {
+		restReply(w, 200, restOpenApi())
+		return
+	}
+	if isShuttingDown() {
+		restReply(w, 503, restErr{errShuttingDown.Error()})
+		return
+	}
+	route, portname, isFound := matchRestRoute(r.Method, path)
+	if !isFound {
+		restReply(w, 404, restErr{"No such route " + r.Method + " " + restPrefix + path})
+		return
+	}
+	if !mayRun(role, route.Cmd) {
+		restReply(w, 403, restErr{"Your role " + role + " is not allowed to run the " + route.Cmd + " command"})
+		return
+	}
+
+	// build up the args the json command expects
+	args := map[string]interface{}{}
+	if route.Body != nil {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			restReply(w, 400, restErr{"Problem reading body. " + err.Error()})
+			return
+		}
+		if len(strings.TrimSpace(string(b))) > 0 {
+			if err := json.Unmarshal(b, &args); err != nil {
+				restReply(w, 400, restErr{"Problem decoding body. " + err.Error()})
+				return
+			}
+		}
+	}
+	if len(route.PortArg) > 0 {
+		args[route.PortArg] = restPortName(portname)
+		if route.Cmd != "open" {
+			if _, isOpen := findPortByName(args[route.PortArg].(string)); !isOpen {
+				restReply(w, 404, restErr{"Port " + portname + " is not open"})
+				return
+			}
+		}
+	}
+	argsJson, _ := json.Marshal(args)
+
+	// a stand-in connection so leases and roles treat this like
+	// any other client. it is never registered with the hub.
+	c := &connection{user: user, role: role, addr: r.RemoteAddr}
+
+	log.Printf("Got REST call %v %v. cmd:%v, args:%v\n", r.Method, r.URL.Path, route.Cmd, string(argsJson))
+	result, err := spjsCmdsByName[route.Cmd].Json(c, argsJson)
+	if err != nil {
+		status := route.FailStatus
+		if _, isLeaseErr := err.(leaseErr); isLeaseErr {
+			status = 409
+		}
+		restReply(w, status, restErr{err.Error()})
+		return
+	}
+	if result == nil {
+		w.WriteHeader(204)
+		return
+	}
+	restReply(w, 200, result)
+}
+
+func restReply(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		status = 500
+		b, _ = json.Marshal(restErr{"Problem creating json. " + err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// matchRestRoute finds the route for an escaped path and pulls out the
+// port name if the route has one
+func matchRestRoute(method string, path string) (restRoute, string, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for _, route := range restRoutes {
+		if route.Method != method {
+			continue
+		}
+		rparts := strings.Split(strings.Trim(route.Path, "/"), "/")
+		if len(rparts) != len(parts) {
+			continue
+		}
+		portname := ""
+		isMatch := true
+		for i := range rparts {
+			if rparts[i] == "{port}" {
+				name, err := url.PathUnescape(parts[i])
+				if err != nil || len(name) == 0 {
+					isMatch = false
+					break
+				}
+				portname = name
+			} else if rparts[i] != parts[i] {
+				isMatch = false
+				break
+			}
+		}
+		if isMatch {
+			return route, portname, true
+		}
+	}
+	return restRoute{}, "", false
+}
+
+// restPortName turns a friendly name like ttyACM0 into the real device
+// name. Anything we don't recognize is passed through as is.
+func restPortName(name string) string {
+	if myport, isFound := findPortByName(name); isFound {
+		return myport.name()
+	}
+	list, _ := GetList()
+	for _, item := range list {
+		if strings.EqualFold(item.Name, name) || strings.EqualFold(item.FriendlyName, name) {
+			return item.Name
+		}
+	}
+	return name
+}
+
+func restOpenApi() map[string]interface{} {
+	paths := map[string]interface{}{}
+	for _, route := range restRoutes {
+		op := map[string]interface{}{
+			"summary":     route.Desc,
+			"operationId": route.Cmd,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{"description": "The result of the command"},
+				"204": map[string]interface{}{"description": "The command ran and has nothing to return"},
+				"400": map[string]interface{}{"description": "Bad arguments or the command failed", "content": openApiJson(reflect.TypeOf(restErr{}))},
+				"401": map[string]interface{}{"description": "Not authenticated"},
+				"403": map[string]interface{}{"description": "Your role may not run this command"},
+				"404": map[string]interface{}{"description": "No such route or the port is not open"},
+				"409": map[string]interface{}{"description": "Another client has claimed the port"},
+				"500": map[string]interface{}{"description": "The command failed"},
+				"503": map[string]interface{}{"description": "SPJS is shutting down"},
+			},
+		}
+		if strings.Contains(route.Path, "{port}") {
+			op["parameters"] = []interface{}{map[string]interface{}{
+				"name":        "port",
+				"in":          "path",
+				"required":    true,
+				"description": "Port name, url encoded, or its friendly name",
+				"schema":      map[string]string{"type": "string"},
+			}}
+		}
+		if route.Body != nil {
+			op["requestBody"] = map[string]interface{}{"content": openApiJson(reflect.TypeOf(route.Body))}
+		}
+		p, isFound := paths[route.Path].(map[string]interface{})
+		if !isFound {
+			p = map[string]interface{}{}
+			paths[route.Path] = p
+		}
+		p[strings.ToLower(route.Method)] = op
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Serial Port JSON Server",
+			"version": version,
+		},
+		"servers": []interface{}{map[string]string{"url": restPrefix}},
+		"paths":   paths,
+	}
+}
+
+func openApiJson(t reflect.Type) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": openApiSchema(t)}}
+}
+
+// openApiSchema describes a Go type the way encoding/json will see it
+func openApiSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return openApiSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": openApiSchema(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if len(f.PkgPath) > 0 || f.Tag.Get("json") == "-" {
+				// unexported or hidden from json
+				continue
+			}
+			if f.Anonymous {
+				// embedded structs are flattened by json so flatten them here too
+				for name, prop := range openApiSchema(f.Type)["properties"].(map[string]interface{}) {
+					props[name] = prop
+				}
+				continue
+			}
+			props[f.Name] = openApiSchema(f.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": props}
+	}
+	return map[string]interface{}{}
+}
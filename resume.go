@@ -0,0 +1,213 @@
+// Session resume. Every websocket connection is handed a ResumeToken when it
+// connects. If the browser drops off and comes back to /ws?resume=TOKEN
+// within -resumewindow seconds, it picks up its old subscriptions, gets
+// replayed the port events it missed while it was gone, and then gets a
+// ResumeState snapshot of the open ports so it knows where things stand.
+//
+// To be able to replay, the hub keeps the last -history events of every
+// port in a ring. All of this is only ever touched from inside the hub
+// goroutine so it needs no locking.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type historyEntry struct {
+	seq int64
+	m   []byte
+	t   msgTopic
+}
+
+// historyRing holds the most recent events of one port
+type historyRing struct {
+	entries []historyEntry
+	next    int
+	// seq of the last entry we threw away to make room, 0 if none yet.
+	// seqs are global so the ones in between may be other ports' events.
+	evicted int64
+}
+
+func (r *historyRing) add(e historyEntry) {
+	if len(r.entries) < *historySize {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.evicted = r.entries[r.next].seq
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+}
+
+// since gives back the entries newer than seq, oldest first, and whether
+// we had already thrown away some of what was asked for
+func (r *historyRing) since(seq int64) ([]historyEntry, bool) {
+	ordered := append(append([]historyEntry{}, r.entries[r.next:]...), r.entries[:r.next]...)
+	out := []historyEntry{}
+	for _, e := range ordered {
+		if e.seq > seq {
+			out = append(out, e)
+		}
+	}
+	return out, r.evicted > seq
+}
+
+type session struct {
+	token string
+	user  string
+	subs  *subscription
+
+	// the last event seq that went out before the connection dropped.
+	// -1 while the connection is still up.
+	lastSeq        int64
+	disconnectedAt time.Time
+}
+
+var portHistory = make(map[string]*historyRing)
+var sessions = make(map[string]*session)
+
+type ResumeTokenMsg struct {
+	ResumeToken string
+}
+
+type ResumeStatePort struct {
+	Name           string
+	Baud           int
+	BufferType     string
+	IsPrimary      bool
+	QCnt           int
+	IsManualPaused bool
+}
+
+type ResumeStateMsg struct {
+	Cmd         string
+	Replayed    int
+	IsTruncated bool
+	Ports       []ResumeStatePort
+}
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Println("Problem making a resume token. err:", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// recordHistory keeps a port event around in case somebody needs it
+// replayed later
+func recordHistory(m []byte, t msgTopic, seq int64) {
+	if *historySize <= 0 || len(t.Port) == 0 {
+		return
+	}
+	port := strings.ToLower(t.Port)
+	r, isFound := portHistory[port]
+	if !isFound {
+		r = &historyRing{}
+		portHistory[port] = r
+	}
+	r.add(historyEntry{seq: seq, m: m, t: t})
+}
+
+// startSession is called when a connection registers. It hands out a
+// resume token, and if the connection asked to resume a session we still
+// know about, it replays what was missed.
+func (h *hub) startSession(c *connection) {
+	expireSessions()
+
+	old, isFound := sessions[c.resumeToken]
+	if len(c.resumeToken) > 0 && (!isFound || old.lastSeq < 0 || old.user != c.user) {
+		log.Printf("Client %v asked to resume a session we don't know about\n", c.id)
+		c.send <- outMsg{m: []byte("{\"Error\" : \"Could not resume your session. It may have expired. You are starting a new one.\"} ")}
+		isFound = false
+	}
+
+	if !isFound || len(c.resumeToken) == 0 {
+		s := &session{token: newResumeToken(), user: c.user, subs: &c.subs, lastSeq: -1}
+		sessions[s.token] = s
+		c.resumeToken = s.token
+		// a new session has nothing to catch up on from before now
+		atomic.StoreInt64(&c.lastSeq, eventSeq)
+		b, _ := json.Marshal(ResumeTokenMsg{s.token})
+		c.send <- outMsg{m: b}
+		return
+	}
+
+	log.Printf("Client %v is resuming a session that dropped at %v\n", c.id, old.disconnectedAt)
+	c.subs.copyFrom(old.subs)
+	old.subs = &c.subs
+	lastSeq := old.lastSeq
+	old.lastSeq = -1
+	// if we lose this one too before the replay is out, the next resume
+	// starts from wherever it got to
+	atomic.StoreInt64(&c.lastSeq, lastSeq)
+
+	b, _ := json.Marshal(ResumeTokenMsg{old.token})
+	c.send <- outMsg{m: b}
+
+	// put the missed events from all ports back in order
+	missed := []historyEntry{}
+	isTruncated := false
+	for _, r := range portHistory {
+		entries, t := r.since(lastSeq)
+		missed = append(missed, entries...)
+		isTruncated = isTruncated || t
+	}
+	sortHistory(missed)
+
+	replayed := 0
+	for _, e := range missed {
+		if c.subs.isFiltering() && !c.subs.wants(e.t) {
+			continue
+		}
+		if !h.deliver(c, e.m, e.seq, &e.t) {
+			return
+		}
+		replayed++
+	}
+
+	state := ResumeStateMsg{Cmd: "ResumeState", Replayed: replayed, IsTruncated: isTruncated, Ports: []ResumeStatePort{}}
+	for _, p := range sh.portList() {
+		state.Ports = append(state.Ports, ResumeStatePort{
+			Name:           p.name(),
+			Baud:           p.portConf.Baud,
+			BufferType:     p.BufferType,
+			IsPrimary:      p.IsPrimary,
+			QCnt:           p.itemsInBuffer,
+			IsManualPaused: p.bufferwatcher.GetManualPaused(),
+		})
+	}
+	sb, _ := json.Marshal(state)
+	h.deliver(c, sb, 0, &msgTopic{Class: topicSystem})
+}
+
+// endSession remembers where a dropped connection got to so it can resume.
+// That's the last event its writer got out, not the last one we stamped,
+// since whatever was still in its send channel or backlog never made it.
+func endSession(c *connection) {
+	s, isFound := sessions[c.resumeToken]
+	if !isFound || s.subs != &c.subs {
+		return
+	}
+	s.lastSeq = atomic.LoadInt64(&c.lastSeq)
+	s.disconnectedAt = time.Now()
+}
+
+func expireSessions() {
+	for token, s := range sessions {
+		if s.lastSeq >= 0 && time.Since(s.disconnectedAt) > time.Duration(*resumeWindow)*time.Second {
+			delete(sessions, token)
+		}
+	}
+}
+
+func sortHistory(entries []historyEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+}
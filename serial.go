@@ -5,6 +5,7 @@ package main
 import (
 	//"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	//"path/filepath"
 	//"github.com/kballard/go-shellquote"
@@ -18,6 +19,8 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	//"time"
 )
 
@@ -30,9 +33,10 @@ type writeRequest struct {
 }
 
 type writeRequestJson struct {
-	p    *serport
-	P    string
-	Data []writeRequestJsonData
+	p        *serport
+	P        string
+	Data     []writeRequestJsonData
+	Encoding string // leave out to use the port's. see encoding.go.
 }
 
 type writeRequestJsonData struct {
@@ -67,8 +71,10 @@ type qReport struct {
 }
 
 type serialhub struct {
-	// Opened serial ports.
-	ports map[*serport]bool
+	// Opened serial ports. Only run() changes it, but the http handlers,
+	// the hub and shutdown read it too, so go through portList().
+	ports     map[*serport]bool
+	portsLock sync.RWMutex
 
 	//open chan *io.ReadWriteCloser
 	//write chan *serport, chan []byte
@@ -93,6 +99,7 @@ type SpPortList struct {
 
 type SpPortItem struct {
 	Name                      string
+	Alias                     string // from the config file, i.e. mill
 	Friendly                  string
 	SerialNumber              string
 	DeviceClass               string
@@ -105,7 +112,10 @@ type SpPortItem struct {
 	Ver                       float32
 	UsbVid                    string
 	UsbPid                    string
+	UsbPath                   string
 	FeedRateOverride          float32
+	PortOptions               // only filled in for open ports
+	IsReconnecting            bool
 }
 
 var sh = serialhub{
@@ -129,20 +139,30 @@ func (sh *serialhub) run() {
 	for {
 		select {
 		case p := <-sh.register:
-			log.Print("Registering a port: ", p.portConf.Name)
+			log.Print("Registering a port: ", p.name())
 			isPrimary := "false"
 			if p.IsPrimary {
 				isPrimary = "true"
 			}
-			h.broadcastSys <- []byte("{\"Cmd\":\"Open\",\"Desc\":\"Got register/open on port.\",\"Port\":\"" + p.portConf.Name + "\",\"IsPrimary\":" + isPrimary + ",\"Baud\":" + strconv.Itoa(p.portConf.Baud) + ",\"BufferType\":\"" + p.BufferType + "\"}")
+			h.broadcastSys <- []byte("{\"Cmd\":\"Open\",\"Desc\":\"Got register/open on port.\",\"Port\":\"" + p.name() + "\",\"IsPrimary\":" + isPrimary + ",\"Baud\":" + strconv.Itoa(p.portConf.Baud) + ",\"BufferType\":\"" + p.BufferType + "\",\"DataBits\":" + strconv.Itoa(p.line.DataBits) + ",\"Parity\":\"" + p.line.Parity + "\",\"StopBits\":" + strconv.FormatFloat(p.line.StopBits, 'f', -1, 64) + ",\"FlowControl\":\"" + p.line.FlowControl + "\"}")
 			//log.Print(p.portConf.Name)
+			sh.portsLock.Lock()
 			sh.ports[p] = true
+			sh.portsLock.Unlock()
+			close(p.registered)
+			nudgeHotplug()
 		case p := <-sh.unregister:
-			log.Print("Unregistering a port: ", p.portConf.Name)
-			h.broadcastSys <- []byte("{\"Cmd\":\"Close\",\"Desc\":\"Got unregister/close on port.\",\"Port\":\"" + p.portConf.Name + "\",\"Baud\":" + strconv.Itoa(p.portConf.Baud) + "}")
+			log.Print("Unregistering a port: ", p.name())
+			h.broadcastSys <- []byte("{\"Cmd\":\"Close\",\"Desc\":\"Got unregister/close on port.\",\"Port\":\"" + p.name() + "\",\"Baud\":" + strconv.Itoa(p.portConf.Baud) + "}")
+			sh.portsLock.Lock()
 			delete(sh.ports, p)
+			sh.portsLock.Unlock()
+			dropLease(p)
+			stopShare(p)
 			close(p.sendBuffered)
 			close(p.sendNoBuf)
+			forgetVirtualPort(p.name())
+			nudgeHotplug()
 		case wrj := <-sh.writeJson:
 			// if the user sent in the commands as json
 			writeJson(wrj)
@@ -154,6 +174,17 @@ func (sh *serialhub) run() {
 	}
 }
 
+// portList gives back the ports that are open right now
+func (sh *serialhub) portList() []*serport {
+	sh.portsLock.RLock()
+	defer sh.portsLock.RUnlock()
+	list := make([]*serport, 0, len(sh.ports))
+	for p := range sh.ports {
+		list = append(list, p)
+	}
+	return list
+}
+
 func writeJson(wrj writeRequestJson) {
 	// we'll parse this json request and then do a write() as if
 	// the cmd was sent in as text mode
@@ -215,9 +246,9 @@ func writeJson(wrj writeRequestJson) {
 	// do our own report
 	qr := qReportJson{
 		Cmd:  "Queued",
-		Data: qReportDataArr,
+		Data: wrj.p.encodeReportData(qReportDataArr),
 		QCnt: wrj.p.itemsInBuffer,
-		P:    wrj.p.portConf.Name,
+		P:    wrj.p.name(),
 	}
 	json, _ := json.Marshal(qr)
 	h.broadcastSys <- json
@@ -259,9 +290,9 @@ func write(wr writeRequest, id string) {
 		Cmd: "Queued",
 		//Type: bufTypeArr,
 		Ids:  idArr,
-		D:    cmds,
+		D:    wr.p.encodeCmds(cmds),
 		QCnt: wr.p.itemsInBuffer,
-		Port: wr.p.portConf.Name,
+		Port: wr.p.name(),
 	}
 	json, _ := json.Marshal(qr)
 	h.broadcastSys <- json
@@ -335,54 +366,7 @@ func createCommands(wr writeRequest, id string) ([]string, []string, []string) {
 		wipeBuf := wr.p.bufferwatcher.SeeIfSpecificCommandsShouldWipeBuffer(cmd)
 		if wipeBuf {
 			log.Printf("We got a command that is asking us to wipe the sendBuffered buf. cmd:%v\n", cmd)
-			// just wipe out the current channel and create new
-			// hopefully garbage collection works here
-
-			// close the channel
-			//close(wr.p.sendBuffered)
-
-			// consume all stuff queued
-			func() {
-				ctr := 0
-				/*
-					for data := range wr.p.sendBuffered {
-						log.Printf("Consuming sendBuffered queue. d:%v\n", string(data))
-						ctr++
-					}*/
-
-				keepLooping := true
-				for keepLooping {
-					select {
-					case d, ok := <-wr.p.sendBuffered:
-						log.Printf("Consuming sendBuffered queue. ok:%v, d:%v, id:%v\n", ok, string(d.data), string(d.id))
-						ctr++
-						// since we just consumed a buffer item, we need to decrement bufcount
-						// we are doing this artificially because we artifically threw
-						// away what was in the bufer
-						wr.p.itemsInBuffer--
-						if ok == false {
-							keepLooping = false
-						}
-					default:
-						keepLooping = false
-						log.Println("Hit default in select clause")
-					}
-				}
-				log.Printf("Done consuming sendBuffered cmds. ctr:%v\n", ctr)
-			}()
-
-			// we still will likely have a sendBuffered that is in the BlockUntilReady()
-			// that we have to deal with so it doesn't send to the serial port
-			// when we release it
-			// send semaphore release if there is one on the BlockUntilReady()
-			// this method will release the BlockUntilReady() but with an unblock
-			// of type 2 which means cancel the send
-			wr.p.bufferwatcher.ReleaseLock()
-
-			// let user know we wiped queue
-			log.Printf("itemsInBuffer:%v\n", wr.p.itemsInBuffer)
-			h.broadcastSys <- []byte("{\"Cmd\":\"WipedQueue\",\"QCnt\":" + strconv.Itoa(wr.p.itemsInBuffer) + ",\"Port\":\"" + wr.p.portConf.Name + "\"}")
-
+			wipeQueue(wr.p)
 		}
 
 		// do extra check to see if any specific commands should pause
@@ -450,29 +434,57 @@ func writeToChannels(cmds []string, idArr []string, bufTypeArr []string) {
 
 func spList() {
 
+	spl := spListData()
+
+	// we are getting a crash here, so thinking it's like a null pointer. do some further
+	// debug and set default values
+	log.Printf("About to marshal the serial port list. spl:%v", spl)
+	ls, err := json.MarshalIndent(spl, "", "\t")
+	if err != nil {
+		log.Println(err)
+		h.broadcastSys <- []byte("Error creating json on port list " +
+			err.Error())
+	} else {
+		//log.Print("Printing out json byte data...")
+		//log.Print(ls)
+		h.broadcastSys <- ls
+	}
+}
+
+// spListData builds the port list that spList() broadcasts. It is split
+// out so the json command protocol can hand the list back to just the
+// client that asked for it.
+func spListData() SpPortList {
+
 	// call our os specific implementation of getting the serial list
 	list, _ := GetList()
 
+	// virtual ports aren't anything the OS knows about
+	list = append(list, virtualPortList()...)
+
 	// do a quick loop to see if any of our open ports
 	// did not end up in the list port list. this can
 	// happen on windows in a fallback scenario where an
 	// open port can't be identified because it is locked,
 	// so just solve that by manually inserting
-	for port := range sh.ports {
+	for _, port := range sh.portList() {
 
 		isFound := false
 		for _, item := range list {
-			if strings.ToLower(port.portConf.Name) == strings.ToLower(item.Name) {
+			if strings.ToLower(port.name()) == strings.ToLower(item.Name) {
 				isFound = true
 			}
 		}
 
 		if !isFound {
 			// artificially push to front of port list
-			log.Println(fmt.Sprintf("Did not find an open port in the serial port list. We are going to artificially push it onto the list. port:%v", port.portConf.Name))
+			log.Println(fmt.Sprintf("Did not find an open port in the serial port list. We are going to artificially push it onto the list. port:%v", port.name()))
 			var ossp OsSerialPort
-			ossp.Name = port.portConf.Name
-			ossp.FriendlyName = port.portConf.Name
+			ossp.Name = port.name()
+			ossp.FriendlyName = port.name()
+			if isNetPort(port.name()) {
+				ossp.DeviceClass = deviceClassNetwork
+			}
 			list = append([]OsSerialPort{ossp}, list...)
 		}
 	}
@@ -485,8 +497,9 @@ func spList() {
 
 	// now try to get the meta data for the ports. keep in mind this may fail
 	// to give us anything
-	metaports, err := GetMetaList()
+	metaports, _ := GetMetaList()
 	log.Printf("Got metadata on ports:%v", metaports)
+	isAliased := hasPortAliases()
 
 	ctr := 0
 	for _, item := range list {
@@ -515,15 +528,19 @@ func spList() {
 			Baud:                      0,
 			BufferAlgorithm:           "",
 			AvailableBufferAlgorithms: availableBufferAlgorithms,
-			Ver:    versionFloat,
-			UsbPid: item.IdProduct,
-			UsbVid: item.IdVendor,
+			Ver:     versionFloat,
+			UsbPid:  item.IdProduct,
+			UsbVid:  item.IdVendor,
+			UsbPath: item.UsbPath,
 		}
 
 		// if we have meta data for this port, use it
 		if len(metaports) > 0 {
 			setMetaData(&spl.SerialPorts[ctr], metaports)
 		}
+		if isAliased {
+			spl.SerialPorts[ctr].Alias = portAlias(spl.SerialPorts[ctr])
+		}
 
 		// figure out if port is open
 		//spl.SerialPorts[ctr].IsOpen = false
@@ -536,24 +553,18 @@ func spList() {
 			spl.SerialPorts[ctr].BufferAlgorithm = myport.BufferType
 			spl.SerialPorts[ctr].IsPrimary = myport.IsPrimary
 			spl.SerialPorts[ctr].FeedRateOverride = myport.feedRateOverride
+			spl.SerialPorts[ctr].PortOptions = PortOptions{LineSettings: myport.line, FrameSettings: myport.framing, AutoReconnect: myport.autoReconnect, Encoding: myport.encoding}
+			spl.SerialPorts[ctr].IsReconnecting = myport.isReconnecting
+			// the alias it was opened under, even if the config changed since
+			if len(myport.alias) > 0 {
+				spl.SerialPorts[ctr].Alias = myport.alias
+			}
 		}
 		//ls += "{ \"name\" : \"" + item.Name + "\", \"friendly\" : \"" + item.FriendlyName + "\" },\n"
 		ctr++
 	}
 
-	// we are getting a crash here, so thinking it's like a null pointer. do some further
-	// debug and set default values
-	log.Printf("About to marshal the serial port list. spl:%v", spl)
-	ls, err := json.MarshalIndent(spl, "", "\t")
-	if err != nil {
-		log.Println(err)
-		h.broadcastSys <- []byte("Error creating json on port list " +
-			err.Error())
-	} else {
-		//log.Print("Printing out json byte data...")
-		//log.Print(ls)
-		h.broadcastSys <- ls
-	}
+	return spl
 }
 
 func setMetaData(pi *SpPortItem, metadata []OsSerialPort) {
@@ -567,6 +578,7 @@ func setMetaData(pi *SpPortItem, metadata []OsSerialPort) {
 			pi.RelatedNames = mi.RelatedNames
 			pi.UsbPid = mi.IdProduct
 			pi.UsbVid = mi.IdVendor
+			pi.UsbPath = mi.UsbPath
 			break
 		}
 	}
@@ -584,6 +596,7 @@ func setMetaDataForOsSerialPort(pi *OsSerialPort, metadata []OsSerialPort) {
 			pi.DeviceClass = mi.DeviceClass
 			pi.SerialNumber = mi.SerialNumber
 			pi.RelatedNames = mi.RelatedNames
+			pi.UsbPath = mi.UsbPath
 			break
 		}
 	}
@@ -614,18 +627,27 @@ func spClose(portname string) {
 	// that should cause an unregister channel call back
 	// to myself
 
+	if err := spClosePort(portname); err != nil {
+		spErr(err.Error())
+	}
+}
+
+func spClosePort(portname string) error {
 	myport, isFound := findPortByName(portname)
 
-	if isFound {
-		// we found our port
-		spHandlerClose(myport)
-	} else {
+	if !isFound {
 		// we couldn't find the port, so send err
-		spErr("We could not find the serial port " + portname + " that you were trying to close.")
+		return errors.New("We could not find the serial port " + portname + " that you were trying to close.")
 	}
+
+	// we found our port
+	spHandlerClose(myport)
+	return nil
 }
 
-func spWriteJson(arg string) {
+// spWriteJson handles the text sendjson command. c is who sent it, or nil
+// if it came from inside SPJS.
+func spWriteJson(c *connection, arg string) {
 
 	//log.Printf("spWriteJson. arg:%v\n", arg)
 
@@ -658,14 +680,31 @@ func spWriteJson(arg string) {
 		return
 	}
 
+	if err := spWriteJsonReq(c, m); err != nil {
+		spErr(err.Error())
+	}
+}
+
+// spWriteJsonReq queues an already decoded sendjson request onto its port
+func spWriteJsonReq(c *connection, m writeRequestJson) error {
+
 	// see if we have this port open
 	portname := m.P
 	myport, isFound := findPortByName(portname)
 
 	if !isFound {
 		// we couldn't find the port, so send err
-		spErr("We could not find the serial port " + portname + " that you were trying to write to.")
-		return
+		return errors.New("We could not find the serial port " + portname + " that you were trying to write to.")
+	}
+
+	// somebody else may have claimed this port
+	if err := checkLease(c, myport); err != nil {
+		return err
+	}
+
+	// hex or base64 if that's how the port was opened
+	if err := decodeJsonReq(c, &m); err != nil {
+		return err
 	}
 
 	// we found our port
@@ -673,9 +712,10 @@ func spWriteJson(arg string) {
 
 	// send it to the writeJson channel
 	sh.writeJson <- m
+	return nil
 }
 
-func spWrite(arg string) {
+func spWrite(c *connection, arg string) {
 	// we will get a string of comXX asdf asdf asdf
 	log.Println("Inside spWrite arg: " + arg)
 	arg = strings.TrimPrefix(arg, " ")
@@ -691,43 +731,157 @@ func spWrite(arg string) {
 	//log.Println("The port to write to is:" + portname + "---")
 	//log.Println("The data is:" + args[2] + "---")
 
+	// see if args[0] is send or sendnobuf
+	buffer := true
+	if args[0] == "sendnobuf" {
+		log.Println("sendnobuf specified so wr.buffer is false")
+		buffer = false
+	}
+
+	// hex or base64 if that's how the port was opened
+	data, err := decodePortData(c, portname, args[2], "")
+	if err != nil {
+		spErr(err.Error())
+		return
+	}
+
+	// include newline or not in the write? that is the question.
+	// for now lets skip the newline
+	if err := spWritePort(c, portname, data, buffer); err != nil {
+		spErr(err.Error())
+	}
+}
+
+// spWritePort queues data onto an open port as if it came in from a
+// send (buffer == true) or sendnobuf (buffer == false) command from c
+func spWritePort(c *connection, portname string, data string, buffer bool) error {
+
 	// see if we have this port open
 	myport, isFound := findPortByName(portname)
 
 	if !isFound {
 		// we couldn't find the port, so send err
-		spErr("We could not find the serial port " + portname + " that you were trying to write to.")
-		return
+		return errors.New("We could not find the serial port " + portname + " that you were trying to write to.")
+	}
+
+	// somebody else may have claimed this port
+	if err := checkLease(c, myport); err != nil {
+		return err
+	}
+
+	// sendnobuf skips the held queue so it would just go nowhere
+	if myport.isReconnecting && !buffer {
+		return errors.New("Port " + portname + " is waiting to reconnect. Use send to queue data for when it's back.")
 	}
 
 	// we found our port
 	// create our write request
 	var wr writeRequest
 	wr.p = myport
+	wr.buffer = buffer
+	wr.d = data
 
-	// see if args[0] is send or sendnobuf
-	if args[0] != "sendnobuf" {
-		// we were just given a "send" so buffer it
-		wr.buffer = true
-	} else {
-		log.Println("sendnobuf specified so wr.buffer is false")
-		wr.buffer = false
+	// send it to the write channel
+	sh.write <- wr
+	return nil
+}
+
+type SpQueueStatus struct {
+	Cmd            string
+	Port           string
+	QCnt           int
+	BufferType     string
+	IsManualPaused bool
+	IsHeld         bool // held after the device went away. see reconnect.go.
+}
+
+func spQueueStatusData(portname string) (SpQueueStatus, error) {
+	myport, isFound := findPortByName(portname)
+	if !isFound {
+		return SpQueueStatus{}, errors.New("We could not find the serial port " + portname + " that you were asking about.")
 	}
+	return SpQueueStatus{
+		Cmd:            "QueueStatus",
+		Port:           myport.name(),
+		QCnt:           myport.itemsInBuffer,
+		BufferType:     myport.BufferType,
+		IsManualPaused: myport.bufferwatcher.GetManualPaused(),
+		IsHeld:         myport.isHeld(),
+	}, nil
+}
 
-	// include newline or not in the write? that is the question.
-	// for now lets skip the newline
-	//wr.d = []byte(args[2] + "\n")
-	wr.d = args[2] //[]byte(args[2])
+func spQueueStatus(arg string) {
+	args := strings.Fields(arg)
+	if len(args) < 2 {
+		spErr("You did not specify a port to get the queue of")
+		return
+	}
+	qs, err := spQueueStatusData(args[1])
+	if err != nil {
+		spErr(err.Error())
+		return
+	}
+	b, _ := json.Marshal(qs)
+	h.broadcastSys <- b
+}
 
-	// send it to the write channel
-	sh.write <- wr
+// wipeQueue throws away everything in the sendBuffered queue of p
+func wipeQueue(p *serport) {
+	atomic.AddInt64(&p.wipes, 1)
+
+	// just wipe out the current channel and create new
+	// hopefully garbage collection works here
 
+	// close the channel
+	//close(p.sendBuffered)
+
+	// consume all stuff queued
+	func() {
+		ctr := 0
+		/*
+			for data := range p.sendBuffered {
+				log.Printf("Consuming sendBuffered queue. d:%v\n", string(data))
+				ctr++
+			}*/
+
+		keepLooping := true
+		for keepLooping {
+			select {
+			case d, ok := <-p.sendBuffered:
+				log.Printf("Consuming sendBuffered queue. ok:%v, d:%v, id:%v\n", ok, string(d.data), string(d.id))
+				ctr++
+				// since we just consumed a buffer item, we need to decrement bufcount
+				// we are doing this artificially because we artifically threw
+				// away what was in the bufer
+				p.itemsInBuffer--
+				if ok == false {
+					keepLooping = false
+				}
+			default:
+				keepLooping = false
+				log.Println("Hit default in select clause")
+			}
+		}
+		log.Printf("Done consuming sendBuffered cmds. ctr:%v\n", ctr)
+	}()
+
+	// we still will likely have a sendBuffered that is in the BlockUntilReady()
+	// that we have to deal with so it doesn't send to the serial port
+	// when we release it
+	// send semaphore release if there is one on the BlockUntilReady()
+	// this method will release the BlockUntilReady() but with an unblock
+	// of type 2 which means cancel the send
+	p.bufferwatcher.ReleaseLock()
+
+	// let user know we wiped queue
+	log.Printf("itemsInBuffer:%v\n", p.itemsInBuffer)
+	h.broadcastSys <- []byte("{\"Cmd\":\"WipedQueue\",\"QCnt\":" + strconv.Itoa(p.itemsInBuffer) + ",\"Port\":\"" + p.name() + "\"}")
 }
 
 func findPortByName(portname string) (*serport, bool) {
 	portnamel := strings.ToLower(portname)
-	for port := range sh.ports {
-		if strings.ToLower(port.portConf.Name) == portnamel {
+	for _, port := range sh.portList() {
+		if strings.ToLower(port.name()) == portnamel || (len(port.alias) > 0 && strings.ToLower(port.alias) == portnamel) {
 			// we found our port
 			//spHandlerClose(port)
 			return port, true
@@ -747,11 +901,13 @@ func spBufferAlgorithms() {
 	h.broadcastSys <- []byte(json)
 }
 
+var availableBaudRates = []int{2400, 4800, 9600, 19200, 38400, 57600, 115200, 230400}
+
 func spBaudRates() {
-	arr := []string{"2400", "4800", "9600", "19200", "38400", "57600", "115200", "230400"}
+	arr := availableBaudRates
 	json := "{\"BaudRate\" : ["
 	for _, elem := range arr {
-		json += "" + elem + ", "
+		json += strconv.Itoa(elem) + ", "
 	}
 	json = regexp.MustCompile(", $").ReplaceAllString(json, "]}")
 	h.broadcastSys <- []byte(json)
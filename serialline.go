@@ -0,0 +1,169 @@
+// Line settings for a serial port beyond the baud, i.e. the 7E1 a scale or
+// PLC wants or the 8N2 with RTS/CTS handshaking some controllers need. They
+// can be given on open, in the text form as "open COM4 9600 default 7E1 rtscts"
+// or as the DataBits, Parity, StopBits and FlowControl args of the json form,
+// or by a rule in the config file. Anything left out is 8N1 with no flow
+// control like always.
+//
+// Ports that are 8N1 with no flow control are opened exactly like they always
+// were. Anything else is applied by openSerialLine(), which lives in the
+// serialline_*.go file for your OS.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	parityNone  = "none"
+	parityOdd   = "odd"
+	parityEven  = "even"
+	parityMark  = "mark"
+	paritySpace = "space"
+
+	flowNone    = "none"
+	flowRtsCts  = "rtscts"
+	flowXonXoff = "xonxoff"
+)
+
+type LineSettings struct {
+	DataBits    int     // 5, 6, 7 or 8. 8 if left out.
+	Parity      string  // none, odd, even, mark or space. none if left out.
+	StopBits    float64 // 1, 1.5 or 2. 1 if left out.
+	FlowControl string  // none, rtscts or xonxoff. none if left out.
+}
+
+// withDefaults fills in what was left out, taking it from def first, i.e.
+// from the rule in the config file, and then from 8N1 with no flow control
+func (ls LineSettings) withDefaults(def LineSettings) LineSettings {
+	if ls.DataBits == 0 {
+		ls.DataBits = def.DataBits
+	}
+	if len(ls.Parity) == 0 {
+		ls.Parity = def.Parity
+	}
+	if ls.StopBits == 0 {
+		ls.StopBits = def.StopBits
+	}
+	if len(ls.FlowControl) == 0 {
+		ls.FlowControl = def.FlowControl
+	}
+
+	if ls.DataBits == 0 {
+		ls.DataBits = 8
+	}
+	if len(ls.Parity) == 0 {
+		ls.Parity = parityNone
+	}
+	if ls.StopBits == 0 {
+		ls.StopBits = 1
+	}
+	if len(ls.FlowControl) == 0 {
+		ls.FlowControl = flowNone
+	}
+	ls.Parity = strings.ToLower(ls.Parity)
+	ls.FlowControl = strings.ToLower(ls.FlowControl)
+	return ls
+}
+
+// check makes sure the settings make sense. Leaving something out is fine.
+func (ls LineSettings) check() error {
+	if ls.DataBits != 0 && (ls.DataBits < 5 || ls.DataBits > 8) {
+		return errors.New("DataBits must be 5, 6, 7 or 8")
+	}
+	switch strings.ToLower(ls.Parity) {
+	case "", parityNone, parityOdd, parityEven, parityMark, paritySpace:
+	default:
+		return errors.New("Parity must be none, odd, even, mark or space")
+	}
+	if ls.StopBits != 0 && ls.StopBits != 1 && ls.StopBits != 1.5 && ls.StopBits != 2 {
+		return errors.New("StopBits must be 1, 1.5 or 2")
+	}
+	switch strings.ToLower(ls.FlowControl) {
+	case "", flowNone, flowRtsCts, flowXonXoff:
+	default:
+		return errors.New("FlowControl must be none, rtscts or xonxoff")
+	}
+	return nil
+}
+
+// isDefault is true for 8N1 with no flow control, which is what the serial
+// library gives us without any help
+func (ls LineSettings) isDefault() bool {
+	ls = ls.withDefaults(LineSettings{})
+	return ls.DataBits == 8 && ls.Parity == parityNone && ls.StopBits == 1 && ls.FlowControl == flowNone
+}
+
+// shortForm gives the settings the way people write them, i.e. 7E1 or 8N2 rtscts
+func (ls LineSettings) shortForm() string {
+	ls = ls.withDefaults(LineSettings{})
+	s := strconv.Itoa(ls.DataBits) + strings.ToUpper(ls.Parity[:1]) + strconv.FormatFloat(ls.StopBits, 'f', -1, 64)
+	if ls.FlowControl != flowNone {
+		s += " " + ls.FlowControl
+	}
+	return s
+}
+
+// parseLineFormat parses the short form, i.e. 7E1, 8N2 or 5N1.5
+func parseLineFormat(s string) (LineSettings, bool) {
+	var ls LineSettings
+	if len(s) < 3 || s[0] < '5' || s[0] > '8' {
+		return ls, false
+	}
+	ls.DataBits = int(s[0] - '0')
+	switch strings.ToUpper(s[1:2]) {
+	case "N":
+		ls.Parity = parityNone
+	case "O":
+		ls.Parity = parityOdd
+	case "E":
+		ls.Parity = parityEven
+	case "M":
+		ls.Parity = parityMark
+	case "S":
+		ls.Parity = paritySpace
+	default:
+		return ls, false
+	}
+	stopBits, err := strconv.ParseFloat(s[2:], 64)
+	if err != nil {
+		return ls, false
+	}
+	ls.StopBits = stopBits
+	return ls, ls.check() == nil
+}
+
+func isFlowControl(s string) bool {
+	switch strings.ToLower(s) {
+	case flowNone, flowRtsCts, flowXonXoff:
+		return true
+	}
+	return false
+}
+
+// parseLineArgs picks the line settings and buffer algorithm out of what
+// comes after the baud in the text open command. They can be in any order.
+func parseLineArgs(args []string) (LineSettings, string, error) {
+	var ls LineSettings
+	bufferAlgorithm := ""
+	for _, arg := range args {
+		arg = strings.TrimSpace(arg)
+		if len(arg) == 0 {
+			continue
+		}
+		if line, ok := parseLineFormat(arg); ok {
+			ls.DataBits, ls.Parity, ls.StopBits = line.DataBits, line.Parity, line.StopBits
+		} else if isFlowControl(arg) {
+			ls.FlowControl = strings.ToLower(arg)
+		} else if len(bufferAlgorithm) == 0 {
+			bufferAlgorithm = arg
+		} else {
+			return ls, "", fmt.Errorf("Did not understand %v. Line settings look like 8N1 or 7E1 and flow control is none, rtscts or xonxoff.", arg)
+		}
+	}
+	return ls, bufferAlgorithm, nil
+}
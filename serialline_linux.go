@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/johnlauer/goserial"
+)
+
+// these aren't in the syscall package
+const (
+	termiosCrtsCts = 020000000000
+	termiosCmsPar  = 010000000000
+	termiosCbaud   = 0010017
+
+	// like TCSETS but waits for what was written to go out first
+	termiosSetsWait = syscall.TCSETS + 1
+)
+
+var termiosBauds = map[int]uint32{
+	50: syscall.B50, 75: syscall.B75, 110: syscall.B110, 134: syscall.B134, 150: syscall.B150,
+	200: syscall.B200, 300: syscall.B300, 600: syscall.B600, 1200: syscall.B1200, 1800: syscall.B1800,
+	2400: syscall.B2400, 4800: syscall.B4800, 9600: syscall.B9600, 19200: syscall.B19200,
+	38400: syscall.B38400, 57600: syscall.B57600, 115200: syscall.B115200, 230400: syscall.B230400,
+	460800: syscall.B460800, 500000: syscall.B500000, 576000: syscall.B576000, 921600: syscall.B921600,
+	1000000: syscall.B1000000, 1152000: syscall.B1152000, 1500000: syscall.B1500000,
+	2000000: syscall.B2000000, 2500000: syscall.B2500000, 3000000: syscall.B3000000,
+	3500000: syscall.B3500000, 4000000: syscall.B4000000,
+}
+
+// openSerialLine opens the port like always and then sets the data bits,
+// parity, stop bits and flow control on it with termios
+func openSerialLine(conf *serial.Config, ls LineSettings) (io.ReadWriteCloser, error) {
+	sp, err := serial.OpenPort(conf)
+	if err != nil || ls.isDefault() {
+		return sp, err
+	}
+	f, ok := sp.(*os.File)
+	if !ok {
+		sp.Close()
+		return nil, errors.New("The serial library did not give back a file we can set the line settings on")
+	}
+	if err := setTermios(f, 0, ls, syscall.TCSETS); err != nil {
+		sp.Close()
+		return nil, errors.New("Problem setting the line to " + ls.shortForm() + ". " + err.Error())
+	}
+	return sp, nil
+}
+
+// osReconfigure changes the baud and line settings of an open port once
+// what was already written to it has gone out
+func osReconfigure(rwc io.ReadWriteCloser, baud int, ls LineSettings) error {
+	f, err := portFile(rwc)
+	if err != nil {
+		return err
+	}
+	return setTermios(f, baud, ls, termiosSetsWait)
+}
+
+// setTermios sets the line settings, and the baud too unless it's 0
+func setTermios(f *os.File, baud int, ls LineSettings, req uintptr) error {
+	ls = ls.withDefaults(LineSettings{})
+	fd := f.Fd()
+	var t syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		return err
+	}
+
+	if baud > 0 {
+		speed, isFound := termiosBauds[baud]
+		if !isFound {
+			return errors.New("Linux doesn't have a baud rate of " + strconv.Itoa(baud))
+		}
+		// the speed lives in Cflag. Ispeed and Ospeed aren't there on
+		// every arch and the kernel goes by Cflag for these rates anyway.
+		t.Cflag &^= termiosCbaud
+		t.Cflag |= speed
+	}
+
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.PARODD | termiosCmsPar | syscall.CSTOPB | termiosCrtsCts
+	t.Iflag &^= syscall.IXON | syscall.IXOFF | syscall.IXANY | syscall.INPCK
+
+	switch ls.DataBits {
+	case 5:
+		t.Cflag |= syscall.CS5
+	case 6:
+		t.Cflag |= syscall.CS6
+	case 7:
+		t.Cflag |= syscall.CS7
+	default:
+		t.Cflag |= syscall.CS8
+	}
+
+	switch ls.Parity {
+	case parityOdd:
+		t.Cflag |= syscall.PARENB | syscall.PARODD
+	case parityEven:
+		t.Cflag |= syscall.PARENB
+	case parityMark:
+		t.Cflag |= syscall.PARENB | syscall.PARODD | termiosCmsPar
+	case paritySpace:
+		t.Cflag |= syscall.PARENB | termiosCmsPar
+	}
+	if ls.Parity != parityNone {
+		t.Iflag |= syscall.INPCK
+	}
+
+	// linux gives you 1.5 stop bits when you ask for 2 with 5 data bits
+	switch {
+	case ls.StopBits == 1.5 && ls.DataBits != 5:
+		return errors.New("Linux can only do 1.5 stop bits with 5 data bits")
+	case ls.StopBits == 2 && ls.DataBits == 5:
+		return errors.New("Linux can't do 2 stop bits with 5 data bits")
+	case ls.StopBits > 1:
+		t.Cflag |= syscall.CSTOPB
+	}
+
+	switch ls.FlowControl {
+	case flowRtsCts:
+		t.Cflag |= termiosCrtsCts
+	case flowXonXoff:
+		t.Iflag |= syscall.IXON | syscall.IXOFF
+	}
+
+	return ioctl(fd, req, uintptr(unsafe.Pointer(&t)))
+}
+
+func portFile(rwc io.ReadWriteCloser) (*os.File, error) {
+	f, ok := rwc.(*os.File)
+	if !ok {
+		return nil, errModemNotSupported
+	}
+	return f, nil
+}
+
+func setModemBit(rwc io.ReadWriteCloser, bit int, on bool) error {
+	f, err := portFile(rwc)
+	if err != nil {
+		return err
+	}
+	req := syscall.TIOCMBIC
+	if on {
+		req = syscall.TIOCMBIS
+	}
+	cbit := int32(bit) // the kernel wants a C int
+	return ioctl(f.Fd(), uintptr(req), uintptr(unsafe.Pointer(&cbit)))
+}
+
+func osSetDTR(rwc io.ReadWriteCloser, on bool) error {
+	return setModemBit(rwc, syscall.TIOCM_DTR, on)
+}
+
+func osSetRTS(rwc io.ReadWriteCloser, on bool) error {
+	return setModemBit(rwc, syscall.TIOCM_RTS, on)
+}
+
+func osSendBreak(rwc io.ReadWriteCloser, d time.Duration) error {
+	f, err := portFile(rwc)
+	if err != nil {
+		return err
+	}
+	if err := ioctl(f.Fd(), syscall.TIOCSBRK, 0); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return ioctl(f.Fd(), syscall.TIOCCBRK, 0)
+}
+
+func osModemLines(rwc io.ReadWriteCloser) (ModemLines, error) {
+	var ml ModemLines
+	f, err := portFile(rwc)
+	if err != nil {
+		return ml, err
+	}
+	var bits int32
+	if err := ioctl(f.Fd(), syscall.TIOCMGET, uintptr(unsafe.Pointer(&bits))); err != nil {
+		return ml, err
+	}
+	ml.Dtr = bits&syscall.TIOCM_DTR != 0
+	ml.Rts = bits&syscall.TIOCM_RTS != 0
+	ml.Cts = bits&syscall.TIOCM_CTS != 0
+	ml.Dsr = bits&syscall.TIOCM_DSR != 0
+	ml.Dcd = bits&syscall.TIOCM_CD != 0
+	ml.Ri = bits&syscall.TIOCM_RI != 0
+	return ml, nil
+}
+
+func ioctl(fd uintptr, req uintptr, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	serial2 "github.com/facchinm/go-serial"
+	"github.com/johnlauer/goserial"
+)
+
+// openSerialLine opens ports that aren't 8N1 with the Arduino serial library
+// since the original one can only do 8N1. Neither can do flow control here.
+func openSerialLine(conf *serial.Config, ls LineSettings) (io.ReadWriteCloser, error) {
+	if ls.isDefault() {
+		return serial.OpenPort(conf)
+	}
+	mode, err := serialMode(conf.Baud, ls)
+	if err != nil {
+		return nil, err
+	}
+	sp, err := serial2.OpenPort(conf.Name, mode)
+	if err != nil {
+		return nil, err
+	}
+	sp.SetDTR(conf.DtrOn)
+	sp.SetRTS(conf.RtsOn)
+	return sp, nil
+}
+
+func serialMode(baud int, ls LineSettings) (*serial2.Mode, error) {
+	ls = ls.withDefaults(LineSettings{})
+	if ls.FlowControl != flowNone {
+		return nil, errors.New("Flow control is only supported on Linux")
+	}
+
+	mode := &serial2.Mode{
+		BaudRate: baud,
+		DataBits: ls.DataBits,
+		Parity:   serial2.PARITY_NONE,
+		StopBits: serial2.STOPBITS_ONE,
+	}
+	switch ls.Parity {
+	case parityOdd:
+		mode.Parity = serial2.PARITY_ODD
+	case parityEven:
+		mode.Parity = serial2.PARITY_EVEN
+	case parityMark:
+		mode.Parity = serial2.PARITY_MARK
+	case paritySpace:
+		mode.Parity = serial2.PARITY_SPACE
+	}
+	switch ls.StopBits {
+	case 1.5:
+		mode.StopBits = serial2.STOPBITS_ONEPOINTFIVE
+	case 2:
+		mode.StopBits = serial2.STOPBITS_TWO
+	}
+	return mode, nil
+}
+
+// the Arduino serial library can only set DTR and RTS
+func osSetDTR(rwc io.ReadWriteCloser, on bool) error {
+	if sp, ok := rwc.(*serial2.SerialPort); ok {
+		return sp.SetDTR(on)
+	}
+	return errModemNotSupported
+}
+
+func osSetRTS(rwc io.ReadWriteCloser, on bool) error {
+	if sp, ok := rwc.(*serial2.SerialPort); ok {
+		return sp.SetRTS(on)
+	}
+	return errModemNotSupported
+}
+
+func osSendBreak(rwc io.ReadWriteCloser, d time.Duration) error {
+	return errModemNotSupported
+}
+
+func osModemLines(rwc io.ReadWriteCloser) (ModemLines, error) {
+	return ModemLines{}, errModemNotSupported
+}
+
+// osReconfigure can only change ports that were opened with the Arduino
+// serial library
+func osReconfigure(rwc io.ReadWriteCloser, baud int, ls LineSettings) error {
+	sp, ok := rwc.(*serial2.SerialPort)
+	if !ok {
+		return errors.New("On this OS you can only change the settings of a port that was opened with line settings other than 8N1. Close and open it instead.")
+	}
+	mode, err := serialMode(baud, ls)
+	if err != nil {
+		return err
+	}
+	return sp.SetMode(mode)
+}
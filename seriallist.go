@@ -23,6 +23,7 @@ type OsSerialPort struct {
 	Product      string
 	IdProduct    string
 	IdVendor     string
+	UsbPath      string // the hub port it's plugged into, i.e. 1-1.3. Linux only.
 }
 
 func GetList() ([]OsSerialPort, error) {
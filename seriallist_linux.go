@@ -73,6 +73,8 @@ func getListViaTtyList() ([]OsSerialPort, os.SyscallError) {
 	return list[0:ctr], err
 }
 
+var reUsbPath = regexp.MustCompile(`^\d+-\d+(\.\d+)*$`)
+
 type deviceClass struct {
 	BaseClass   int
 	Description string
@@ -204,7 +206,14 @@ func getAllPortsViaManufacturer() ([]OsSerialPort, os.SyscallError) {
 		idProduct := ""
 		idProduct = reNewLine.ReplaceAllString(string(idProductBytes), "")
 
-		log.Printf("%v : %v (%v) DevClass:%v", manuf, product, serialNum, deviceClass)
+		// the usb device directory is named for where it's plugged in, i.e.
+		// 1-1.3 is port 3 of the hub on port 1 of bus 1
+		usbPath := ""
+		if reUsbPath.MatchString(filepath.Base(directory)) {
+			usbPath = filepath.Base(directory)
+		}
+
+		log.Printf("%v : %v (%v) DevClass:%v UsbPath:%v", manuf, product, serialNum, deviceClass, usbPath)
 
 		// -name tty[AU]* -print
 		filesTty := findDirs(directory, "^tty(A|U).*")
@@ -249,6 +258,7 @@ func getAllPortsViaManufacturer() ([]OsSerialPort, os.SyscallError) {
 				Product:      product,
 				IdVendor:     idVendor,
 				IdProduct:    idProduct,
+				UsbPath:      usbPath,
 			}
 			if len(product) > 0 {
 				listitem.FriendlyName += " " + product
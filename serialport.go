@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"sync"
 
 	"github.com/johnlauer/goserial"
@@ -11,9 +12,45 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// PortOptions are what a port can be opened with besides its baud and
+// buffer algorithm. A rule in the config file can give any of them too.
+type PortOptions struct {
+	LineSettings
+
+	// one event per complete frame. see framing.go.
+	FrameSettings
+
+	// reopen the port if the device is unplugged and comes back
+	AutoReconnect bool
+
+	// text, hex or base64. see encoding.go.
+	Encoding string `json:",omitempty"`
+}
+
+// withDefaults fills in what was left out from def, i.e. the rule in the
+// config file
+func (o PortOptions) withDefaults(def PortOptions) PortOptions {
+	o.LineSettings = o.LineSettings.withDefaults(def.LineSettings)
+	o.FrameSettings = o.FrameSettings.withDefaults(def.FrameSettings)
+	o.AutoReconnect = o.AutoReconnect || def.AutoReconnect
+	if len(o.Encoding) == 0 {
+		o.Encoding = def.Encoding
+	}
+	return o
+}
+
+// check makes sure the line settings and framing make sense
+func (o PortOptions) check() error {
+	if err := o.LineSettings.check(); err != nil {
+		return err
+	}
+	return o.FrameSettings.check()
+}
+
 type SerialConfig struct {
 	Name string
 	Baud int
@@ -42,12 +79,41 @@ type serport struct {
 
 	portIo io.ReadWriteCloser
 
+	// guards portConf and portIo since a reconnect, reconfigure or setdtr
+	// can change them. read the name and portIo with name() and io().
+	lock sync.RWMutex
+
+	// data bits, parity, stop bits and flow control
+	line LineSettings
+
+	// what the config file calls the device, i.e. mill. see portalias.go.
+	alias string
+
+	// text, hex or base64. see encoding.go.
+	encoding string
+
+	// puts what we read back together into frames. nil if the port isn't
+	// framed. see framing.go.
+	framing FrameSettings
+	framer  *framer
+
 	done chan bool // signals the end of this request
 
 	// Keep track of whether we're being actively closed
 	// just so we don't show scary error messages
 	isClosing bool
 
+	// reopen the port if the device goes away and comes back. see reconnect.go.
+	autoReconnect  bool
+	isReconnecting bool
+	device         SpPortItem // what we know about the device so we can find it again
+
+	// set while the queue is held after the device went away. only
+	// touched with sync/atomic.
+	held int32
+	// bumped every time the queue is wiped. only touched with sync/atomic.
+	wipes int64
+
 	// counter incremented on queue, decremented on write
 	itemsInBuffer int
 
@@ -70,6 +136,24 @@ type serport struct {
 	// Feedrate override value
 	feedRateOverride     float32
 	isFeedRateOverrideOn bool
+
+	// counters for /metrics
+	stats *portStats
+
+	// closed by the serial hub once the port is in its list
+	registered chan bool
+}
+
+func (p *serport) name() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.portConf.Name
+}
+
+func (p *serport) io() io.ReadWriteCloser {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.portIo
 }
 
 type Cmd struct {
@@ -107,32 +191,45 @@ type qwReportWithData struct {
 }
 
 type SpPortMessage struct {
-	P string // the port, i.e. com22
-	D string // the data, i.e. G0 X0 Y0
+	P        string // the port, i.e. com22
+	D        string // the data, i.e. G0 X0 Y0
+	ReadTs   int64  // when the data came off the port, in microseconds since the unix epoch
+	Encoding string `json:",omitempty"` // hex or base64 if D is encoded
+	Frame    bool   `json:",omitempty"` // D is one whole frame. see framing.go.
 }
 
-func (p *serport) reader() {
+// reader reads the port until it is closed. It gives back true if we lost
+// the port rather than closed it, i.e. the device was unplugged.
+func (p *serport) reader() bool {
 
 	//var buf bytes.Buffer
 	ch := make([]byte, 1024)
 	timeCheckOpen := time.Now()
 
+	// a partial frame from before a reconnect is no good
+	if p.framer != nil {
+		p.framer.reset()
+	}
+
 	for {
 
-		n, err := p.portIo.Read(ch)
+		n, err := p.io().Read(ch)
+		readTs := nowMicros()
 
 		//if we detect that port is closing, break out o this for{} loop.
 		if p.isClosing {
-			strmsg := "Shutting down reader on " + p.portConf.Name
+			strmsg := "Shutting down reader on " + p.name()
 			log.Println(strmsg)
 			h.broadcastSys <- []byte(strmsg)
-			break
+			p.io().Close()
+			return false
 		}
 
 		// read can return legitimate bytes as well as an error
 		// so process the bytes if n > 0
 		if n > 0 {
 			//log.Print("Read " + strconv.Itoa(n) + " bytes ch: " + string(ch))
+			atomic.AddInt64(&p.stats.bytesRead, int64(n))
 			data := string(ch[:n])
 			//log.Print("The data i will convert to json is:")
 			//log.Print(data)
@@ -144,6 +241,9 @@ func (p *serport) reader() {
 			//p.b.bufferwatcher..OnIncomingData(data)
 			p.bufferwatcher.OnIncomingData(data)
 
+			// and to anybody on the network if the port is shared
+			shareData(p, ch[:n])
+
 			// see if the OnIncomingData handled the broadcast back
 			// to the user. this option was added in case the OnIncomingData wanted
 			// to do something fancier or implementation specific, i.e. TinyG Buffer
@@ -153,23 +253,12 @@ func (p *serport) reader() {
 			// of course would screw things up when parsing
 
 			if p.bufferwatcher.IsBufferGloballySendingBackIncomingData() == false {
-				//m := SpPortMessage{"Alice", "Hello"}
-				m := SpPortMessage{p.portConf.Name, data}
-				//log.Print("The m obj struct is:")
-				//log.Print(m)
-
-				//b, err := json.MarshalIndent(m, "", "\t")
-				b, err := json.Marshal(m)
-				if err != nil {
-					log.Println(err)
-					h.broadcastSys <- []byte("Error creating json on " + p.portConf.Name + " " +
-						err.Error() + " The data we were trying to convert is: " + string(ch[:n]))
+				if p.framer != nil {
+					// sent once the frame is complete
+					p.framer.add(ch[:n], readTs)
+				} else if !p.sendData(data, readTs) {
 					break
 				}
-				//log.Print("Printing out json byte data...")
-				//log.Print(string(b))
-				h.broadcastSys <- b
-				//h.broadcastSys <- []byte("{ \"p\" : \"" + p.portConf.Name + "\", \"d\": \"" + string(ch[:n]) + "\" }\n")
 			}
 		}
 
@@ -182,19 +271,26 @@ func (p *serport) reader() {
 		// connect. This means we'll only catch EOF's when there are
 		// other characters with it, but that seems to work ok
 		if n <= 0 {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if (err == io.EOF || err == io.ErrUnexpectedEOF) && !p.autoReconnect {
 				// hit end of file
 				log.Println("Hit end of file on serial port")
-				h.broadcastSys <- []byte("{\"Cmd\":\"OpenFail\",\"Desc\":\"Got EOF (End of File) on port which usually means another app other than Serial Port JSON Server is locking your port. " + err.Error() + "\",\"Port\":\"" + p.portConf.Name + "\",\"Baud\":" + strconv.Itoa(p.portConf.Baud) + "}")
+				h.broadcastSys <- []byte("{\"Cmd\":\"OpenFail\",\"Desc\":\"Got EOF (End of File) on port which usually means another app other than Serial Port JSON Server is locking your port. " + err.Error() + "\",\"Port\":\"" + p.name() + "\",\"Baud\":" + strconv.Itoa(p.portConf.Baud) + "}")
+
+			}
 
+			if err != nil && p.autoReconnect {
+				log.Println("Lost serial port " + p.name() + ". " + err.Error())
+				p.io().Close()
+				return true
 			}
 
 			if err != nil {
 				log.Println(err)
-				h.broadcastSys <- []byte("Error reading on " + p.portConf.Name + " " +
+				h.broadcastSys <- []byte("Error reading on " + p.name() + " " +
 					err.Error() + " Closing port.")
-				h.broadcastSys <- []byte("{\"Cmd\":\"OpenFail\",\"Desc\":\"Got error reading on port. " + err.Error() + "\",\"Port\":\"" + p.portConf.Name + "\",\"Baud\":" + strconv.Itoa(p.portConf.Baud) + "}")
-				break
+				h.broadcastSys <- []byte("{\"Cmd\":\"OpenFail\",\"Desc\":\"Got error reading on port. " + err.Error() + "\",\"Port\":\"" + p.name() + "\",\"Baud\":" + strconv.Itoa(p.portConf.Baud) + "}")
+				p.io().Close()
+				return true
 			}
 
 			// Keep track of time difference between two consecutive read with n == 0 and err == nil
@@ -203,13 +299,45 @@ func (p *serport) reader() {
 			if err == nil {
 				diff := time.Since(timeCheckOpen)
 				if diff.Nanoseconds() < 1000000 {
+					if p.autoReconnect {
+						log.Println("Lost serial port " + p.name())
+						p.io().Close()
+						return true
+					}
 					p.isClosing = true
 				}
 				timeCheckOpen = time.Now()
 			}
 		}
 	}
-	p.portIo.Close()
+	p.io().Close()
+	return false
+}
+
+// sendData sends what we read, or a frame of it, back to the clients
+func (p *serport) sendData(data string, readTs int64) bool {
+	//m := SpPortMessage{"Alice", "Hello"}
+	m := SpPortMessage{p.name(), data, readTs, "", p.framer != nil}
+	if p.encoding == encodingHex || p.encoding == encodingBase64 {
+		m.D = encodeData(p.encoding, data)
+		m.Encoding = p.encoding
+	}
+	//log.Print("The m obj struct is:")
+	//log.Print(m)
+
+	//b, err := json.MarshalIndent(m, "", "\t")
+	b, err := json.Marshal(m)
+	if err != nil {
+		log.Println(err)
+		h.broadcastSys <- []byte("Error creating json on " + p.name() + " " +
+			err.Error() + " The data we were trying to convert is: " + data)
+		return false
+	}
+	//log.Print("Printing out json byte data...")
+	//log.Print(string(b))
+	h.broadcastSys <- b
+	//h.broadcastSys <- []byte("{ \"p\" : \"" + p.portConf.Name + "\", \"d\": \"" + data + "\" }\n")
+	return true
 }
 
 // this method runs as its own thread because it's instantiated
@@ -229,12 +357,15 @@ func (p *serport) writerBuffered() {
 	// this for loop blocks on p.sendBuffered until that channel
 	// sees something come in
 	for data := range p.sendBuffered {
+		wipes := atomic.LoadInt64(&p.wipes)
 
 		log.Printf("Got p.sendBuffered. data:%v, id:%v, pause:%v\n", strings.Replace(string(data.data), "\n", "\\n", -1), string(data.id), data.pause)
 
 		// we want to block here if we are being asked
 		// to pause.
+		blockStart := time.Now()
 		goodToGo, willHandleCompleteResponse, newGcode := p.bufferwatcher.BlockUntilReady(string(data.data), data.id)
+		atomic.AddInt64(&p.stats.pausedNanos, int64(time.Since(blockStart)))
 
 		// BlockUntilReady can modify our Gcode now so it can possibly add tracking data
 		// so if we got newGcode then we must swap it for our original gcode
@@ -246,6 +377,9 @@ func (p *serport) writerBuffered() {
 			log.Println("We got back from BlockUntilReady() but apparently we must cancel this cmd")
 			// since we won't get a buffer decrement in p.sendNoBuf, we must do it here
 			p.itemsInBuffer--
+		} else if !p.waitWhileHeld(wipes) {
+			// the queue was wiped while it was held
+			p.itemsInBuffer--
 		} else {
 			// send to the non-buffered serial port writer
 			//log.Printf("About to send to p.sendNoBuf channel. cmd:%v", data)
@@ -253,7 +387,7 @@ func (p *serport) writerBuffered() {
 			p.sendNoBuf <- data
 		}
 	}
-	msgstr := "writerBuffered just got closed. make sure you make a new one. port:" + p.portConf.Name
+	msgstr := "writerBuffered just got closed. make sure you make a new one. port:" + p.name()
 	log.Println(msgstr)
 	h.broadcastSys <- []byte(msgstr)
 }
@@ -304,7 +438,7 @@ func (p *serport) writerNoBuf() {
 				Id:   string(data.id),
 				D:    string(data.data),
 				Buf:  buf,
-				P:    p.portConf.Name,
+				P:    p.name(),
 			}
 			qwrJson, _ := json.Marshal(qwr)
 			h.broadcastSys <- qwrJson
@@ -316,7 +450,7 @@ func (p *serport) writerNoBuf() {
 				Id:   string(data.id),
 				D:    string(data.data),
 				Buf:  buf,
-				P:    p.portConf.Name,
+				P:    p.name(),
 			}
 			qwrJson, _ := json.Marshal(qwr)
 			h.broadcastSys <- qwrJson
@@ -324,7 +458,8 @@ func (p *serport) writerNoBuf() {
 
 		// FINALLY, OF ALL THE CODE IN THIS PROJECT
 		// WE TRULY/FINALLY GET TO WRITE TO THE SERIAL PORT!
-		_, err := p.portIo.Write([]byte(data.data)) // n2, err :=
+		n2, err := p.io().Write([]byte(data.data))
+		atomic.AddInt64(&p.stats.bytesWritten, int64(n2))
 
 		// New Pause capability after we write. Added 9/23/15
 		// This was needed because many Atmel microcontrollers just plain drop serial data
@@ -340,7 +475,7 @@ func (p *serport) writerNoBuf() {
 			// we need to send back complete response
 			// Send fake cmd:"Complete" back
 			//strCmd := data.data
-			m := CmdComplete{"CompleteFake", data.id, p.portConf.Name, -1, data.data}
+			m := CmdComplete{"CompleteFake", data.id, p.name(), -1, data.data}
 			msgJson, err := json.Marshal(m)
 			if err == nil {
 				h.broadcastSys <- msgJson
@@ -353,31 +488,147 @@ func (p *serport) writerNoBuf() {
 		//log.Print(" bytes to serial: ")
 		//log.Print(data)
 		if err != nil {
-			errstr := "Error writing to " + p.portConf.Name + " " + err.Error() + " Closing port."
+			if p.autoReconnect && !p.isClosing {
+				// the reader will notice the port is gone and reconnect it.
+				// keep this writer around for when it does.
+				errstr := "Error writing to " + p.name() + " " + err.Error() + " Waiting for it to reconnect."
+				log.Print(errstr)
+				h.broadcastSys <- []byte(errstr)
+				continue
+			}
+			errstr := "Error writing to " + p.name() + " " + err.Error() + " Closing port."
 			log.Print(errstr)
 			h.broadcastSys <- []byte(errstr)
 			break
 		}
 	}
-	msgstr := "Shutting down writer on " + p.portConf.Name
+	msgstr := "Shutting down writer on " + p.name()
 	log.Println(msgstr)
 	h.broadcastSys <- []byte(msgstr)
-	p.portIo.Close()
+	p.io().Close()
+}
+
+// Ports are opened side by side. A second open of the same port waits for
+// the first one and then finds the port open.
+var portOpenLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+func lockPortOpen(portname string) *sync.Mutex {
+	key := strings.ToLower(portname)
+	portOpenLocks.Lock()
+	l, isFound := portOpenLocks.m[key]
+	if !isFound {
+		l = &sync.Mutex{}
+		portOpenLocks.m[key] = l
+	}
+	portOpenLocks.Unlock()
+	l.Lock()
+	return l
+}
+
+type OpenFailMsg struct {
+	Cmd  string // OpenFail
+	Desc string
+	Port string
+	Baud int
 }
 
-var spmutex = &sync.Mutex{}
-var spIsOpening = false
+type AlreadyOpenMsg struct {
+	Cmd        string // AlreadyOpen
+	Desc       string
+	Port       string
+	Alias      string `json:",omitempty"`
+	Baud       int
+	BufferType string
+	IsPrimary  bool
+}
+
+// openFail tells everybody, and whoever is waiting on done, that a port
+// didn't open
+func openFail(portname string, baud int, desc string, err error, done chan<- error) {
+	log.Printf("Could not open port %v. err:%v\n", portname, err)
+	b, _ := json.Marshal(OpenFailMsg{Cmd: "OpenFail", Desc: desc + err.Error(), Port: portname, Baud: baud})
+	h.broadcastSys <- b
+	if done != nil {
+		done <- err
+	}
+}
 
-func spHandlerOpen(portname string, baud int, buftype string, isSecondary bool) {
+// spHandlerOpen opens the port and then blocks in the port reader until the
+// port is closed. If done is not nil it is handed the outcome of the open,
+// i.e. nil once the port is registered or the reason we could not open it.
+// Everybody gets an Open or OpenFail event either way, or an AlreadyOpen
+// if the port was open already.
+func spHandlerOpen(portname string, baud int, buftype string, opts PortOptions, isSecondary bool, done chan<- error) {
 
 	log.Print("Inside spHandler")
 
-	if spIsOpening {
-		log.Println("We are currently in the middle of opening a port. Returning...")
+	// an alias from the config file, i.e. mill, opens whatever device it's
+	// bound to
+	portname, alias, err := resolvePortAlias(portname)
+	if err != nil {
+		openFail(portname, baud, "", err, done)
+		return
+	}
+
+	openLock := lockPortOpen(portname)
+	isLocked := true
+	defer func() {
+		if isLocked {
+			openLock.Unlock()
+		}
+	}()
+
+	// we don't want two serports on the same device
+	if myport, isOpen := findPortByName(portname); isOpen {
+		buffer := myport.BufferType
+		if len(buffer) == 0 {
+			buffer = "default"
+		}
+		desc := "is already open at " + strconv.Itoa(myport.portConf.Baud) + " baud with the " + buffer +
+			" buffer algorithm. Close it first if you want to open it with other settings."
+		msg := AlreadyOpenMsg{Cmd: "AlreadyOpen", Desc: "Port " + desc, Port: myport.name(), Alias: myport.alias,
+			Baud: myport.portConf.Baud, BufferType: myport.BufferType, IsPrimary: myport.IsPrimary}
+		b, _ := json.Marshal(msg)
+		h.broadcastSys <- b
+		if done != nil {
+			done <- errors.New("Port " + myport.name() + " " + desc)
+		}
+		return
+	}
+
+	// fill in what the client left out from the config file
+	rule := findPortRule(portname)
+	var ruleOpts PortOptions
+	if rule != nil {
+		if baud <= 0 {
+			baud = rule.Baud
+		}
+		if len(buftype) == 0 {
+			buftype = rule.BufferAlgorithm
+		}
+		ruleOpts = rule.PortOptions
+	}
+	if baud <= 0 {
+		err = errors.New("You did not specify a baud rate for port " + portname + " and there is no rule for it in the config file")
+	} else if err = opts.check(); err == nil {
+		opts = opts.withDefaults(ruleOpts)
+		err = checkEncoding(opts.Encoding, buftype)
+		if err == nil {
+			err = checkFraming(opts.FrameSettings, buftype)
+		}
+	}
+	line := opts.LineSettings
+	encoding := strings.ToLower(opts.Encoding)
+	if encoding == encodingText {
+		encoding = ""
+	}
+	if err != nil {
+		openFail(portname, baud, "", err, done)
 		return
 	}
-	spIsOpening = true
-	spmutex.Lock()
 
 	var out bytes.Buffer
 
@@ -385,7 +636,8 @@ func spHandlerOpen(portname string, baud int, buftype string, isSecondary bool)
 	out.WriteString(portname)
 	out.WriteString(" at ")
 	out.WriteString(strconv.Itoa(baud))
-	out.WriteString(" baud")
+	out.WriteString(" baud ")
+	out.WriteString(line.shortForm())
 	log.Print(out.String())
 
 	//h.broadcast <- []byte("Opened a serial port ")
@@ -407,6 +659,12 @@ func spHandlerOpen(portname string, baud int, buftype string, isSecondary bool)
 	conf.Name = portname
 	conf.RtsOn = true
 	conf.DtrOn = false
+	if rule != nil && rule.RtsOn != nil {
+		conf.RtsOn = *rule.RtsOn
+	}
+	if rule != nil && rule.DtrOn != nil {
+		conf.DtrOn = *rule.DtrOn
+	}
 
 	// Needed for Arduino serial library
 	/*
@@ -426,8 +684,10 @@ func spHandlerOpen(portname string, baud int, buftype string, isSecondary bool)
 	//mode.Parity = 0
 	//mode.StopBits = 1
 
-	// Needed for original serial library
-	sp, err := serial.OpenPort(conf)
+	// Needed for original serial library. anything but 8N1 goes through
+	// openSerialLine() which sets the rest of the line settings. virtual
+	// ports get their io from wherever they were registered.
+	sp, err := openPortIo(conf, line)
 	// Needed for Arduino serial library
 	//sp, err := serial.OpenPort(portname, mode)
 
@@ -436,46 +696,45 @@ func spHandlerOpen(portname string, baud int, buftype string, isSecondary bool)
 		//log.Fatal(err)
 		log.Print("Error opening port " + err.Error())
 		//h.broadcastSys <- []byte("Error opening port. " + err.Error())
-		h.broadcastSys <- []byte("{\"Cmd\":\"OpenFail\",\"Desc\":\"Error opening port. " + err.Error() + "\",\"Port\":\"" + conf.Name + "\",\"Baud\":" + strconv.Itoa(conf.Baud) + "}")
-
+		openFail(conf.Name, conf.Baud, "Error opening port. ", err, done)
 		return
 	}
 	log.Print("Opened port successfully")
 	//p := &serport{send: make(chan []byte, 256), portConf: conf, portIo: sp}
 	// we can go up to 500,000 lines of gcode in the buffer
-	p := &serport{sendBuffered: make(chan Cmd, 500000), sendNoBuf: make(chan Cmd), portConf: conf, portIo: sp, BufferType: buftype, IsPrimary: isPrimary, IsSecondary: isSecondary, isFeedRateOverrideOn: false}
+	p := &serport{registered: make(chan bool), sendBuffered: make(chan Cmd, 500000), sendNoBuf: make(chan Cmd), portConf: conf, portIo: sp, line: line, alias: alias, encoding: encoding, framing: opts.FrameSettings, autoReconnect: opts.AutoReconnect, BufferType: buftype, IsPrimary: isPrimary, IsSecondary: isSecondary, isFeedRateOverrideOn: false, stats: portStatsFor(portname)}
 
 	// if user asked for a buffer watcher, i.e. tinyg/grbl then attach here
 	if buftype == "tinyg_old" {
 
 		bw := &BufferflowTinyg{Name: "tinyg", parent_serport: p}
 		bw.Init()
-		bw.Port = portname
+		bw.SetPort(portname)
 		p.bufferwatcher = bw
 	} else if buftype == "tinyg" {
 
 		bw := &BufferflowTinygV2{Name: "tinyg_v2", parent_serport: p}
 		bw.Init()
-		bw.Port = portname
+		bw.SetPort(portname)
 		p.bufferwatcher = bw
 
 	} else if buftype == "tinygg2" {
 
 		bw := &BufferflowTinygG2{Name: "tinygg2", parent_serport: p}
 		bw.Init()
-		bw.Port = portname
+		bw.SetPort(portname)
 		p.bufferwatcher = bw
 	} else if buftype == "tinyg_linemode" {
 
 		bw := &BufferflowTinygPktMode{Name: "tinyg_linemode", parent_serport: p}
 		bw.Init()
-		bw.Port = portname
+		bw.SetPort(portname)
 		p.bufferwatcher = bw
 	} else if buftype == "tinyg_tidmode" {
 
 		bw := &BufferflowTinygTidMode{Name: "tinyg_tidmode", parent_serport: p}
 		bw.Init()
-		bw.Port = portname
+		bw.SetPort(portname)
 		p.bufferwatcher = bw
 
 	} else if buftype == "dummypause" {
@@ -485,7 +744,7 @@ func spHandlerOpen(portname string, baud int, buftype string, isSecondary bool)
 		// it just pauses 3 seconds on each serial port write
 		bw := &BufferflowDummypause{}
 		bw.Init()
-		bw.Port = portname
+		bw.SetPort(portname)
 		p.bufferwatcher = bw
 	} else if buftype == "timed" {
 
@@ -493,67 +752,82 @@ func spHandlerOpen(portname string, baud int, buftype string, isSecondary bool)
 		// guys did to reduce the amount of json packets coming
 		// back from the server. by adding a timer we can collect data
 		// first and then send back. we only add 16ms so it's not too bad
-		bw := &BufferflowTimed{Name: "timed", Port: portname, Output: h.broadcastSys, Input: make(chan string)}
+		bw := &BufferflowTimed{Name: "timed", Output: h.broadcastSys, Input: make(chan string), Encoding: encoding}
 		bw.Init()
-		bw.Port = portname
+		bw.SetPort(portname)
 		p.bufferwatcher = bw
 	} else if buftype == "nodemcu" {
 
 		// nodemcu buffer only sends data back per line (which might be a bad call)
 		// and it only sends 1 line at a time to the device and releases the next line
 		// when it sees a > come back
-		bw := &BufferflowNodeMcu{Name: "nodemcu", Port: portname}
+		bw := &BufferflowNodeMcu{Name: "nodemcu"}
 		bw.Init()
+		bw.SetPort(portname)
 		p.bufferwatcher = bw
 	} else if buftype == "grbl" {
 		// grbl bufferflow
 		// store port as parent_serport for use in intializing a status query loop for '?'
 		bw := &BufferflowGrbl{Name: "grbl", parent_serport: p}
 		bw.Init()
-		bw.Port = portname
+		bw.SetPort(portname)
 		p.bufferwatcher = bw
 	} else if buftype == "marlin" {
 		// marlin bufferflow
 		// store port as parent_serport for use in intializing a status query loop for '?'
 		bw := &BufferflowMarlin{Name: "marlin", parent_serport: p}
 		bw.Init()
-		bw.Port = portname
+		bw.SetPort(portname)
 		p.bufferwatcher = bw
 	} else {
 		bw := &BufferflowDefault{}
 		bw.Init()
-		bw.Port = portname
+		bw.SetPort(portname)
 		p.bufferwatcher = bw
 	}
+	if len(opts.Framing) > 0 {
+		p.framer = newFramer(opts.FrameSettings, func(frame string, readTs int64) { p.sendData(frame, readTs) })
+	}
 
 	sh.register <- p
 	defer func() { sh.unregister <- p }()
+	// wait till the port can be found by name so a send right after the
+	// open, or a second open of it, finds it
+	<-p.registered
 	// this is internally buffered thread to not send to serial port if blocked
 	go p.writerBuffered()
 	// this is thread to send to serial port regardless of block
 	go p.writerNoBuf()
+	// this tells everybody when CTS, DSR, DCD or RI change
+	go p.watchModemLines()
 	//v1.89 moved unlock here
-	spIsOpening = false
-	spmutex.Unlock()
-	p.reader()
+	openLock.Unlock()
+	isLocked = false
+	if done != nil {
+		done <- nil
+	}
+	if p.autoReconnect {
+		p.rememberDevice()
+	}
+	// if the device goes away and we're to reconnect, the reader is
+	// started back up on the new connection
+	for p.reader() && p.autoReconnect && p.reconnect() {
+	}
 	//	go p.reader()
 	//p.done = make(chan bool)
 	//<-p.done
 
-	// prior to 1.89 i had lock here.
-	//	spIsOpening = false
-	//	spmutex.Unlock()
 }
 
 func spHandlerCloseExperimental(p *serport) {
-	h.broadcastSys <- []byte("Pre-closing serial port " + p.portConf.Name)
+	h.broadcastSys <- []byte("Pre-closing serial port " + p.name())
 	p.isClosing = true
 	//close the port
 
 	p.bufferwatcher.Close()
-	p.portIo.Close()
+	p.io().Close()
 	h.broadcastSys <- []byte("Bufferwatcher closed")
-	p.portIo.Close()
+	p.io().Close()
 	//elicit response from hardware to close out p.reader()
 	//_, _ = p.portIo.Write([]byte("?"))
 	//p.portIo.Read(nil)
@@ -571,20 +845,23 @@ func spHandlerCloseExperimental(p *serport) {
 	// we already have a deferred unregister in place from when
 	// we opened. the only thing holding up that thread is the p.reader()
 	// so if we close the reader we should get an exit
-	h.broadcastSys <- []byte("Closing serial port " + p.portConf.Name)
+	h.broadcastSys <- []byte("Closing serial port " + p.name())
 }
 
 func spHandlerClose(p *serport) {
 	p.isClosing = true
 	//close the port
 	//elicit response from hardware to close out p.reader()
-	_, _ = p.portIo.Write([]byte("?"))
+	_, _ = p.io().Write([]byte("?"))
 
 	p.bufferwatcher.Close()
-	p.portIo.Close()
+	if p.framer != nil {
+		p.framer.stop()
+	}
+	p.io().Close()
 	// unregister myself
 	// we already have a deferred unregister in place from when
 	// we opened. the only thing holding up that thread is the p.reader()
 	// so if we close the reader we should get an exit
-	h.broadcastSys <- []byte("Closing serial port " + p.portConf.Name)
+	h.broadcastSys <- []byte("Closing serial port " + p.name())
 }
@@ -0,0 +1,621 @@
+// Sharing ports. share puts an open port on the network as a tcp server,
+// either raw or RFC 2217, so a tool on another machine, i.e. avrdude or a
+// Marlin EEPROM editor, can get at a device plugged into the Pi without SPJS
+// letting go of it. What the device sends goes to every network client as
+// well as the websockets. What the clients send goes in the sendnobuf way
+// as the connection that shared the port, so a claim by somebody else stops
+// it and it shows up in the Queued and Write events like anything else. The
+// share stops when that connection goes away.
+//
+// An RFC 2217 client can also change the baud, line settings and modem
+// lines. Those go through reconfigure, setdtr, setrts and sendbreak.
+//
+// There is no auth on the tcp side, so anybody who can reach it writes to
+// the port as the sharer. A share is on 127.0.0.1 unless you give a host,
+// and only an admin can share on anything else.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	shareRaw     = "raw"
+	shareRfc2217 = "rfc2217"
+)
+
+// how many reads from the device a network client can fall behind by
+// before we drop it, so one slow client can't hold up the port
+var shareClientBacklog = 256
+
+type portShare struct {
+	p        *serport
+	c        *connection // who shared it. the network clients write as them.
+	protocol string
+	ln       net.Listener
+
+	lock     sync.Mutex
+	clients  map[*shareClient]bool
+	modem    byte // the last modem state we know of, in RFC 2217 form
+	isClosed bool
+}
+
+type shareClient struct {
+	s      *portShare
+	conn   net.Conn
+	remote string
+	out    chan []byte
+	done   chan bool
+	telnet telnetStream
+
+	lock      sync.Mutex
+	modemMask byte
+	closeOnce sync.Once
+}
+
+var shares = struct {
+	sync.Mutex
+	m map[*serport]*portShare
+}{m: make(map[*serport]*portShare)}
+
+type ShareMsg struct {
+	Cmd      string // Shared or Unshared
+	Port     string
+	Addr     string
+	Protocol string
+	Desc     string
+}
+
+type ShareClientMsg struct {
+	Cmd    string // ShareConnect or ShareDisconnect
+	Port   string
+	Remote string
+}
+
+type jsonCmdShareArgs struct {
+	Port     string
+	Addr     string // i.e. 2217 or 192.168.1.5:2217. 127.0.0.1 if you leave out the host.
+	Protocol string // raw or rfc2217. raw if left out.
+}
+
+type jsonCmdUnshareArgs struct {
+	Port string
+}
+
+func spShare(c *connection, portname string, addr string, protocol string) (ShareMsg, error) {
+	var msg ShareMsg
+	myport, isFound := findPortByName(portname)
+	if !isFound {
+		return msg, errors.New("We could not find the serial port " + portname + " that you were trying to share.")
+	}
+	// the network clients write as c so c has to be allowed to
+	if err := checkLease(c, myport); err != nil {
+		return msg, err
+	}
+	protocol = strings.ToLower(protocol)
+	if len(protocol) == 0 {
+		protocol = shareRaw
+	}
+	if protocol != shareRaw && protocol != shareRfc2217 {
+		return msg, errors.New("Ports can be shared as raw or rfc2217, not " + protocol)
+	}
+	if len(addr) == 0 {
+		return msg, errors.New("You did not give an address to share port " + portname + " on, i.e. 2217 or :2217")
+	}
+	addr, isLocal, err := shareAddr(addr)
+	if err != nil {
+		return msg, err
+	}
+	if !isLocal && !isAdmin(c) {
+		return msg, errors.New("Only an admin can share a port on " + addr + ". Anybody who can reach it can write to the port. Leave out the host to share on 127.0.0.1.")
+	}
+
+	shares.Lock()
+	if s, isShared := shares.m[myport]; isShared {
+		shares.Unlock()
+		return msg, errors.New("Port " + portname + " is already shared on " + s.ln.Addr().String())
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		shares.Unlock()
+		return msg, errors.New("Could not share port " + portname + " on " + addr + ". " + err.Error())
+	}
+	s := &portShare{p: myport, c: c, protocol: protocol, ln: ln, clients: make(map[*shareClient]bool)}
+	if ml, err := myport.modemLines(); err == nil {
+		s.modem = rfc2217ModemState(ml)
+	}
+	shares.m[myport] = s
+	shares.Unlock()
+	go s.accept()
+
+	log.Printf("Sharing port %v on %v as %v\n", myport.name(), ln.Addr(), protocol)
+	if !isLocal {
+		log.Printf("Port %v is shared on %v with no auth. Anybody who can reach it can write to the port.\n", myport.name(), ln.Addr())
+	}
+	msg = ShareMsg{Cmd: "Shared", Port: myport.name(), Addr: ln.Addr().String(), Protocol: protocol,
+		Desc: "Port is shared on the network. Connect to " + ln.Addr().String() + " as " + protocol + "."}
+	b, _ := json.Marshal(msg)
+	h.broadcastSys <- b
+	return msg, nil
+}
+
+// shareAddr puts 127.0.0.1 on an address with no host, i.e. 2217 or :2217,
+// and tells us whether the address is loopback only
+func shareAddr(addr string) (string, bool, error) {
+	if _, err := strconv.Atoi(addr); err == nil {
+		addr = ":" + addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, false, errors.New("Could not make sense of the address " + addr + ". " + err.Error())
+	}
+	if len(host) == 0 {
+		host = "127.0.0.1"
+	}
+	ip := net.ParseIP(host)
+	isLocal := strings.ToLower(host) == "localhost" || (ip != nil && ip.IsLoopback())
+	return net.JoinHostPort(host, port), isLocal, nil
+}
+
+func spUnshare(c *connection, portname string) (ShareMsg, error) {
+	var msg ShareMsg
+	myport, isFound := findPortByName(portname)
+	if !isFound {
+		return msg, errors.New("We could not find the serial port " + portname + " that you were trying to unshare.")
+	}
+	if err := checkLease(c, myport); err != nil {
+		return msg, err
+	}
+	s := stopShare(myport)
+	if s == nil {
+		return msg, errors.New("Port " + portname + " is not shared")
+	}
+	return ShareMsg{Cmd: "Unshared", Port: myport.name(), Addr: s.ln.Addr().String(), Protocol: s.protocol}, nil
+}
+
+// stopShare closes the listener and the network clients of a port, if it's
+// shared, and tells everybody. It's called when the port is closed too.
+func stopShare(p *serport) *portShare {
+	shares.Lock()
+	s, isShared := shares.m[p]
+	delete(shares.m, p)
+	shares.Unlock()
+	if !isShared {
+		return nil
+	}
+	s.stop("Port is no longer shared on the network")
+	return s
+}
+
+// stopAllShares is called when a connection goes away since the network
+// clients write to the port as that connection
+func stopAllShares(c *connection) {
+	shares.Lock()
+	stopped := []*portShare{}
+	for p, s := range shares.m {
+		if s.c == c {
+			delete(shares.m, p)
+			stopped = append(stopped, s)
+		}
+	}
+	shares.Unlock()
+
+	for _, s := range stopped {
+		go s.stop("Port is no longer shared on the network because the client that shared it disconnected")
+	}
+}
+
+func (s *portShare) stop(desc string) {
+	s.lock.Lock()
+	s.isClosed = true
+	s.lock.Unlock()
+	s.ln.Close()
+	for _, sc := range s.clientList() {
+		sc.close()
+	}
+	log.Printf("Stopped sharing port %v on %v\n", s.p.name(), s.ln.Addr())
+
+	msg := ShareMsg{Cmd: "Unshared", Port: s.p.name(), Addr: s.ln.Addr().String(), Protocol: s.protocol,
+		Desc: desc}
+	b, _ := json.Marshal(msg)
+	h.broadcastSys <- b
+}
+
+func findShare(p *serport) *portShare {
+	shares.Lock()
+	defer shares.Unlock()
+	return shares.m[p]
+}
+
+func (s *portShare) clientList() []*shareClient {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list := []*shareClient{}
+	for sc := range s.clients {
+		list = append(list, sc)
+	}
+	return list
+}
+
+func (s *portShare) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			s.lock.Lock()
+			isClosed := s.isClosed
+			s.lock.Unlock()
+			if isClosed {
+				return
+			}
+			log.Printf("Error accepting a network client on port %v. err:%v\n", s.p.name(), err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		sc := &shareClient{s: s, conn: conn, remote: conn.RemoteAddr().String(),
+			out: make(chan []byte, shareClientBacklog), done: make(chan bool), modemMask: 0xff}
+		sc.telnet = telnetStream{onNegotiate: sc.onNegotiate, onSubnegotiation: sc.onSubnegotiation}
+		s.lock.Lock()
+		if s.isClosed {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.clients[sc] = true
+		s.lock.Unlock()
+
+		log.Printf("Network client %v connected to port %v\n", sc.remote, s.p.name())
+		b, _ := json.Marshal(ShareClientMsg{Cmd: "ShareConnect", Port: s.p.name(), Remote: sc.remote})
+		h.broadcastSys <- b
+
+		go sc.writer()
+		if s.protocol == shareRfc2217 {
+			sc.queue([]byte{
+				telnetIAC, telnetDO, telnetComPort,
+				telnetIAC, telnetWILL, telnetBinary, telnetIAC, telnetDO, telnetBinary,
+				telnetIAC, telnetWILL, telnetSGA, telnetIAC, telnetDO, telnetSGA,
+			})
+		}
+		go sc.reader()
+	}
+}
+
+// shareData hands what the device sent to the network clients of a port.
+// The reader calls it for every read.
+func shareData(p *serport, data []byte) {
+	s := findShare(p)
+	if s == nil {
+		return
+	}
+	// the reader reuses its buffer so we need our own copy
+	b := append([]byte{}, data...)
+	if s.protocol == shareRfc2217 {
+		b = telnetEscape(b)
+	}
+	for _, sc := range s.clientList() {
+		sc.queue(b)
+	}
+}
+
+// shareModemLines tells the RFC 2217 clients of a port that its modem lines
+// changed. The modem line watcher calls it.
+func shareModemLines(p *serport, ml ModemLines) {
+	s := findShare(p)
+	if s == nil {
+		return
+	}
+	state := rfc2217ModemState(ml)
+	s.lock.Lock()
+	delta := s.modem ^ state
+	s.modem = state
+	s.lock.Unlock()
+	if s.protocol != shareRfc2217 || delta == 0 {
+		return
+	}
+	// the low bits say which lines changed
+	state |= (delta >> 4) & 0x0f
+	for _, sc := range s.clientList() {
+		sc.notifyModemState(state)
+	}
+}
+
+// rfc2217ModemState puts the lines the device drives into the form of an
+// RFC 2217 NOTIFY-MODEMSTATE
+func rfc2217ModemState(ml ModemLines) byte {
+	var state byte
+	if ml.Cts {
+		state |= 0x10
+	}
+	if ml.Dsr {
+		state |= 0x20
+	}
+	if ml.Ri {
+		state |= 0x40
+	}
+	if ml.Dcd {
+		state |= 0x80
+	}
+	return state
+}
+
+// queue hands b to the writer. A client that has fallen too far behind is
+// dropped.
+func (sc *shareClient) queue(b []byte) {
+	select {
+	case sc.out <- b:
+	case <-sc.done:
+	default:
+		log.Printf("Network client %v fell too far behind on port %v. Dropping it.\n", sc.remote, sc.s.p.name())
+		go sc.close()
+	}
+}
+
+func (sc *shareClient) writer() {
+	for {
+		select {
+		case b := <-sc.out:
+			if _, err := sc.conn.Write(b); err != nil {
+				sc.close()
+				return
+			}
+		case <-sc.done:
+			return
+		}
+	}
+}
+
+// reader puts what the client sends onto the port
+func (sc *shareClient) reader() {
+	portname := sc.s.p.name()
+	buf := make([]byte, 1024)
+	data := make([]byte, 1024)
+	for {
+		n, err := sc.conn.Read(buf)
+		d := buf[:n]
+		if sc.s.protocol == shareRfc2217 {
+			d = data[:sc.telnet.decode(buf[:n], data)]
+		}
+		if len(d) > 0 {
+			if err := spWritePort(sc.s.c, portname, string(d), false); err != nil {
+				spErr("Dropped what network client " + sc.remote + " sent to port " + portname + ". " + err.Error())
+			}
+		}
+		if err != nil {
+			sc.close()
+			return
+		}
+	}
+}
+
+func (sc *shareClient) close() {
+	sc.closeOnce.Do(func() {
+		close(sc.done)
+		sc.conn.Close()
+		sc.s.lock.Lock()
+		delete(sc.s.clients, sc)
+		sc.s.lock.Unlock()
+
+		log.Printf("Network client %v disconnected from port %v\n", sc.remote, sc.s.p.name())
+		b, _ := json.Marshal(ShareClientMsg{Cmd: "ShareDisconnect", Port: sc.s.p.name(), Remote: sc.remote})
+		h.broadcastSys <- b
+	})
+}
+
+// onNegotiate answers the client. Like when we're the client we'll do
+// binary, suppress go ahead and COM-PORT-OPTION and nothing else.
+func (sc *shareClient) onNegotiate(verb byte, option byte) {
+	isOurs := option == telnetBinary || option == telnetSGA || option == telnetComPort
+	switch {
+	case verb == telnetDO && !isOurs:
+		sc.queue([]byte{telnetIAC, telnetWONT, option})
+	case verb == telnetWILL && !isOurs:
+		sc.queue([]byte{telnetIAC, telnetDONT, option})
+	}
+}
+
+// sendCommand answers a COM-PORT-OPTION command
+func (sc *shareClient) sendCommand(cmd byte, val ...byte) {
+	b := []byte{telnetIAC, telnetSB, telnetComPort, cmd + rfc2217ServerOffset}
+	b = append(b, telnetEscape(val)...)
+	sc.queue(append(b, telnetIAC, telnetSE))
+}
+
+func (sc *shareClient) notifyModemState(state byte) {
+	sc.lock.Lock()
+	mask := sc.modemMask
+	sc.lock.Unlock()
+	sc.sendCommand(rfc2217NotifyModemState, state&mask)
+}
+
+// onSubnegotiation does what the client asks of the port and answers with
+// how the port is now, which is how it finds out we couldn't do something
+func (sc *shareClient) onSubnegotiation(sb []byte) {
+	if len(sb) < 2 || sb[0] != telnetComPort {
+		return
+	}
+	cmd, val := sb[1], sb[2:]
+	p := sc.s.p
+
+	// a value of 0 asks how it is without changing it
+	isSet := len(val) > 0 && val[0] != 0
+
+	switch cmd {
+	case rfc2217Signature:
+		if len(val) == 0 {
+			sc.sendCommand(cmd, []byte("Serial Port JSON Server "+version)...)
+		}
+	case rfc2217SetBaud:
+		if len(val) < 4 {
+			return
+		}
+		if baud := int(binary.BigEndian.Uint32(val)); baud > 0 {
+			sc.reconfigure(baud, LineSettings{})
+		}
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(p.portConf.Baud))
+		sc.sendCommand(cmd, b...)
+	case rfc2217SetDataSize:
+		if isSet {
+			sc.reconfigure(0, LineSettings{DataBits: int(val[0])})
+		}
+		sc.sendCommand(cmd, byte(sc.line().DataBits))
+	case rfc2217SetParity:
+		if isSet {
+			for parity, v := range rfc2217Parities {
+				if v == val[0] {
+					sc.reconfigure(0, LineSettings{Parity: parity})
+				}
+			}
+		}
+		sc.sendCommand(cmd, rfc2217Parities[sc.line().Parity])
+	case rfc2217SetStopSize:
+		if isSet {
+			for stop, v := range rfc2217StopSizes {
+				if v == val[0] {
+					sc.reconfigure(0, LineSettings{StopBits: stop})
+				}
+			}
+		}
+		sc.sendCommand(cmd, rfc2217StopSizes[sc.line().StopBits])
+	case rfc2217SetControl:
+		if len(val) > 0 {
+			sc.sendCommand(cmd, sc.control(val[0]))
+		}
+	case rfc2217NotifyModemState:
+		sc.s.lock.Lock()
+		state := sc.s.modem
+		sc.s.lock.Unlock()
+		sc.notifyModemState(state)
+	case rfc2217SetModemMask:
+		if len(val) > 0 {
+			sc.lock.Lock()
+			sc.modemMask = val[0]
+			sc.lock.Unlock()
+			sc.sendCommand(cmd, val[0])
+		}
+	case rfc2217SetLineMask, rfc2217PurgeData:
+		// we don't send line state and the queue is ours, so just say ok
+		if len(val) > 0 {
+			sc.sendCommand(cmd, val[0])
+		}
+	}
+}
+
+// reconfigure changes the port if it isn't that way already. Clients send
+// the whole line when they connect and we don't want a Reconfigured event
+// for every part of it.
+func (sc *shareClient) reconfigure(baud int, ls LineSettings) {
+	p := sc.s.p
+	if (baud <= 0 || baud == p.portConf.Baud) && ls.withDefaults(sc.line()) == sc.line() {
+		return
+	}
+	if _, err := spReconfigure(sc.s.c, p.name(), baud, ls); err != nil {
+		spErr("Network client " + sc.remote + " could not reconfigure port " + p.name() + ". " + err.Error())
+	}
+}
+
+func (sc *shareClient) line() LineSettings {
+	return sc.s.p.line.withDefaults(LineSettings{})
+}
+
+// control does a SET-CONTROL and gives back the answer
+func (sc *shareClient) control(val byte) byte {
+	p := sc.s.p
+	portname := p.name()
+	onOff := func(isOn bool, on byte, off byte) byte {
+		if isOn {
+			return on
+		}
+		return off
+	}
+	setLine := func(line string, on bool) {
+		if err := spSetModemLine(sc.s.c, portname, line, on); err != nil {
+			spErr("Network client " + sc.remote + " could not set " + strings.ToUpper(line) + " on port " + portname + ". " + err.Error())
+		}
+	}
+
+	switch val {
+	case rfc2217FlowNone, rfc2217FlowXonXoff, rfc2217FlowRtsCts:
+		flow := map[byte]string{rfc2217FlowNone: flowNone, rfc2217FlowXonXoff: flowXonXoff, rfc2217FlowRtsCts: flowRtsCts}[val]
+		sc.reconfigure(0, LineSettings{FlowControl: flow})
+		return rfc2217Flow(sc.line().FlowControl)
+	case rfc2217FlowQuery:
+		return rfc2217Flow(sc.line().FlowControl)
+	case rfc2217BreakOn:
+		// we can only send a break of a set length, so that's what we do
+		go func() {
+			if err := spSendBreak(sc.s.c, portname, defaultBreak); err != nil {
+				spErr("Network client " + sc.remote + " could not send a break on port " + portname + ". " + err.Error())
+			}
+		}()
+		return rfc2217BreakOn
+	case rfc2217BreakOff, rfc2217BreakQuery:
+		return rfc2217BreakOff
+	case rfc2217DtrOn, rfc2217DtrOff:
+		setLine("dtr", val == rfc2217DtrOn)
+		return onOff(p.portConf.DtrOn, rfc2217DtrOn, rfc2217DtrOff)
+	case rfc2217DtrQuery:
+		return onOff(p.portConf.DtrOn, rfc2217DtrOn, rfc2217DtrOff)
+	case rfc2217RtsOn, rfc2217RtsOff:
+		setLine("rts", val == rfc2217RtsOn)
+		return onOff(p.portConf.RtsOn, rfc2217RtsOn, rfc2217RtsOff)
+	case rfc2217RtsQuery:
+		return onOff(p.portConf.RtsOn, rfc2217RtsOn, rfc2217RtsOff)
+	}
+	// the inbound flow control ones we leave alone
+	return val
+}
+
+// textShare handles share, i.e.
+//   share /dev/ttyACM0 2217 rfc2217
+//   share COM4 0.0.0.0:4000
+func textShare(c *connection, s string) {
+	args := strings.Fields(s)
+	if len(args) < 3 {
+		spErr("You need to give a port and an address to share it on, i.e. share /dev/ttyACM0 2217 rfc2217")
+		return
+	}
+	protocol := ""
+	if len(args) > 3 {
+		protocol = args[3]
+	}
+	if _, err := spShare(c, args[1], args[2], protocol); err != nil {
+		spErr(err.Error())
+	}
+}
+
+func textUnshare(c *connection, s string) {
+	args := strings.Fields(s)
+	if len(args) < 2 {
+		spErr("You did not give the port to stop sharing, i.e. unshare /dev/ttyACM0")
+		return
+	}
+	if _, err := spUnshare(c, args[1]); err != nil {
+		spErr(err.Error())
+	}
+}
+
+func jsonCmdShare(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdShareArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return spShare(c, a.Port, a.Addr, a.Protocol)
+}
+
+func jsonCmdUnshare(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdUnshareArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return spUnshare(c, a.Port)
+}
@@ -0,0 +1,292 @@
+// Graceful shutdown. exit and restart used to just log.Fatal, which threw
+// away whatever gcode was queued and left the ports to be closed by the OS.
+// Now we stop taking commands, deal with the queues, close every port so
+// its bufferflow stops, tell the clients, and only then exit.
+//
+// What happens to the queues depends on the mode
+//   now      - close the ports right away. anything still queued is lost.
+//   drain    - wait for the queues to empty before closing, up to a timeout
+//   feedhold - feed hold every port (! for controllers that know it) so
+//              the machine stops cleanly, then close
+//
+// A restart also saves the open ports to a file and hands it to the new
+// process with -restore so it opens them right back up.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	shutdownNow      = "now"
+	shutdownDrain    = "drain"
+	shutdownFeedHold = "feedhold"
+)
+
+// how long drain waits on the queues if you don't say
+var defaultDrainTimeout = 60 * time.Second
+
+// set once we start shutting down. only touched with sync/atomic.
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+var errShuttingDown = errors.New("SPJS is shutting down and is not taking commands")
+
+type ShutdownMsg struct {
+	Cmd       string // ShuttingDown
+	Mode      string
+	IsRestart bool
+	Desc      string
+}
+
+// savedPort is what a restart remembers about an open port
+type savedPort struct {
+	Name        string
+	Baud        int
+	BufferType  string
+	IsPrimary   bool
+	IsSecondary bool
+	PortOptions
+}
+
+type jsonCmdShutdownArgs struct {
+	Mode    string // now, drain or feedhold. now if left out.
+	Timeout int    // seconds to wait on drain
+}
+
+// shutdown takes SPJS down cleanly and never returns
+func shutdown(mode string, drainTimeout time.Duration, isRestart bool) {
+	if !atomic.CompareAndSwapInt32(&shuttingDown, 0, 1) {
+		log.Println("Already shutting down")
+		return
+	}
+	if len(mode) == 0 {
+		mode = shutdownNow
+	}
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+
+	log.Printf("Shutting down. mode:%v, restart:%v\n", mode, isRestart)
+	b, _ := json.Marshal(ShutdownMsg{Cmd: "ShuttingDown", Mode: mode, IsRestart: isRestart, Desc: "SPJS is shutting down and is no longer taking commands."})
+	h.broadcastSys <- b
+	if isRestart {
+		h.broadcastSys <- []byte("{\"Restarting\" : true}")
+	} else {
+		h.broadcastSys <- []byte("{\"Exiting\" : true}")
+	}
+
+	// hotplug, a reconnect or a client can still close a port while we
+	// work, so go off a snapshot
+	ports := sh.portList()
+
+	switch mode {
+	case shutdownDrain:
+		drainPorts(ports, drainTimeout)
+	case shutdownFeedHold:
+		feedHoldPorts(ports)
+	}
+
+	statePath := ""
+	if isRestart {
+		var err error
+		statePath, err = savePortState(ports)
+		if err != nil {
+			log.Printf("Could not save the open ports for the restart. err:%v\n", err)
+			h.broadcastSys <- []byte("{\"Error\" : \"Could not save the open ports for the restart. " + err.Error() + "\"}")
+		}
+	}
+
+	closeAllPorts(ports)
+
+	if isRestart {
+		launchSelf(statePath)
+	}
+
+	// give the hub a moment to get the last messages out to the clients
+	time.Sleep(500 * time.Millisecond)
+	log.Println("Done shutting down")
+	os.Exit(0)
+}
+
+// drainPorts waits for the queues to empty
+func drainPorts(ports []*serport, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		queued := 0
+		for _, p := range ports {
+			if p.itemsInBuffer > 0 {
+				queued += p.itemsInBuffer
+			}
+		}
+		if queued == 0 {
+			return
+		}
+		log.Printf("Waiting on %v queued items to drain\n", queued)
+		time.Sleep(250 * time.Millisecond)
+	}
+	log.Println("Timed out waiting for the queues to drain")
+	h.broadcastSys <- []byte("{\"Error\" : \"Timed out waiting for the queues to drain. Closing ports anyway.\"}")
+}
+
+// feedHoldPorts sends a feed hold to the controllers that understand one and
+// pauses the queue of everything else
+func feedHoldPorts(ports []*serport) {
+	for _, p := range ports {
+		if p.bufferwatcher.SeeIfSpecificCommandsShouldPauseBuffer("!") {
+			log.Printf("Sending feed hold to %v\n", p.name())
+			spWritePort(nil, p.name(), "!", true)
+		} else {
+			p.bufferwatcher.SetManualPaused(true)
+			p.bufferwatcher.Pause()
+		}
+	}
+	// let the writers get the ! out before we close
+	time.Sleep(500 * time.Millisecond)
+}
+
+// closeAllPorts closes the ports and waits for them to unregister
+func closeAllPorts(ports []*serport) {
+	for _, p := range ports {
+		spHandlerClose(p)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for len(sh.portList()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func savePortState(ports []*serport) (string, error) {
+	saved := []savedPort{}
+	for _, p := range ports {
+		sp := savedPort{Name: p.name(), Baud: p.portConf.Baud, BufferType: p.BufferType, IsPrimary: p.IsPrimary, IsSecondary: p.IsSecondary, PortOptions: PortOptions{LineSettings: p.line, FrameSettings: p.framing, AutoReconnect: p.autoReconnect, Encoding: p.encoding}}
+		// the primary port goes first so it comes back as the primary
+		if p.IsPrimary {
+			saved = append([]savedPort{sp}, saved...)
+		} else {
+			saved = append(saved, sp)
+		}
+	}
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(os.TempDir(), "spjs-restore-"+strconv.Itoa(os.Getpid())+".json")
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return "", err
+	}
+	log.Printf("Saved %v open ports to %v\n", len(saved), path)
+	return path, nil
+}
+
+// restorePorts opens the ports the process before a restart had open. The
+// file is removed once it's read.
+func restorePorts(path string) {
+	b, err := ioutil.ReadFile(path)
+	os.Remove(path)
+	if err != nil {
+		log.Printf("Could not read the ports to restore. err:%v\n", err)
+		return
+	}
+	var saved []savedPort
+	if err := json.Unmarshal(b, &saved); err != nil {
+		log.Printf("Could not decode the ports to restore. err:%v\n", err)
+		return
+	}
+	for _, sp := range saved {
+		log.Printf("Reopening port %v from before the restart\n", sp.Name)
+		done := make(chan error, 1)
+		go spHandlerOpen(sp.Name, sp.Baud, sp.BufferType, sp.PortOptions, sp.IsSecondary, done)
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Printf("Could not reopen port %v. err:%v\n", sp.Name, err)
+			}
+		case <-time.After(jsonCmdOpenTimeout):
+			log.Printf("Timed out reopening port %v\n", sp.Name)
+		}
+	}
+}
+
+// parseShutdownArgs parses the text versions of exit and restart, i.e.
+//   exit drain timeout:120
+func parseShutdownArgs(s string) (string, time.Duration, error) {
+	mode := shutdownNow
+	timeout := 0
+	for _, arg := range strings.Fields(s)[1:] {
+		al := strings.ToLower(arg)
+		if strings.HasPrefix(al, "timeout:") {
+			secs, err := strconv.Atoi(strings.TrimPrefix(al, "timeout:"))
+			if err != nil {
+				return "", 0, errors.New("Problem converting timeout " + arg)
+			}
+			timeout = secs
+		} else {
+			mode = al
+		}
+	}
+	if err := checkShutdownMode(mode); err != nil {
+		return "", 0, err
+	}
+	return mode, time.Duration(timeout) * time.Second, nil
+}
+
+func checkShutdownMode(mode string) error {
+	switch mode {
+	case "", shutdownNow, shutdownDrain, shutdownFeedHold:
+		return nil
+	}
+	return errors.New("The shutdown mode must be now, drain or feedhold")
+}
+
+func spShutdownCmd(s string, isRestart bool) {
+	mode, timeout, err := parseShutdownArgs(s)
+	if err != nil {
+		spErr(err.Error())
+		return
+	}
+	shutdown(mode, timeout, isRestart)
+}
+
+func jsonCmdShutdown(args json.RawMessage, isRestart bool) (interface{}, error) {
+	var a jsonCmdShutdownArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	mode := strings.ToLower(a.Mode)
+	if err := checkShutdownMode(mode); err != nil {
+		return nil, err
+	}
+	// we never come back from shutdown() so reply first
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		shutdown(mode, time.Duration(a.Timeout)*time.Second, isRestart)
+	}()
+	return nil, nil
+}
+
+// watchShutdownSignal shuts down cleanly on ctrl-c or a kill
+func watchShutdownSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	sig := <-ch
+	// a second ctrl-c kills us the old fashioned way
+	signal.Stop(ch)
+	log.Printf("Got signal %v. Shutting down.\n", sig)
+	shutdown(shutdownNow, 0, false)
+}
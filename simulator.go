@@ -0,0 +1,424 @@
+// Simulators. opensim opens a make believe Grbl, Marlin or TinyG as a port
+// so the buffer algorithms can be tried end to end without a board. Each one
+// has an rx buffer of so many bytes, which anything sent past it overflows
+// just like the real thing, and takes so long to work through each line
+// before it answers it. Both can be set when you open it, so you can see
+// what a buffer algorithm does with a slow machine or a small buffer.
+//
+// The characters a controller acts on the moment they arrive, like ? and !
+// on Grbl, skip the rx buffer like they do on the real thing. Dropping and
+// raising DTR resets the Arduino based ones just like a real Arduino.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johnlauer/goserial"
+)
+
+const deviceClassSimulator = "simulator"
+
+// what realtime() says a character was
+const (
+	simNotRealtime = iota
+	simRealtime
+	simFlush // also empties the rx buffer, i.e. a reset
+)
+
+// simDevice is the firmware side of a simulator. simPort holds the lock
+// while it calls any of these.
+type simDevice interface {
+	// reset puts the device back the way it powers up and gives back its
+	// banner
+	reset() string
+	// realtime looks at each character as it arrives and handles it right
+	// away if it's one the firmware acts on outside the rx buffer
+	realtime(c byte, rxFree int) (string, int)
+	// line handles a line once the device has worked through it
+	line(s string, rxFree int) string
+	// isHeld is true while the device isn't taking lines out of its rx
+	// buffer, i.e. in a feedhold
+	isHeld() bool
+	// resetsOnDtr is true for boards that reset when DTR comes on, which
+	// is every Arduino
+	resetsOnDtr() bool
+}
+
+type simType struct {
+	newDevice       func() simDevice
+	BufferAlgorithm string
+	RxBuffer        int // bytes
+	Latency         int // ms
+	Baud            int
+}
+
+var simComment = regexp.MustCompile("\\(.*?\\)|;.*")
+
+var simTypes = map[string]simType{
+	"grbl":   {newDevice: newSimGrbl, BufferAlgorithm: "grbl", RxBuffer: 128, Latency: 5, Baud: 115200},
+	"marlin": {newDevice: newSimMarlin, BufferAlgorithm: "marlin", RxBuffer: 128, Latency: 10, Baud: 250000},
+	"tinyg":  {newDevice: newSimTinyg, BufferAlgorithm: "tinyg", RxBuffer: 254, Latency: 5, Baud: 115200},
+}
+
+type SimulatorMsg struct {
+	Cmd             string // OpenSim
+	Port            string
+	Type            string
+	BufferAlgorithm string
+	RxBuffer        int
+	Latency         int
+	DeviceClass     string
+}
+
+type SimOverflowMsg struct {
+	Cmd     string // SimOverflow
+	Port    string
+	Dropped int
+	Total   int64
+	Desc    string
+}
+
+type jsonCmdOpenSimArgs struct {
+	Type            string // grbl, marlin or tinyg
+	Port            string // leave out for sim plus the type, i.e. simgrbl
+	BufferAlgorithm string // leave out for the one that goes with the type
+	RxBuffer        int    // bytes. leave out for what the real one has.
+	Latency         int    // ms per line. leave out for the default of the type.
+}
+
+// simPort is the port io of a simulator
+type simPort struct {
+	name    string
+	dev     simDevice
+	rxSize  int
+	latency time.Duration
+
+	lock     sync.Mutex
+	rx       []byte
+	dtr, rts bool
+
+	// what the device sends back, which Read hands out
+	outLock  sync.Mutex
+	outReady *sync.Cond
+	out      bytes.Buffer
+
+	wake      chan bool
+	done      chan bool
+	closeOnce sync.Once
+	isClosed  bool
+	overflows int64
+}
+
+func newSimPort(name string, dev simDevice, rxSize int, latency time.Duration, conf *serial.Config) *simPort {
+	p := &simPort{name: name, dev: dev, rxSize: rxSize, latency: latency,
+		dtr: conf.DtrOn, rts: conf.RtsOn, wake: make(chan bool, 1), done: make(chan bool)}
+	p.outReady = sync.NewCond(&p.outLock)
+	p.reply(dev.reset())
+	go p.run()
+	return p
+}
+
+// run works through the rx buffer a line at a time. It also looks every so
+// often since a device can stop being held on its own, i.e. once its planner
+// has room again.
+func (p *simPort) run() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.wake:
+		case <-time.After(10 * time.Millisecond):
+		}
+		for {
+			p.lock.Lock()
+			isReady := bytes.IndexByte(p.rx, '\n') >= 0 && !p.dev.isHeld()
+			p.lock.Unlock()
+			if !isReady {
+				break
+			}
+
+			// the device working on the line
+			time.Sleep(p.latency)
+
+			p.lock.Lock()
+			// a reset or a hold may have come in while we slept
+			i := bytes.IndexByte(p.rx, '\n')
+			if i < 0 || p.dev.isHeld() {
+				p.lock.Unlock()
+				break
+			}
+			line := strings.TrimRight(string(p.rx[:i]), "\r")
+			p.rx = append(p.rx[:0], p.rx[i+1:]...)
+			reply := p.dev.line(line, p.rxSize-len(p.rx))
+			p.lock.Unlock()
+			p.reply(reply)
+		}
+	}
+}
+
+func (p *simPort) wakeUp() {
+	select {
+	case p.wake <- true:
+	default:
+	}
+}
+
+func (p *simPort) reply(s string) {
+	if len(s) == 0 {
+		return
+	}
+	p.outLock.Lock()
+	p.out.WriteString(s)
+	p.outLock.Unlock()
+	p.outReady.Signal()
+}
+
+func (p *simPort) Read(b []byte) (int, error) {
+	p.outLock.Lock()
+	defer p.outLock.Unlock()
+	for p.out.Len() == 0 && !p.isClosed {
+		p.outReady.Wait()
+	}
+	if p.isClosed {
+		return 0, io.EOF
+	}
+	return p.out.Read(b)
+}
+
+func (p *simPort) Write(b []byte) (int, error) {
+	select {
+	case <-p.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	var replies bytes.Buffer
+	dropped := 0
+	p.lock.Lock()
+	for _, c := range b {
+		reply, kind := p.dev.realtime(c, p.rxSize-len(p.rx))
+		switch kind {
+		case simFlush:
+			p.rx = p.rx[:0]
+			replies.WriteString(reply)
+		case simRealtime:
+			replies.WriteString(reply)
+		default:
+			if len(p.rx) >= p.rxSize {
+				dropped++
+				continue
+			}
+			p.rx = append(p.rx, c)
+		}
+	}
+	p.lock.Unlock()
+
+	p.reply(replies.String())
+	if dropped > 0 {
+		p.overflowed(dropped)
+	}
+	p.wakeUp()
+	return len(b), nil
+}
+
+// overflowed tells everybody the rx buffer overflowed, which on a real
+// controller means a mangled line and is the thing buffer algorithms are
+// there to stop
+func (p *simPort) overflowed(dropped int) {
+	total := atomic.AddInt64(&p.overflows, int64(dropped))
+	log.Printf("Simulator %v overflowed its rx buffer of %v bytes and dropped %v bytes\n", p.name, p.rxSize, dropped)
+	b, _ := json.Marshal(SimOverflowMsg{Cmd: "SimOverflow", Port: p.name, Dropped: dropped, Total: total,
+		Desc: "The simulated rx buffer of " + strconv.Itoa(p.rxSize) + " bytes overflowed. A real controller would have got a mangled line."})
+	h.broadcastSys <- b
+}
+
+func (p *simPort) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.outLock.Lock()
+		p.isClosed = true
+		p.outLock.Unlock()
+		p.outReady.Broadcast()
+	})
+	return nil
+}
+
+// SetDTR resets Arduino based devices when DTR comes on, like the real ones
+func (p *simPort) SetDTR(on bool) error {
+	p.lock.Lock()
+	isReset := on && !p.dtr && p.dev.resetsOnDtr()
+	p.dtr = on
+	reply := ""
+	if isReset {
+		p.rx = p.rx[:0]
+		reply = p.dev.reset()
+	}
+	p.lock.Unlock()
+	p.reply(reply)
+	return nil
+}
+
+func (p *simPort) SetRTS(on bool) error {
+	p.lock.Lock()
+	p.rts = on
+	p.lock.Unlock()
+	return nil
+}
+
+func (p *simPort) SendBreak(d time.Duration) error {
+	time.Sleep(d)
+	return nil
+}
+
+func (p *simPort) ModemLines() (ModemLines, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return ModemLines{Dtr: p.dtr, Rts: p.rts, Cts: true, Dsr: true}, nil
+}
+
+// Reconfigure is a no-op. The simulators don't care about the baud.
+func (p *simPort) Reconfigure(baud int, ls LineSettings) error {
+	return nil
+}
+
+// simWords splits a line of gcode into its words, i.e. G1 X10 F200, after
+// taking out comments and spaces
+func simWords(line string) (map[byte]float64, error) {
+	words := make(map[byte]float64)
+	line = simComment.ReplaceAllString(line, "")
+	line = strings.ToUpper(strings.Replace(line, " ", "", -1))
+	for i := 0; i < len(line); {
+		c := line[i]
+		if c < 'A' || c > 'Z' {
+			return words, errors.New("expected a letter")
+		}
+		j := i + 1
+		for j < len(line) && (line[j] == '.' || line[j] == '-' || line[j] == '+' || (line[j] >= '0' && line[j] <= '9')) {
+			j++
+		}
+		val, err := strconv.ParseFloat(line[i+1:j], 64)
+		if err != nil {
+			return words, errors.New("bad number")
+		}
+		// only the first G or M counts, which is plenty for a simulator
+		if _, isFound := words[c]; !isFound {
+			words[c] = val
+		}
+		i = j
+	}
+	return words, nil
+}
+
+// simMove updates pos from the axis words of a move
+func simMove(pos map[byte]float64, words map[byte]float64, isRelative bool) {
+	for axis := range pos {
+		if val, isFound := words[axis]; isFound {
+			if isRelative {
+				pos[axis] += val
+			} else {
+				pos[axis] = val
+			}
+		}
+	}
+}
+
+func simLines(lines ...string) string {
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func spOpenSim(simtype string, portname string, buftype string, rxBuffer int, latency int) (SimulatorMsg, error) {
+	var msg SimulatorMsg
+	simtype = strings.ToLower(simtype)
+	st, isFound := simTypes[simtype]
+	if !isFound {
+		return msg, errors.New("There is no simulator for " + simtype + ". Try grbl, marlin or tinyg.")
+	}
+	if len(portname) == 0 {
+		portname = "sim" + simtype
+	}
+	if _, isFound := findPortByName(portname); isFound {
+		return msg, errors.New("There is already a port open called " + portname)
+	}
+	if len(buftype) == 0 {
+		buftype = st.BufferAlgorithm
+	}
+	if rxBuffer <= 0 {
+		rxBuffer = st.RxBuffer
+	}
+	if latency < 0 {
+		latency = st.Latency
+	}
+
+	vp := &virtualPort{Name: portname, DeviceClass: deviceClassSimulator,
+		Friendly: "Simulated " + simtype + " " + portname}
+	vp.open = func(conf *serial.Config, ls LineSettings) (io.ReadWriteCloser, error) {
+		return newSimPort(portname, st.newDevice(), rxBuffer, time.Duration(latency)*time.Millisecond, conf), nil
+	}
+	if err := registerVirtualPort(vp); err != nil {
+		return msg, err
+	}
+	if err := openRegistered(vp, st.Baud, buftype); err != nil {
+		return msg, err
+	}
+	log.Printf("Opened simulated %v as %v with an rx buffer of %v bytes and %vms per line\n", simtype, portname, rxBuffer, latency)
+
+	msg = SimulatorMsg{Cmd: "OpenSim", Port: portname, Type: simtype, BufferAlgorithm: buftype,
+		RxBuffer: rxBuffer, Latency: latency, DeviceClass: deviceClassSimulator}
+	b, _ := json.Marshal(msg)
+	h.broadcastSys <- b
+	return msg, nil
+}
+
+// textOpenSim handles opensim. After the type, a buffer algorithm is taken
+// as one, the first number is the rx buffer, the second is the latency and
+// anything else is the name, i.e.
+//   opensim grbl
+//   opensim tinyg bigtinyg tinyg_linemode 1024 20
+func textOpenSim(c *connection, s string) {
+	args := strings.Fields(s)
+	if len(args) < 2 {
+		spErr("You did not say which simulator to open. Try grbl, marlin or tinyg.")
+		return
+	}
+	name, buftype := "", ""
+	nums := []int{}
+	for _, arg := range args[2:] {
+		if n, err := strconv.Atoi(arg); err == nil {
+			nums = append(nums, n)
+		} else if isBufferAlgorithm(arg) {
+			buftype = arg
+		} else {
+			name = arg
+		}
+	}
+	rxBuffer, latency := 0, -1
+	if len(nums) > 0 {
+		rxBuffer = nums[0]
+	}
+	if len(nums) > 1 {
+		latency = nums[1]
+	}
+	if _, err := spOpenSim(args[1], name, buftype, rxBuffer, latency); err != nil {
+		spErr(err.Error())
+	}
+}
+
+func jsonCmdOpenSim(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdOpenSimArgs
+	a.Latency = -1
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return spOpenSim(a.Type, a.Port, a.BufferAlgorithm, a.RxBuffer, a.Latency)
+}
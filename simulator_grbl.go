@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// simGrbl acts like Grbl 1.1f on an Arduino Uno
+type simGrbl struct {
+	pos        map[byte]float64
+	isRelative bool
+	held       bool
+	lastMove   time.Time
+	settings   map[string]string
+}
+
+func newSimGrbl() simDevice {
+	return &simGrbl{}
+}
+
+func (g *simGrbl) reset() string {
+	g.pos = map[byte]float64{'X': 0, 'Y': 0, 'Z': 0}
+	g.isRelative = false
+	g.held = false
+	if g.settings == nil {
+		g.settings = map[string]string{"0": "10", "1": "25", "2": "0", "3": "0", "10": "1", "11": "0.010",
+			"12": "0.002", "13": "0", "20": "0", "21": "0", "22": "0", "100": "250.000", "101": "250.000",
+			"102": "250.000", "110": "500.000", "111": "500.000", "112": "500.000", "120": "10.000",
+			"121": "10.000", "122": "10.000", "130": "200.000", "131": "200.000", "132": "200.000"}
+	}
+	return simLines("", "Grbl 1.1f ['$' for help]")
+}
+
+func (g *simGrbl) realtime(c byte, rxFree int) (string, int) {
+	switch c {
+	case '?':
+		return g.status(rxFree), simRealtime
+	case '!':
+		g.held = true
+		return "", simRealtime
+	case '~':
+		g.held = false
+		return "", simRealtime
+	case 0x18:
+		return g.reset(), simFlush
+	}
+	return "", simNotRealtime
+}
+
+func (g *simGrbl) status(rxFree int) string {
+	state := "Idle"
+	if g.held {
+		state = "Hold:0"
+	} else if time.Since(g.lastMove) < 200*time.Millisecond {
+		state = "Run"
+	}
+	return simLines(fmt.Sprintf("<%v|MPos:%.3f,%.3f,%.3f|Bf:15,%v|FS:0,0>", state, g.pos['X'], g.pos['Y'], g.pos['Z'], rxFree))
+}
+
+func (g *simGrbl) line(s string, rxFree int) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "$") {
+		return g.system(s)
+	}
+	words, err := simWords(s)
+	if err != nil {
+		if err.Error() == "bad number" {
+			return simLines("error:2")
+		}
+		return simLines("error:1")
+	}
+	if gcode, isFound := words['G']; isFound {
+		switch gcode {
+		case 0, 1, 2, 3:
+			simMove(g.pos, words, g.isRelative)
+			g.lastMove = time.Now()
+		case 90:
+			g.isRelative = false
+		case 91:
+			g.isRelative = true
+		case 4, 10, 17, 18, 19, 20, 21, 28, 30, 38.2, 53, 54, 55, 56, 57, 58, 59, 80, 92, 93, 94:
+		default:
+			return simLines("error:20")
+		}
+	}
+	if mcode, isFound := words['M']; isFound {
+		switch mcode {
+		case 0, 1, 2, 3, 4, 5, 7, 8, 9, 30:
+		default:
+			return simLines("error:20")
+		}
+	}
+	// an empty line or a comment still gets an ok
+	return simLines("ok")
+}
+
+// system handles the $ commands
+func (g *simGrbl) system(s string) string {
+	cmd := strings.ToUpper(s)
+	switch {
+	case cmd == "$":
+		return simLines("[HLP:$$ $# $G $I $N $x=val $Nx=line $J=line $SLP $C $X $H ~ ! ? ctrl-x]", "ok")
+	case cmd == "$$":
+		lines := []string{}
+		for _, key := range []string{"0", "1", "2", "3", "10", "11", "12", "13", "20", "21", "22", "100", "101", "102", "110", "111", "112", "120", "121", "122", "130", "131", "132"} {
+			lines = append(lines, "$"+key+"="+g.settings[key])
+		}
+		return simLines(append(lines, "ok")...)
+	case cmd == "$I":
+		return simLines("[VER:1.1f.20170801:]", "[OPT:V,15,128]", "ok")
+	case cmd == "$G":
+		mode := "G90"
+		if g.isRelative {
+			mode = "G91"
+		}
+		return simLines("[GC:G0 G54 G17 G21 "+mode+" G94 M5 M9 T0 F0 S0]", "ok")
+	case cmd == "$#":
+		return simLines("[G54:0.000,0.000,0.000]", "[G28:0.000,0.000,0.000]", "[G30:0.000,0.000,0.000]", "[G92:0.000,0.000,0.000]", "[PRB:0.000,0.000,0.000:0]", "ok")
+	case cmd == "$X":
+		return simLines("[MSG:Caution: Unlocked]", "ok")
+	case cmd == "$H":
+		g.pos = map[byte]float64{'X': 0, 'Y': 0, 'Z': 0}
+		return simLines("ok")
+	case strings.HasPrefix(cmd, "$J="):
+		words, err := simWords(cmd[3:])
+		if err != nil {
+			return simLines("error:2")
+		}
+		simMove(g.pos, words, g.isRelative)
+		g.lastMove = time.Now()
+		return simLines("ok")
+	case strings.Contains(cmd, "="):
+		parts := strings.SplitN(cmd[1:], "=", 2)
+		if _, isFound := g.settings[parts[0]]; !isFound {
+			return simLines("error:3")
+		}
+		g.settings[parts[0]] = parts[1]
+		return simLines("ok")
+	}
+	return simLines("error:3")
+}
+
+func (g *simGrbl) isHeld() bool {
+	return g.held
+}
+
+func (g *simGrbl) resetsOnDtr() bool {
+	return true
+}
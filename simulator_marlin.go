@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// simMarlin acts like Marlin 1.1.9 on a RAMPS board
+type simMarlin struct {
+	pos        map[byte]float64
+	isRelative bool
+	lastLine   int
+	hotend     float64
+	bed        float64
+}
+
+func newSimMarlin() simDevice {
+	return &simMarlin{}
+}
+
+func (m *simMarlin) reset() string {
+	m.pos = map[byte]float64{'X': 0, 'Y': 0, 'Z': 0, 'E': 0}
+	m.isRelative = false
+	m.lastLine = 0
+	m.hotend, m.bed = 0, 0
+	return simLines("start", "echo:Marlin 1.1.9", "echo: Last Updated: 2018-08-01 | Author: (none, default config)",
+		"echo: Free Memory: 5142  PlannerBufferBytes: 1232", "echo:SD init fail")
+}
+
+// Marlin has nothing that skips the rx buffer
+func (m *simMarlin) realtime(c byte, rxFree int) (string, int) {
+	return "", simNotRealtime
+}
+
+func (m *simMarlin) line(s string, rxFree int) string {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return ""
+	}
+
+	// lines can come with a line number and a checksum, i.e. N10 G1 X5*85
+	if s[0] == 'N' || s[0] == 'n' {
+		if i := strings.LastIndex(s, "*"); i > 0 {
+			sum := 0
+			for _, c := range []byte(s[:i]) {
+				sum ^= int(c)
+			}
+			if want, err := strconv.Atoi(s[i+1:]); err != nil || want != sum {
+				return simLines("Error:checksum mismatch, Last Line: "+strconv.Itoa(m.lastLine), "Resend: "+strconv.Itoa(m.lastLine+1), "ok")
+			}
+			s = s[:i]
+		}
+		end := strings.IndexAny(s, " GMTgmt")
+		if end < 0 {
+			end = len(s)
+		}
+		n, err := strconv.Atoi(s[1:end])
+		if err != nil {
+			return simLines("Error:No Line Number with checksum, Last Line: "+strconv.Itoa(m.lastLine), "Resend: "+strconv.Itoa(m.lastLine+1), "ok")
+		}
+		s = strings.TrimSpace(s[end:])
+		isM110 := strings.HasPrefix(strings.ToUpper(s), "M110")
+		if n != m.lastLine+1 && !isM110 {
+			return simLines("Error:Line Number is not Last Line Number+1, Last Line: "+strconv.Itoa(m.lastLine), "Resend: "+strconv.Itoa(m.lastLine+1), "ok")
+		}
+		m.lastLine = n
+	}
+
+	words, err := simWords(s)
+	if err != nil || len(words) == 0 {
+		return simLines("echo:Unknown command: \""+s+"\"", "ok")
+	}
+	if gcode, isFound := words['G']; isFound {
+		switch gcode {
+		case 0, 1, 2, 3:
+			simMove(m.pos, words, m.isRelative)
+		case 28:
+			m.pos = map[byte]float64{'X': 0, 'Y': 0, 'Z': 0, 'E': m.pos['E']}
+		case 90:
+			m.isRelative = false
+		case 91:
+			m.isRelative = true
+		case 92:
+			simMove(m.pos, words, false)
+		case 4, 20, 21, 29:
+		default:
+			return simLines("echo:Unknown command: \""+s+"\"", "ok")
+		}
+		return simLines("ok")
+	}
+	if mcode, isFound := words['M']; isFound {
+		switch mcode {
+		case 104, 109:
+			m.hotend = words['S']
+		case 140, 190:
+			m.bed = words['S']
+		case 105:
+			return simLines(fmt.Sprintf("ok T:%.1f /%.1f B:%.1f /%.1f @:0 B@:0", m.hotend, m.hotend, m.bed, m.bed))
+		case 114:
+			return simLines(fmt.Sprintf("X:%.2f Y:%.2f Z:%.2f E:%.2f Count X:%d Y:%d Z:%d", m.pos['X'], m.pos['Y'], m.pos['Z'], m.pos['E'],
+				int(m.pos['X']*80), int(m.pos['Y']*80), int(m.pos['Z']*400)), "ok")
+		case 115:
+			return simLines("FIRMWARE_NAME:Marlin 1.1.9 (Github) SOURCE_CODE_URL:https://github.com/MarlinFirmware/Marlin PROTOCOL_VERSION:1.0 MACHINE_TYPE:3D Printer EXTRUDER_COUNT:1 UUID:cede2a2f-41a2-4748-9b12-c55c62f367ff", "ok")
+		case 110:
+			m.lastLine = int(words['N'])
+		case 82, 83, 84, 106, 107, 112, 400, 500, 501, 503:
+		default:
+			return simLines("echo:Unknown command: \""+s+"\"", "ok")
+		}
+		return simLines("ok")
+	}
+	if _, isFound := words['T']; isFound {
+		return simLines("echo:Active Extruder: 0", "ok")
+	}
+	return simLines("echo:Unknown command: \""+s+"\"", "ok")
+}
+
+func (m *simMarlin) isHeld() bool {
+	return false
+}
+
+func (m *simMarlin) resetsOnDtr() bool {
+	return true
+}
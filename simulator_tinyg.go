@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how many moves the planner holds and how long we pretend each one takes
+// to run. once the planner is full the rx buffer stops draining, which is
+// what the qr reports are there to warn about.
+const (
+	simTinygPlanner  = 28
+	simTinygMoveTime = 50 * time.Millisecond
+)
+
+// TinyG takes relaxed json, i.e. {can:t,tid:5}
+var (
+	simTinygBareKey = regexp.MustCompile(`([{,]\s*)([A-Za-z!%~][A-Za-z0-9]*)\s*:`)
+	simTinygTrue    = regexp.MustCompile(`:\s*t\s*([,}])`)
+	simTinygFalse   = regexp.MustCompile(`:\s*f\s*([,}])`)
+	simTinygNull    = regexp.MustCompile(`:\s*n\s*([,}])`)
+)
+
+// simTinyg acts like TinyG firmware 440.20 in json mode
+type simTinyg struct {
+	pos         map[byte]float64
+	isRelative  bool
+	held        bool
+	isLineStart bool
+	planned     int
+	lastRun     time.Time
+	settings    map[string]interface{}
+}
+
+func newSimTinyg() simDevice {
+	return &simTinyg{}
+}
+
+func (t *simTinyg) reset() string {
+	t.pos = map[byte]float64{'X': 0, 'Y': 0, 'Z': 0, 'A': 0}
+	t.isRelative = false
+	t.held = false
+	t.isLineStart = true
+	t.planned = 0
+	// json numbers come in as float64 so keep ours that way too
+	t.settings = map[string]interface{}{"qv": 1.0, "sv": 1.0, "jv": 4.0, "ec": 0.0, "ee": 0.0, "ex": 1.0}
+	r := map[string]interface{}{"fv": 0.970, "fb": 440.20, "hp": 1, "hv": 8, "id": "9H3583-PMJ", "msg": "SYSTEM READY"}
+	return t.response(r, 0, 0)
+}
+
+func (t *simTinyg) realtime(c byte, rxFree int) (string, int) {
+	wasLineStart := t.isLineStart
+	t.isLineStart = c == '\n'
+	if c == 0x18 {
+		return t.reset(), simFlush
+	}
+	if !wasLineStart {
+		return "", simNotRealtime
+	}
+	switch c {
+	case '?':
+		return t.statusReport(), simRealtime
+	case '!':
+		t.held = true
+		return t.statusReport(), simRealtime
+	case '~':
+		t.held = false
+		return t.statusReport(), simRealtime
+	case '%':
+		t.planned = 0
+		return "", simFlush
+	}
+	return "", simNotRealtime
+}
+
+// response gives back {"r":{...},"f":[1,status,bytes]} where bytes is the
+// length of the line we're answering
+func (t *simTinyg) response(r map[string]interface{}, status int, n int) string {
+	rb, _ := json.Marshal(r)
+	return "{\"r\":" + string(rb) + ",\"f\":[1," + strconv.Itoa(status) + "," + strconv.Itoa(n) + "]}\n"
+}
+
+func (t *simTinyg) statusReport() string {
+	stat := 3 // stop
+	if t.held {
+		stat = 6
+	} else if t.plannerFree() < simTinygPlanner {
+		stat = 5 // run
+	}
+	b, _ := json.Marshal(map[string]interface{}{"sr": map[string]interface{}{
+		"posx": t.pos['X'], "posy": t.pos['Y'], "posz": t.pos['Z'], "posa": t.pos['A'], "stat": stat}})
+	return string(b) + "\n"
+}
+
+// plannerFree works out how many moves have run since we last looked
+func (t *simTinyg) plannerFree() int {
+	if t.planned == 0 {
+		t.lastRun = time.Now()
+		return simTinygPlanner
+	}
+	done := int(time.Since(t.lastRun) / simTinygMoveTime)
+	if done > 0 {
+		t.lastRun = t.lastRun.Add(time.Duration(done) * simTinygMoveTime)
+		t.planned -= done
+		if t.planned < 0 {
+			t.planned = 0
+		}
+	}
+	return simTinygPlanner - t.planned
+}
+
+func (t *simTinyg) queueReport() string {
+	if t.settings["qv"] == 0.0 {
+		return ""
+	}
+	return "{\"qr\":" + strconv.Itoa(t.plannerFree()) + "}\n"
+}
+
+func (t *simTinyg) line(s string, rxFree int) string {
+	n := len(s) + 1
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") {
+		status := t.gcode(s)
+		return t.response(map[string]interface{}{}, status, n) + t.queueReport()
+	}
+
+	s = simTinygBareKey.ReplaceAllString(s, "$1\"$2\":")
+	s = simTinygTrue.ReplaceAllString(s, ":true$1")
+	s = simTinygFalse.ReplaceAllString(s, ":false$1")
+	s = simTinygNull.ReplaceAllString(s, ":null$1")
+	var req map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &req); err != nil {
+		return t.response(map[string]interface{}{"err": s}, 108, n) // json syntax error
+	}
+
+	r := map[string]interface{}{}
+	if tid, isFound := req["tid"]; isFound {
+		r["tid"] = tid
+	}
+	status := 0
+	qr := ""
+	for key, val := range req {
+		switch key {
+		case "tid":
+		case "txt", "gc":
+			txt, _ := val.(string)
+			status = t.gcode(strings.TrimSpace(txt))
+			qr = t.queueReport()
+		case "!":
+			t.held = true
+			r[key] = true
+		case "~":
+			t.held = false
+			r[key] = true
+		case "%", "can":
+			t.planned = 0
+			r[key] = true
+		case "qr":
+			r["qr"], r["qi"], r["qo"] = t.plannerFree(), 0, 0
+		case "rx":
+			r["rx"] = rxFree
+		case "sr":
+			var sr map[string]interface{}
+			json.Unmarshal([]byte(strings.TrimSpace(t.statusReport())), &sr)
+			r["sr"] = sr["sr"]
+		case "fv":
+			r[key] = 0.970
+		case "fb":
+			r[key] = 440.20
+		default:
+			// anything else is a setting. "" or null asks for it.
+			if val == nil || val == "" {
+				if cur, isFound := t.settings[key]; isFound {
+					r[key] = cur
+				} else {
+					r[key] = 0
+				}
+			} else {
+				t.settings[key] = val
+				r[key] = val
+			}
+		}
+	}
+	return t.response(r, status, n) + qr
+}
+
+// gcode runs a line of gcode and gives back the status code
+func (t *simTinyg) gcode(s string) int {
+	if len(s) == 0 || strings.HasPrefix(s, "$") {
+		return 0
+	}
+	words, err := simWords(s)
+	if err != nil {
+		return 100 // unrecognized command
+	}
+	if gcode, isFound := words['G']; isFound {
+		switch gcode {
+		case 0, 1, 2, 3:
+			t.plannerFree()
+			t.planned++
+			simMove(t.pos, words, t.isRelative)
+		case 90:
+			t.isRelative = false
+		case 91:
+			t.isRelative = true
+		case 28:
+			t.pos = map[byte]float64{'X': 0, 'Y': 0, 'Z': 0, 'A': 0}
+		}
+	}
+	return 0
+}
+
+// isHeld is also true while the planner is full
+func (t *simTinyg) isHeld() bool {
+	return t.held || t.plannerFree() == 0
+}
+
+func (t *simTinyg) resetsOnDtr() bool {
+	return false
+}
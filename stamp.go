@@ -0,0 +1,58 @@
+// Every json event the hub sends out gets stamped with
+//   Seq  - a global sequence number that goes up by one for every event
+//   Ts   - server wall clock time in microseconds since the unix epoch
+//   Mono - microseconds since SPJS started, from the monotonic clock, so
+//          it never jumps when the system clock gets adjusted
+// so clients can measure latency and spot events that got lost or
+// reordered. Keep in mind that a client with subscriptions will see gaps
+// in Seq for the events it didn't subscribe to. Plain text status messages
+// aren't json so they go out as is.
+
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+var serverStart = time.Now()
+
+// only touched from inside the hub goroutine
+var eventSeq int64
+
+func nowMicros() int64 {
+	return time.Now().UnixNano() / int64(time.Microsecond)
+}
+
+func monoMicros() int64 {
+	return int64(time.Since(serverStart) / time.Microsecond)
+}
+
+// stampMsg gives the next sequence number to m and, if it is a json object
+// and stamping is on, writes Seq/Ts/Mono into the front of it
+func stampMsg(m []byte) ([]byte, int64) {
+	eventSeq++
+	if !*isStamp {
+		return m, eventSeq
+	}
+	trimmed := bytes.TrimLeft(m, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return m, eventSeq
+	}
+	rest := trimmed[1:]
+
+	var b bytes.Buffer
+	b.Grow(len(m) + 64)
+	b.WriteString("{\"Seq\":")
+	b.WriteString(strconv.FormatInt(eventSeq, 10))
+	b.WriteString(",\"Ts\":")
+	b.WriteString(strconv.FormatInt(nowMicros(), 10))
+	b.WriteString(",\"Mono\":")
+	b.WriteString(strconv.FormatInt(monoMicros(), 10))
+	if len(bytes.TrimLeft(rest, " \t\r\n")) > 0 && bytes.TrimLeft(rest, " \t\r\n")[0] != '}' {
+		b.WriteString(",")
+	}
+	b.Write(rest)
+	return b.Bytes(), eventSeq
+}
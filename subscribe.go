@@ -0,0 +1,298 @@
+// Subscriptions let a client ask for just the traffic it cares about rather
+// than every message from every port. A connection that never subscribes
+// keeps getting everything just like before. Once it subscribes, the hub only
+// fans out the event classes and ports it asked for. System messages such as
+// Version, Hostname, errors and json command replies always get through.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the event classes a client can subscribe to
+const (
+	topicData       = "data"       // raw data coming back from a serial port
+	topicQueue      = "queue"      // Queued, Write, Complete, Error, WipedQueue, etc
+	topicPortList   = "portlist"   // the port list plus Open, Close, OpenFail, AlreadyOpen, Claimed, Released, PortAdded, PortRemoved, OpenVirtual, OpenSim, Shared, Unshared, ShareConnect and ShareDisconnect
+	topicProgrammer = "programmer" // program/programfromurl status
+	topicExec       = "exec"       // exec/execruntime output
+	topicCayenn     = "cayenn"     // Cayenn device announcements
+	topicCommand    = "command"    // echo of text commands sent in by any client
+	topicSystem     = "system"     // everything else. can't be unsubscribed from
+)
+
+var availableTopics = []string{topicData, topicQueue, topicPortList, topicProgrammer, topicExec, topicCayenn, topicCommand}
+
+// msgTopic is what the hub figured out about an outbound message so it
+// can decide which connections want it
+type msgTopic struct {
+	Class string
+	Port  string
+	Cmd   string
+}
+
+// topicProbe picks out just the fields we need to classify a message. The
+// ambiguous ones are raw so a message of any shape still decodes.
+type topicProbe struct {
+	Cmd               string
+	P                 string
+	Port              string
+	D                 json.RawMessage
+	SerialPorts       json.RawMessage
+	ProgrammerStatus  string
+	AssembleStatus    string
+	ExecStatus        string
+	ExecRuntimeStatus string
+	Announce          string
+}
+
+func classifyMsg(m []byte) msgTopic {
+	var probe topicProbe
+	if err := json.Unmarshal(m, &probe); err != nil {
+		// plain text status messages like "Closing serial port COM7"
+		return msgTopic{Class: topicSystem}
+	}
+
+	t := msgTopic{Port: probe.P, Cmd: probe.Cmd}
+	if len(t.Port) == 0 {
+		t.Port = probe.Port
+	}
+
+	switch {
+	case len(probe.ProgrammerStatus) > 0 || len(probe.AssembleStatus) > 0:
+		t.Class = topicProgrammer
+	case len(probe.ExecStatus) > 0 || len(probe.ExecRuntimeStatus) > 0:
+		t.Class = topicExec
+	case len(probe.Announce) > 0:
+		t.Class = topicCayenn
+	case len(probe.SerialPorts) > 0:
+		t.Class = topicPortList
+	case probe.Cmd == "Open" || probe.Cmd == "Close" || probe.Cmd == "OpenFail" || probe.Cmd == "AlreadyOpen" || probe.Cmd == "Claimed" || probe.Cmd == "Released" ||
+		probe.Cmd == "Reconfigured" || probe.Cmd == "Reconnecting" || probe.Cmd == "Reconnected" ||
+		probe.Cmd == "PortAdded" || probe.Cmd == "PortRemoved" || probe.Cmd == "OpenVirtual" || probe.Cmd == "OpenSim" ||
+		probe.Cmd == "Shared" || probe.Cmd == "Unshared" || probe.Cmd == "ShareConnect" || probe.Cmd == "ShareDisconnect":
+		t.Class = topicPortList
+	case len(probe.Cmd) > 0 && len(t.Port) > 0:
+		// Queued, Write, Complete, CompleteFake, Error, WipedQueue, FeedRateOverride...
+		t.Class = topicQueue
+	case len(probe.Cmd) == 0 && len(t.Port) > 0 && len(probe.D) > 0:
+		// SpPortMessage or DataPerLine
+		t.Class = topicData
+	default:
+		t.Class = topicSystem
+	}
+	return t
+}
+
+// subscription is the per connection filter. The zero value lets everything
+// through.
+type subscription struct {
+	mu sync.Mutex
+
+	// nil means every class
+	classes map[string]bool
+
+	// nil means every port except the ones in mutedPorts
+	ports      map[string]bool
+	mutedPorts map[string]bool
+}
+
+type SubscriptionStatus struct {
+	Cmd        string
+	Classes    []string
+	Ports      []string
+	MutedPorts []string
+}
+
+func isTopicClass(s string) bool {
+	for _, t := range availableTopics {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isFiltering tells the hub whether it needs to bother classifying
+// messages for this connection at all
+func (s *subscription) isFiltering() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.classes != nil || s.ports != nil || len(s.mutedPorts) > 0
+}
+
+func (s *subscription) wants(t msgTopic) bool {
+	if t.Class == topicSystem {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.classes != nil && !s.classes[t.Class] {
+		return false
+	}
+	if len(t.Port) > 0 {
+		port := strings.ToLower(t.Port)
+		if s.ports != nil && !s.ports[port] {
+			return false
+		}
+		if s.mutedPorts[port] {
+			return false
+		}
+	}
+	return true
+}
+
+// subscribe adds classes and/or ports. Each item that isn't a known
+// class is taken to be a port name.
+func (s *subscription) subscribe(items []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range items {
+		l := strings.ToLower(item)
+		if isTopicClass(l) {
+			if s.classes == nil {
+				s.classes = make(map[string]bool)
+			}
+			s.classes[l] = true
+		} else {
+			if s.ports == nil {
+				s.ports = make(map[string]bool)
+			}
+			s.ports[l] = true
+			delete(s.mutedPorts, l)
+		}
+	}
+}
+
+// unsubscribe removes classes and/or ports. With no items it goes back
+// to getting everything.
+func (s *subscription) unsubscribe(items []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(items) == 0 {
+		s.classes = nil
+		s.ports = nil
+		s.mutedPorts = nil
+		return
+	}
+	for _, item := range items {
+		l := strings.ToLower(item)
+		if isTopicClass(l) {
+			if s.classes == nil {
+				s.classes = make(map[string]bool)
+				for _, t := range availableTopics {
+					s.classes[t] = true
+				}
+			}
+			delete(s.classes, l)
+		} else if s.ports != nil {
+			delete(s.ports, l)
+		} else {
+			if s.mutedPorts == nil {
+				s.mutedPorts = make(map[string]bool)
+			}
+			s.mutedPorts[l] = true
+		}
+	}
+}
+
+// copyFrom takes over the subscriptions of a connection we are resuming
+func (s *subscription) copyFrom(o *subscription) {
+	o.mu.Lock()
+	classes, ports, mutedPorts := o.classes, o.ports, o.mutedPorts
+	o.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.classes, s.ports, s.mutedPorts = classes, ports, mutedPorts
+}
+
+func (s *subscription) status() SubscriptionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := func(m map[string]bool) []string {
+		arr := []string{}
+		for k := range m {
+			arr = append(arr, k)
+		}
+		sort.Strings(arr)
+		return arr
+	}
+	ss := SubscriptionStatus{Cmd: "Subscriptions", Ports: keys(s.ports), MutedPorts: keys(s.mutedPorts)}
+	if s.classes == nil {
+		ss.Classes = availableTopics
+	} else {
+		ss.Classes = keys(s.classes)
+	}
+	if s.ports == nil {
+		ss.Ports = nil
+	}
+	return ss
+}
+
+// the text versions of the subscription commands. They are per connection
+// so they run right from the connection's reader rather than in the hub.
+func textSubscribe(c *connection, s string) {
+	args := strings.Fields(s)
+	if len(args) < 2 {
+		sendSubscriptionErr(c, "You did not specify any event classes or ports to subscribe to. Classes are "+strings.Join(availableTopics, ", "))
+		return
+	}
+	c.subs.subscribe(args[1:])
+	sendSubscriptionStatus(c)
+}
+
+func textUnsubscribe(c *connection, s string) {
+	c.subs.unsubscribe(strings.Fields(s)[1:])
+	sendSubscriptionStatus(c)
+}
+
+func textSubscriptions(c *connection, s string) {
+	sendSubscriptionStatus(c)
+}
+
+func sendSubscriptionStatus(c *connection) {
+	b, _ := json.Marshal(c.subs.status())
+	h.direct <- directMsg{c, b}
+}
+
+func sendSubscriptionErr(c *connection, msg string) {
+	b, _ := json.Marshal(map[string]string{"Error": msg})
+	h.direct <- directMsg{c, b}
+}
+
+type jsonCmdSubscribeArgs struct {
+	Classes []string
+	Ports   []string
+}
+
+func jsonCmdSubscribe(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdSubscribeArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	for _, cl := range a.Classes {
+		if !isTopicClass(strings.ToLower(cl)) {
+			return nil, errors.New("Unknown event class " + cl + ". Classes are " + strings.Join(availableTopics, ", "))
+		}
+	}
+	c.subs.subscribe(append(a.Classes, a.Ports...))
+	return c.subs.status(), nil
+}
+
+func jsonCmdUnsubscribe(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdSubscribeArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	c.subs.unsubscribe(append(a.Classes, a.Ports...))
+	return c.subs.status(), nil
+}
+
+func jsonCmdSubscriptions(c *connection, args json.RawMessage) (interface{}, error) {
+	return c.subs.status(), nil
+}
@@ -0,0 +1,206 @@
+// Virtual ports. openvirtual makes a pseudo terminal pair and opens one end
+// of it like any other serial port, with whatever buffer algorithm you like.
+// The other end, i.e. /dev/pts/3, is handed back so another program can
+// attach to it. That lets you work on a UI or a buffer algorithm without any
+// hardware, or put legacy desktop software that only talks to a serial port
+// on the other end of SPJS.
+//
+// Anything that isn't a serial port the OS knows about is registered here
+// before it's opened, and spHandlerOpen() gets its io from openPortIo()
+// rather than going to the OS. The port is forgotten again once it's closed.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnlauer/goserial"
+)
+
+const deviceClassVirtual = "virtual"
+
+// baud we report for virtual ports if you don't give one. a pty doesn't
+// care what it is.
+var virtualDefaultBaud = 115200
+
+type virtualPort struct {
+	Name        string
+	Path        string // the other end that programs attach to, if there is one
+	DeviceClass string
+	Friendly    string
+	open        func(conf *serial.Config, ls LineSettings) (io.ReadWriteCloser, error)
+}
+
+var virtualPorts = struct {
+	sync.Mutex
+	m map[string]*virtualPort
+}{m: make(map[string]*virtualPort)}
+
+type VirtualPortMsg struct {
+	Cmd         string // OpenVirtual
+	Port        string
+	Path        string
+	DeviceClass string
+	Desc        string
+}
+
+type jsonCmdOpenVirtualArgs struct {
+	Port            string
+	Baud            int // leave out for 115200
+	BufferAlgorithm string
+}
+
+func registerVirtualPort(vp *virtualPort) error {
+	virtualPorts.Lock()
+	defer virtualPorts.Unlock()
+	key := strings.ToLower(vp.Name)
+	if _, isFound := virtualPorts.m[key]; isFound {
+		return errors.New("There is already a virtual port called " + vp.Name)
+	}
+	virtualPorts.m[key] = vp
+	return nil
+}
+
+func forgetVirtualPort(portname string) {
+	virtualPorts.Lock()
+	delete(virtualPorts.m, strings.ToLower(portname))
+	virtualPorts.Unlock()
+}
+
+func findVirtualPort(portname string) (*virtualPort, bool) {
+	virtualPorts.Lock()
+	defer virtualPorts.Unlock()
+	vp, isFound := virtualPorts.m[strings.ToLower(portname)]
+	return vp, isFound
+}
+
+// virtualPortList gives back the virtual ports in the form the port list
+// wants them
+func virtualPortList() []OsSerialPort {
+	virtualPorts.Lock()
+	defer virtualPorts.Unlock()
+	list := []OsSerialPort{}
+	for _, vp := range virtualPorts.m {
+		item := OsSerialPort{Name: vp.Name, FriendlyName: vp.Friendly, DeviceClass: vp.DeviceClass}
+		if len(vp.Path) > 0 {
+			item.RelatedNames = []string{vp.Path}
+		}
+		list = append(list, item)
+	}
+	return list
+}
+
+// openPortIo opens a registered virtual port, a network port, or else the
+// serial port
+func openPortIo(conf *serial.Config, ls LineSettings) (io.ReadWriteCloser, error) {
+	if vp, isFound := findVirtualPort(conf.Name); isFound {
+		return vp.open(conf, ls)
+	}
+	if isNetPort(conf.Name) {
+		return openNetPort(conf, ls)
+	}
+	return openSerialLine(conf, ls)
+}
+
+// openRegistered opens a port that was just registered and waits to hear
+// how it went. The port is forgotten if it didn't open.
+func openRegistered(vp *virtualPort, baud int, buftype string) error {
+	done := make(chan error, 1)
+	go spHandlerOpen(vp.Name, baud, buftype, PortOptions{}, false, done)
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(jsonCmdOpenTimeout):
+		err = errors.New("Timed out waiting for port " + vp.Name + " to open")
+	}
+	if err != nil {
+		forgetVirtualPort(vp.Name)
+	}
+	return err
+}
+
+func spOpenVirtual(portname string, baud int, buftype string) (VirtualPortMsg, error) {
+	var msg VirtualPortMsg
+	if len(portname) == 0 {
+		return msg, errors.New("You did not give a name for the virtual port")
+	}
+	if _, isFound := findPortByName(portname); isFound {
+		return msg, errors.New("There is already a port open called " + portname)
+	}
+	if baud <= 0 {
+		baud = virtualDefaultBaud
+	}
+
+	pty, path, err := openPty()
+	if err != nil {
+		return msg, errors.New("Could not make a pseudo terminal for virtual port " + portname + ". " + err.Error())
+	}
+	isUsed := false
+	vp := &virtualPort{Name: portname, Path: path, DeviceClass: deviceClassVirtual,
+		Friendly: "Virtual port " + portname + " (" + path + ")"}
+	vp.open = func(conf *serial.Config, ls LineSettings) (io.ReadWriteCloser, error) {
+		// the pty only goes to one serport. it's gone once that closes.
+		if isUsed {
+			return nil, errors.New("Virtual port " + portname + " was already opened")
+		}
+		isUsed = true
+		return pty, nil
+	}
+	if err := registerVirtualPort(vp); err != nil {
+		pty.Close()
+		return msg, err
+	}
+	if err := openRegistered(vp, baud, buftype); err != nil {
+		pty.Close()
+		return msg, err
+	}
+	log.Printf("Opened virtual port %v. Its other end is %v\n", portname, path)
+
+	msg = VirtualPortMsg{Cmd: "OpenVirtual", Port: portname, Path: path, DeviceClass: deviceClassVirtual,
+		Desc: "Opened a virtual port. Attach your program to " + path}
+	b, _ := json.Marshal(msg)
+	h.broadcastSys <- b
+	return msg, nil
+}
+
+// textOpenVirtual handles openvirtual, i.e.
+//   openvirtual vgrbl
+//   openvirtual vgrbl 115200 grbl
+func textOpenVirtual(c *connection, s string) {
+	args := strings.Fields(s)
+	if len(args) < 2 {
+		spErr("You did not give a name for the virtual port")
+		return
+	}
+	baud := 0
+	buftype := ""
+	rest := args[2:]
+	if len(rest) > 0 {
+		if b, err := strconv.Atoi(rest[0]); err == nil {
+			baud = b
+			rest = rest[1:]
+		}
+	}
+	if len(rest) > 0 {
+		buftype = rest[0]
+	}
+	if _, err := spOpenVirtual(args[1], baud, buftype); err != nil {
+		spErr(err.Error())
+	}
+}
+
+func jsonCmdOpenVirtual(c *connection, args json.RawMessage) (interface{}, error) {
+	var a jsonCmdOpenVirtualArgs
+	if err := parseJsonCmdArgs(args, &a); err != nil {
+		return nil, err
+	}
+	return spOpenVirtual(a.Port, a.Baud, a.BufferAlgorithm)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// ptyPort is our end of a pseudo terminal. We hold the other end open too,
+// or reads on ours would fail until a program attaches, and set it raw so
+// it passes bytes through like a serial port rather than a terminal.
+type ptyPort struct {
+	*os.File
+	other *os.File
+}
+
+func (p *ptyPort) Close() error {
+	p.other.Close()
+	return p.File.Close()
+}
+
+// Reconfigure is a no-op. A pty has no line and the program on the other
+// end can set whatever baud it likes.
+func (p *ptyPort) Reconfigure(baud int, ls LineSettings) error {
+	return nil
+}
+
+// openPty gives back our end of a new pseudo terminal and the path of the
+// other end, i.e. /dev/pts/3
+func openPty() (io.ReadWriteCloser, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	path := "/dev/pts/" + strconv.Itoa(int(n))
+
+	other, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	if err := setRaw(other); err != nil {
+		other.Close()
+		master.Close()
+		return nil, "", err
+	}
+	return &ptyPort{File: master, other: other}, path, nil
+}
+
+// setRaw does what cfmakeraw does
+func setRaw(f *os.File) error {
+	var t syscall.Termios
+	if err := ioctl(f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		return err
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	return ioctl(f.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func openPty() (io.ReadWriteCloser, string, error) {
+	return nil, "", errors.New("Virtual ports are only supported on Linux")
+}